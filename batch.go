@@ -0,0 +1,50 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// defaultBatchWorkers is the number of concurrent uploads UploadBatch runs when no worker count is given
+const defaultBatchWorkers = 8
+
+// UploadItem is a single upload in a batch. The content is read from Reader, or from Data when Reader is nil
+type UploadItem struct {
+	Key     string
+	Reader  io.Reader
+	Data    []byte
+	Options []UploadOption
+}
+
+// UploadBatch uploads the items with a pool of workers, which cuts the per call overhead of uploading many small files
+// one at a time. The returned errors line up with the items, holding nil for each item that was uploaded.
+// A workers count of zero or less uses 8 workers
+func UploadBatch(fs FileStore, items []UploadItem, workers int) []error {
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+	errs := make([]error, len(items))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				item := items[i]
+				reader := item.Reader
+				if reader == nil {
+					reader = bytes.NewReader(item.Data)
+				}
+				_, errs[i] = fs.Upload(reader, item.Key, item.Options...)
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,93 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyStore records the most uploads running at once and fails uploads to keys containing "bad"
+type concurrencyStore struct {
+	FileStore
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (s *concurrencyStore) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxSeen {
+		s.maxSeen = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if strings.Contains(key, "bad") {
+		return nil, fmt.Errorf("upload of %s failed", key)
+	}
+	return s.FileStore.Upload(reader, key, opts...)
+}
+
+func TestUploadBatch(t *testing.T) {
+	inner := newTestBlockFS(t)
+	fs := &concurrencyStore{FileStore: inner}
+	var items []UploadItem
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/artifacts/%d.txt", i)
+		if i%4 == 3 {
+			key = fmt.Sprintf("/artifacts/bad-%d.txt", i)
+		}
+		item := UploadItem{Key: key, Data: []byte(key)}
+		if i%2 == 0 {
+			item = UploadItem{Key: key, Reader: strings.NewReader(key)}
+		}
+		items = append(items, item)
+	}
+	errs := UploadBatch(fs, items, 3)
+	if len(errs) != len(items) {
+		t.Fatalf("expected an error slot for each item, got %d", len(errs))
+	}
+	for i, item := range items {
+		bad := strings.Contains(item.Key, "bad")
+		if bad && (errs[i] == nil || !strings.Contains(errs[i].Error(), item.Key)) {
+			t.Errorf("expected the error for %s at %d, got %v", item.Key, i, errs[i])
+		}
+		if bad {
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("expected %s to upload, got %v", item.Key, errs[i])
+		}
+		content, err := GetObjectString(inner, item.Key, 0)
+		if err != nil || content != item.Key {
+			t.Errorf("expected %s to be uploaded, got %q %v", item.Key, content, err)
+		}
+	}
+	if fs.maxSeen > 3 {
+		t.Errorf("expected at most 3 uploads at once, got %d", fs.maxSeen)
+	}
+	if fs.maxSeen < 2 {
+		t.Errorf("expected the uploads to run concurrently, got %d at most", fs.maxSeen)
+	}
+}
+
+func TestUploadBatchToS3(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	items := []UploadItem{{Key: "/a.txt", Data: []byte("a")}, {Key: "/b.txt", Data: []byte("b")}}
+	for i, err := range UploadBatch(fs, items, 0) {
+		if err != nil {
+			t.Errorf("expected item %d to upload, got %v", i, err)
+		}
+	}
+	if mock.object("a.txt") == nil || mock.object("b.txt") == nil {
+		t.Error("expected both items in the bucket")
+	}
+}
@@ -0,0 +1,306 @@
+package filestore
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheFileSuffix is the extension of the files the cache writes, so stale files from an earlier run can be told apart
+const cacheFileSuffix = ".cache"
+
+// CacheConfig configures a store wrapped with Cached
+type CacheConfig struct {
+	// Dir is the local directory the objects are cached in
+	Dir string
+	// MaxBytes is the total size of the cached objects. The least recently used objects are evicted to stay under it.
+	// Zero means no limit
+	MaxBytes int64
+	// TTL is how long a cached object is served before it is downloaded again. Zero means entries don't expire
+	TTL time.Duration
+}
+
+// Cached wraps a store so that objects read with GetObject are saved to a local directory while they are read and
+// served from there afterwards. Each GetObject still makes a GetObjectInfo call to check the ETag, modified time and size
+// of the object, so changed objects are downloaded again. Writes through the wrapper evict the paths they touch.
+// Cached files from a previous run in the directory are removed, since the cache can't know whether they are current
+func Cached(fs FileStore, config CacheConfig) (FileStore, error) {
+	if err := os.MkdirAll(config.Dir, defaultDirMode); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(config.Dir, "*"+cacheFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stale {
+		os.Remove(f)
+	}
+	return &cachingFS{
+		fs:      fs,
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+type cachingFS struct {
+	fs      FileStore
+	config  CacheConfig
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type cacheEntry struct {
+	path      string
+	validator string
+	size      int64
+	cachedAt  time.Time
+}
+
+// validator identifies the version of an object, since not every backend provides an ETag
+func validator(info *ObjectInfo) string {
+	return fmt.Sprintf("%s|%d|%d", info.ETag, info.ModTime.UnixNano(), info.Size)
+}
+
+func (c *cachingFS) cacheFile(path string) string {
+	return filepath.Join(c.config.Dir, fmt.Sprintf("%x%s", sha256.Sum256([]byte(path)), cacheFileSuffix))
+}
+
+// lookup returns the cached file for the path when it holds the version identified by the validator and hasn't expired
+func (c *cachingFS) lookup(path string, version string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.validator != version || (c.config.TTL > 0 && time.Since(entry.cachedAt) > c.config.TTL) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	f, err := os.Open(c.cacheFile(path))
+	if err != nil {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return f, true
+}
+
+// add moves the fully read temp file into the cache and evicts the least recently used entries to make room
+func (c *cachingFS) add(path string, version string, tmpPath string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[path]; ok {
+		c.removeElement(elem)
+	}
+	if c.config.MaxBytes > 0 && size > c.config.MaxBytes {
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, c.cacheFile(path)); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	c.entries[path] = c.lru.PushFront(&cacheEntry{
+		path:      path,
+		validator: version,
+		size:      size,
+		cachedAt:  time.Now(),
+	})
+	c.size += size
+	for c.config.MaxBytes > 0 && c.size > c.config.MaxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// evict removes the cached paths that are the path or are under it
+func (c *cachingFS) evict(paths ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range paths {
+		dir := strings.TrimSuffix(p, "/") + "/"
+		for cached, elem := range c.entries {
+			if cached == p || strings.HasPrefix(cached, dir) {
+				c.removeElement(elem)
+			}
+		}
+	}
+}
+
+// removeElement drops the entry and its file. The caller must hold the lock
+func (c *cachingFS) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.path)
+	c.size -= entry.size
+	os.Remove(c.cacheFile(entry.path))
+}
+
+func (c *cachingFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject, error) {
+	return c.fs.GetDir(path, recursive)
+}
+
+func (c *cachingFS) GetDirPage(path string, token string, pageSize int) ([]FileStoreResultObject, string, error) {
+	return c.fs.GetDirPage(path, token, pageSize)
+}
+
+func (c *cachingFS) ListDirs(path string) ([]string, error) {
+	return c.fs.ListDirs(path)
+}
+
+// GetObject serves the object from the cache when the cached copy is current, and otherwise reads it from the store,
+// saving it to the cache as it is read. The object is only cached once the caller has read it to the end
+func (c *cachingFS) GetObject(path string) (io.ReadCloser, error) {
+	info, err := c.fs.GetObjectInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	version := validator(info)
+	if f, ok := c.lookup(path, version); ok {
+		return f, nil
+	}
+	body, err := c.fs.GetObject(path)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(c.config.Dir, "fill-*.tmp")
+	if err != nil {
+		//the cache is an optimization, so serve the object uncached rather than failing the read
+		return body, nil
+	}
+	return &cacheFillReader{
+		body:    body,
+		tmp:     tmp,
+		cache:   c,
+		path:    path,
+		version: version,
+	}, nil
+}
+
+// cacheFillReader copies the body into a temp file as it is read and adds it to the cache on Close if it was read to the end
+type cacheFillReader struct {
+	body     io.ReadCloser
+	tmp      *os.File
+	cache    *cachingFS
+	path     string
+	version  string
+	size     int64
+	eof      bool
+	writeErr error
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.writeErr == nil {
+		_, r.writeErr = r.tmp.Write(p[:n])
+		r.size += int64(n)
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *cacheFillReader) Close() error {
+	err := r.body.Close()
+	closeErr := r.tmp.Close()
+	if r.eof && r.writeErr == nil && closeErr == nil {
+		r.cache.add(r.path, r.version, r.tmp.Name(), r.size)
+	} else {
+		os.Remove(r.tmp.Name())
+	}
+	return err
+}
+
+func (c *cachingFS) GetObjectInfo(path string) (*ObjectInfo, error) {
+	return c.fs.GetObjectInfo(path)
+}
+
+func (c *cachingFS) Size(path string) (int64, error) {
+	return c.fs.Size(path)
+}
+
+func (c *cachingFS) PutObject(path string, data []byte, opts ...UploadOption) (*FileOperationOutput, error) {
+	c.evict(path)
+	return c.fs.PutObject(path, data, opts...)
+}
+
+func (c *cachingFS) DeleteObjects(path ...string) error {
+	c.evict(path...)
+	return c.fs.DeleteObjects(path...)
+}
+
+func (c *cachingFS) Append(path string, data []byte) error {
+	c.evict(path)
+	return c.fs.Append(path, data)
+}
+
+func (c *cachingFS) CreateDir(path string) error {
+	return c.fs.CreateDir(path)
+}
+
+func (c *cachingFS) CreateEmptyObject(path string) error {
+	c.evict(path)
+	return c.fs.CreateEmptyObject(path)
+}
+
+func (c *cachingFS) Touch(path string) error {
+	c.evict(path)
+	return c.fs.Touch(path)
+}
+
+func (c *cachingFS) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	c.evict(key)
+	return c.fs.Upload(reader, key, opts...)
+}
+
+func (c *cachingFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	c.evict(key)
+	return c.fs.UploadFile(filePath, key, opts...)
+}
+
+func (c *cachingFS) Glob(pattern string) ([]FileStoreResultObject, error) {
+	return c.fs.Glob(pattern)
+}
+
+func (c *cachingFS) Walk(path string, vistorFunction FileVisitFunction) error {
+	return c.fs.Walk(path, vistorFunction)
+}
+
+func (c *cachingFS) WalkDir(path string, visitorFunction WalkDirFunction) error {
+	return c.fs.WalkDir(path, visitorFunction)
+}
+
+func (c *cachingFS) WalkContext(ctx context.Context, path string, vistorFunction FileVisitFunction) error {
+	return c.fs.WalkContext(ctx, path, vistorFunction)
+}
+
+func (c *cachingFS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
+	c.evict(u.ObjectPath)
+	return c.fs.InitializeObjectUpload(u)
+}
+
+func (c *cachingFS) WriteChunk(u UploadConfig) (UploadResult, error) {
+	return c.fs.WriteChunk(u)
+}
+
+func (c *cachingFS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
+	c.evict(u.ObjectPath)
+	return c.fs.CompleteObjectUpload(u)
+}
+
+func (c *cachingFS) Close() error {
+	return c.fs.Close()
+}
@@ -0,0 +1,155 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCache wraps a mock s3 store with a cache in a new temp directory
+func newTestCache(t *testing.T, config CacheConfig) (FileStore, *mockS3) {
+	t.Helper()
+	s3fs, mock := newTestS3FS(t)
+	config.Dir = t.TempDir()
+	fs, err := Cached(s3fs, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, mock
+}
+
+// readObject reads the object to the end and closes it
+func readObject(t *testing.T, fs FileStore, path string) string {
+	t.Helper()
+	content, err := GetObjectString(fs, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// cachedFiles returns the number of files in the cache directory
+func cachedFiles(t *testing.T, fs FileStore) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(fs.(*cachingFS).config.Dir, "*"+cacheFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestCachedHitAfterFullRead(t *testing.T) {
+	fs, mock := newTestCache(t, CacheConfig{})
+	mock.put("data.txt", []byte("cached content"))
+	for i := 0; i < 3; i++ {
+		if content := readObject(t, fs, "/data.txt"); content != "cached content" {
+			t.Fatalf("read %d: expected the content, got %q", i, content)
+		}
+	}
+	if mock.count("GetObject") != 1 {
+		t.Errorf("expected the reads after the first to be served from the cache, got %d gets", mock.count("GetObject"))
+	}
+	if mock.count("HeadObject") != 3 {
+		t.Errorf("expected every read to check the object, got %d heads", mock.count("HeadObject"))
+	}
+	if cachedFiles(t, fs) != 1 {
+		t.Errorf("expected one cached file, got %d", cachedFiles(t, fs))
+	}
+}
+
+func TestCachedPartialReadNotCached(t *testing.T) {
+	fs, mock := newTestCache(t, CacheConfig{})
+	mock.put("data.txt", []byte("cached content"))
+	reader, err := fs.GetObject("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cachedFiles(t, fs) != 0 {
+		t.Errorf("expected a partial read not to be cached, got %d cached files", cachedFiles(t, fs))
+	}
+	entries, err := ioutil.ReadDir(fs.(*cachingFS).config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the fill file to be removed, got %d entries", len(entries))
+	}
+	if content := readObject(t, fs, "/data.txt"); content != "cached content" {
+		t.Errorf("expected the content, got %q", content)
+	}
+	if mock.count("GetObject") != 2 {
+		t.Errorf("expected the read after a partial read to get the object, got %d gets", mock.count("GetObject"))
+	}
+}
+
+func TestCachedEvictsUnderMaxBytes(t *testing.T) {
+	fs, mock := newTestCache(t, CacheConfig{MaxBytes: 10})
+	mock.put("a", []byte("aaaaaa"))
+	mock.put("b", []byte("bbbbbb"))
+	mock.put("large", []byte("larger than the cache"))
+	readObject(t, fs, "/a")
+	//caching b takes the cache over MaxBytes, so the least recently used a is evicted
+	readObject(t, fs, "/b")
+	readObject(t, fs, "/b")
+	if mock.count("GetObject") != 2 {
+		t.Errorf("expected b to be served from the cache, got %d gets", mock.count("GetObject"))
+	}
+	readObject(t, fs, "/a")
+	if mock.count("GetObject") != 3 {
+		t.Errorf("expected a to have been evicted, got %d gets", mock.count("GetObject"))
+	}
+	readObject(t, fs, "/large")
+	if cachedFiles(t, fs) != 1 {
+		t.Errorf("expected an object larger than the cache not to be cached, got %d cached files", cachedFiles(t, fs))
+	}
+	if size := fs.(*cachingFS).size; size > 10 {
+		t.Errorf("expected the cache to stay under MaxBytes, got %d bytes", size)
+	}
+}
+
+func TestCachedTTLMiss(t *testing.T) {
+	fs, mock := newTestCache(t, CacheConfig{TTL: 50 * time.Millisecond})
+	mock.put("data.txt", []byte("cached content"))
+	readObject(t, fs, "/data.txt")
+	readObject(t, fs, "/data.txt")
+	if mock.count("GetObject") != 1 {
+		t.Fatalf("expected a read within the TTL to be served from the cache, got %d gets", mock.count("GetObject"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	readObject(t, fs, "/data.txt")
+	if mock.count("GetObject") != 2 {
+		t.Errorf("expected an expired entry to be read again, got %d gets", mock.count("GetObject"))
+	}
+}
+
+func TestCachedPutObjectEvicts(t *testing.T) {
+	fs, mock := newTestCache(t, CacheConfig{})
+	mock.put("dir/data.txt", []byte("original"))
+	readObject(t, fs, "/dir/data.txt")
+	if cachedFiles(t, fs) != 1 {
+		t.Fatalf("expected the object to be cached, got %d cached files", cachedFiles(t, fs))
+	}
+	if _, err := fs.PutObject("/dir/data.txt", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if cachedFiles(t, fs) != 0 {
+		t.Errorf("expected the put to evict the cached object, got %d cached files", cachedFiles(t, fs))
+	}
+	if content := readObject(t, fs, "/dir/data.txt"); content != "replaced" {
+		t.Errorf("expected the new content, got %q", content)
+	}
+	//deleting a directory evicts the objects under it
+	if err := fs.DeleteObjects("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if cachedFiles(t, fs) != 0 {
+		t.Errorf("expected the delete to evict the objects under the directory, got %d cached files", cachedFiles(t, fs))
+	}
+}
@@ -0,0 +1,142 @@
+package filestore
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when the content read doesn't match the expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumAlgo selects the hash ComputeChecksum uses
+type ChecksumAlgo string
+
+const (
+	ChecksumMD5    ChecksumAlgo = "MD5"
+	ChecksumSHA256 ChecksumAlgo = "SHA256"
+	ChecksumCRC32  ChecksumAlgo = "CRC32"
+)
+
+func (algo ChecksumAlgo) newHash() (hash.Hash, error) {
+	switch algo {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", string(algo))
+}
+
+// checksumHeader returns the s3 header and base64 value that ask s3 to validate the data with the algorithm.
+// MD5 has no header of its own since PutObject always sends a Content-MD5, so the header is empty
+func checksumHeader(algo ChecksumAlgo, data []byte) (string, string, error) {
+	h, err := algo.newHash()
+	if err != nil {
+		return "", "", err
+	}
+	if algo == ChecksumMD5 {
+		return "", "", nil
+	}
+	h.Write(data)
+	return "x-amz-checksum-" + strings.ToLower(string(algo)), base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// ComputeChecksum streams the object at path through the hash selected by algo and returns the hex encoded checksum.
+// The object is read from the store, so on s3 the whole object is downloaded rather than trusting the stored ETag
+func ComputeChecksum(fs FileStore, path string, algo ChecksumAlgo) (string, error) {
+	h, err := algo.newHash()
+	if err != nil {
+		return "", err
+	}
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// GetObjectVerified returns the object body wrapped in a reader that computes the md5 as it is read.
+// Close returns ErrChecksumMismatch when the body was read to the end and its md5 differs from expectedMd5
+func GetObjectVerified(fs FileStore, path string, expectedMd5 string) (io.ReadCloser, error) {
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReader(reader, path, expectedMd5), nil
+}
+
+type verifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	path     string
+	expected string
+	eof      bool
+}
+
+func newVerifyingReader(body io.ReadCloser, path string, expectedMd5 string) *verifyingReader {
+	return &verifyingReader{
+		body:     body,
+		hash:     md5.New(),
+		path:     path,
+		expected: strings.ToLower(strings.Trim(expectedMd5, "\"")),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		v.eof = true
+	}
+	return n, err
+}
+
+// Close closes the body and verifies the checksum. A body that wasn't read to the end can't be verified and is only closed
+func (v *verifyingReader) Close() error {
+	if err := v.body.Close(); err != nil {
+		return err
+	}
+	if !v.eof {
+		return nil
+	}
+	actual := fmt.Sprintf("%x", v.hash.Sum(nil))
+	if actual != v.expected {
+		return fmt.Errorf("%w: %s expected md5 %s but read %s", ErrChecksumMismatch, v.path, v.expected, actual)
+	}
+	return nil
+}
+
+// hashingReader computes the md5 and size of the content read through it, so uploads can report both without buffering
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func newHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{reader: reader, hash: md5.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashingReader) md5() string {
+	return fmt.Sprintf("%x", h.hash.Sum(nil))
+}
@@ -0,0 +1,190 @@
+package filestore
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestComputeChecksumKnownVectors(t *testing.T) {
+	fs := newTestBlockFS(t)
+	tests := []struct {
+		data     string
+		algo     ChecksumAlgo
+		expected string
+	}{
+		{"", ChecksumSHA256, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", ChecksumSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", ChecksumSHA256, "248d6a61d20638b8e5c026930c3e6039a33ce45964ff2167f6ecedd419db06c1"},
+		{"", ChecksumMD5, "d41d8cd98f00b204e9800998ecf8427e"},
+		{"abc", ChecksumMD5, "900150983cd24fb0d6963f7d28e17f72"},
+		{"123456789", ChecksumCRC32, "cbf43926"},
+	}
+	for _, test := range tests {
+		if _, err := fs.PutObject("/vector", []byte(test.data)); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := ComputeChecksum(fs, "/vector", test.algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != test.expected {
+			t.Errorf("%s of %q is %s, expected %s", test.algo, test.data, sum, test.expected)
+		}
+	}
+}
+
+func TestComputeChecksumLargeFile(t *testing.T) {
+	fs := newTestBlockFS(t)
+	//one million a's is a standard SHA256 test vector, and is larger than any single read
+	if _, err := fs.PutObject("/million", []byte(strings.Repeat("a", 1000000))); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ComputeChecksum(fs, "/million", ChecksumSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "cdc76e5c9914fb9281a1c7e284d73e67f1809a48a497200e046d39ccc7112cd0"; sum != expected {
+		t.Errorf("sha256 is %s, expected %s", sum, expected)
+	}
+}
+
+func TestComputeChecksumUnsupported(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/file", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ComputeChecksum(fs, "/file", ChecksumAlgo("SHA1")); err == nil {
+		t.Error("expected an error for an unsupported algorithm")
+	}
+}
+
+func TestComputeChecksumS3(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("abc", []byte("abc"))
+	sum, err := ComputeChecksum(fs, "/abc", ChecksumSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; sum != expected {
+		t.Errorf("sha256 is %s, expected %s", sum, expected)
+	}
+}
+
+func TestGetObjectVerified(t *testing.T) {
+	fs := newTestBlockFS(t)
+	output, err := fs.PutObject("/file", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GetObjectVerified(fs, "/file", output.Md5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("expected the md5 to match, got %v", err)
+	}
+
+	reader, err = GetObjectVerified(fs, "/file", "d41d8cd98f00b204e9800998ecf8427e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestS3GetObjectVerifiedETag(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("good", []byte("content"))
+	corrupted := mock.put("corrupted", []byte("content"))
+	corrupted.data = []byte("c0ntent")
+	multipart := mock.put("multipart", []byte("content"))
+	multipart.etag = `"0123-2"`
+	tests := []struct {
+		key      string
+		mismatch bool
+	}{
+		{"/good", false},
+		{"/corrupted", true},
+		{"/multipart", false},
+	}
+	for _, test := range tests {
+		reader, err := fs.GetObjectVerifiedETag(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+		err = reader.Close()
+		if test.mismatch && !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: expected ErrChecksumMismatch, got %v", test.key, err)
+		}
+		if !test.mismatch && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.key, err)
+		}
+	}
+}
+
+func TestPutObjectWithChecksumSendsHeader(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	if _, err := fs.PutObject("/abc", []byte("abc"), WithChecksum(ChecksumSHA256)); err != nil {
+		t.Fatal(err)
+	}
+	header := mock.headers[len(mock.headers)-1].Get("x-amz-checksum-sha256")
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; hex.EncodeToString(sum) != expected {
+		t.Errorf("x-amz-checksum-sha256 is %x, expected %s", sum, expected)
+	}
+
+	if _, err := fs.PutObject("/abc", []byte("abc"), WithChecksum(ChecksumMD5)); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.headers[len(mock.headers)-1]) != 0 {
+		t.Errorf("md5 is sent as the Content-MD5, expected no checksum header, got %v", mock.headers[len(mock.headers)-1])
+	}
+}
+
+func TestUploadWithChecksumNotSupportedOnS3(t *testing.T) {
+	fs, _ := newTestS3FS(t)
+	_, err := fs.Upload(strings.NewReader("abc"), "/abc", WithChecksum(ChecksumSHA256))
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestS3PutObjectContentMD5(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	data := []byte("payload that must arrive intact")
+	if _, err := fs.PutObject("/data.txt", data); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data)
+	expected := base64.StdEncoding.EncodeToString(sum[:])
+	if obj := mock.object("data.txt"); obj.contentMD5 != expected {
+		t.Errorf("expected the Content-MD5 %s of the payload, got %q", expected, obj.contentMD5)
+	}
+	//compressed content is sent with the md5 of the bytes that are actually uploaded
+	if _, err := fs.PutObject("/data.txt.gz", data, WithCompression()); err != nil {
+		t.Fatal(err)
+	}
+	obj := mock.object("data.txt.gz")
+	compressedSum := md5.Sum(obj.data)
+	if obj.contentMD5 != base64.StdEncoding.EncodeToString(compressedSum[:]) {
+		t.Errorf("expected the Content-MD5 of the compressed body, got %q", obj.contentMD5)
+	}
+}
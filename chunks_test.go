@@ -0,0 +1,269 @@
+package filestore
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// startS3Upload initializes an upload and writes the chunks, returning the upload id and the etag of each chunk
+func startS3Upload(t *testing.T, fs *S3FS, key string, chunks ...[]byte) (string, []string) {
+	t.Helper()
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var etags []string
+	for i, chunk := range chunks {
+		written, err := fs.WriteChunk(UploadConfig{ObjectPath: key, UploadId: result.ID, ChunkId: int64(i), Data: chunk})
+		if err != nil {
+			t.Fatal(err)
+		}
+		etags = append(etags, written.ID)
+	}
+	return result.ID, etags
+}
+
+func TestS3CompleteObjectUpload(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	id, etags := startS3Upload(t, fs, "/chunked", []byte("only chunk"))
+	err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("chunked"); obj == nil || string(obj.data) != "only chunk" {
+		t.Errorf("expected the completed object, got %v", obj)
+	}
+}
+
+func TestS3CompleteObjectUploadRejectsBadChunks(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	id, etags := startS3Upload(t, fs, "/chunked", make([]byte, s3MinPartSize))
+	//chunk 1 is never written, leaving a gap between the parts of chunks 0 and 2
+	written, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: id, ChunkId: 2, Data: make([]byte, s3MinPartSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		chunks   []string
+		expected string
+	}{
+		{"no chunks", nil, "no chunks provided"},
+		{"empty etag", []string{etags[0], "", written.ID}, "missing chunk 1 of 3"},
+		{"gap", []string{etags[0], etags[0], written.ID}, "missing chunk 1 of 3"},
+		{"wrong etag", []string{`"0123"`}, "chunk 0 of 1 does not match"},
+		{"extra parts", []string{etags[0]}, "upload has 2 parts written but 1 chunks were provided"},
+	}
+	for _, test := range tests {
+		err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: test.chunks})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+	if mock.count("CompleteMultipartUpload") != 0 {
+		t.Errorf("expected invalid chunks to be rejected before completing, got %d completions", mock.count("CompleteMultipartUpload"))
+	}
+}
+
+func TestS3CompleteObjectUploadShortChunkBeforeLast(t *testing.T) {
+	fs, _ := newTestS3FS(t)
+	id, etags := startS3Upload(t, fs, "/chunked", []byte("short"), []byte("last"))
+	err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags})
+	if err == nil || !strings.Contains(err.Error(), "only the last chunk can be less than") {
+		t.Errorf("expected a short chunk before the last to be rejected, got %v", err)
+	}
+}
+
+func TestBlockFSCompleteObjectUploadMissingChunk(t *testing.T) {
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), ChunkSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{0, 2} {
+		if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: result.ID, ChunkId: id, Data: []byte("abcd")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: result.ID, ObjectPath: "/chunked"})
+	if err == nil || !strings.Contains(err.Error(), "missing chunks 1 of 3") {
+		t.Errorf("expected the missing chunk to be reported, got %v", err)
+	}
+}
+
+func TestBlockFSChunkSizeOffsets(t *testing.T) {
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), ChunkSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: result.ID, ChunkId: 0, Data: []byte("toolong")}); err == nil {
+		t.Error("expected a chunk larger than the chunk size to be rejected")
+	}
+	//chunks written out of order land at their chunk id times the chunk size
+	chunks := map[int64]string{2: "gh", 0: "abc", 1: "def"}
+	for _, id := range []int64{2, 0, 1} {
+		if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: result.ID, ChunkId: id, Data: []byte(chunks[id])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: result.ID, ObjectPath: "/chunked"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectBytes(fs, "/chunked", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "abcdefgh" {
+		t.Errorf("expected abcdefgh, got %q", content)
+	}
+}
+
+func TestS3ChunkSize(t *testing.T) {
+	if _, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, ChunkSize: s3MinPartSize - 1}, newMockS3()); err == nil {
+		t.Error("expected a chunk size under the s3 minimum part size to be rejected")
+	}
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, ChunkSize: s3MinPartSize}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.ChunkSize() != s3MinPartSize {
+		t.Errorf("expected the configured chunk size, got %d", fs.ChunkSize())
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: result.ID, ChunkId: 0, Data: make([]byte, s3MinPartSize+1)})
+	if err == nil || !strings.Contains(err.Error(), "larger than the configured chunk size") {
+		t.Errorf("expected a chunk larger than the chunk size to be rejected, got %v", err)
+	}
+	if mock.count("UploadPart") != 0 {
+		t.Errorf("expected the oversized chunk not to be sent, got %d parts", mock.count("UploadPart"))
+	}
+
+	id, etags := startS3Upload(t, fs, "/chunked", make([]byte, s3MinPartSize), make([]byte, s3MinPartSize), []byte("last"))
+	parts := mock.uploads[id].parts
+	if len(parts) != 3 || len(parts[1]) != int(s3MinPartSize) || len(parts[3]) != 4 {
+		t.Errorf("expected a part for each chunk, numbered from 1, got %d parts", len(parts))
+	}
+	if err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3WriteChunkPartLimit(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	id, _ := startS3Upload(t, fs, "/huge")
+	for _, chunkID := range []int64{-1, s3MaxParts, s3MaxParts + 1} {
+		_, err := fs.WriteChunk(UploadConfig{ObjectPath: "/huge", UploadId: id, ChunkId: chunkID, Data: []byte("data")})
+		if err == nil || !strings.Contains(err.Error(), "outside the 10000 parts s3 allows") {
+			t.Errorf("chunk %d: expected the part limit error, got %v", chunkID, err)
+		}
+	}
+	if mock.count("UploadPart") != 0 {
+		t.Errorf("expected chunks past the limit to be rejected before uploading, got %d parts", mock.count("UploadPart"))
+	}
+	if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/huge", UploadId: id, ChunkId: s3MaxParts - 1, Data: []byte("data")}); err != nil {
+		t.Errorf("expected the last allowed chunk to be written, got %v", err)
+	}
+	if fs.ChunkSize() != defaultChunkSize {
+		t.Errorf("expected the default chunk size, got %d", fs.ChunkSize())
+	}
+}
+
+func TestS3WriteChunkError(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	id, _ := startS3Upload(t, fs, "/chunked")
+	mock.errs["UploadPart"] = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+	_, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: id, ChunkId: 0, Data: []byte("data")})
+	var denied *AccessDeniedError
+	if !errors.As(err, &denied) || denied.Path != "/chunked" {
+		t.Errorf("expected an AccessDeniedError for /chunked, got %v", err)
+	}
+}
+
+func TestS3CompleteObjectUploadResponseLost(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithRetryPolicy(3, time.Millisecond))
+	chunks := [][]byte{make([]byte, s3MinPartSize), []byte("last")}
+	id, etags := startS3Upload(t, fs, "/chunked", chunks...)
+	//the first completion succeeds on s3 but its response never arrives, so the retry finds no upload
+	mock.lose["CompleteMultipartUpload"] = slowDown()
+	config := CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags}
+	if err := fs.CompleteObjectUpload(config); err != nil {
+		t.Fatalf("expected the completed upload to be recognized, got %v", err)
+	}
+	if mock.count("CompleteMultipartUpload") != 2 {
+		t.Errorf("expected the completion to be retried, got %d completions", mock.count("CompleteMultipartUpload"))
+	}
+	if obj := mock.object("chunked"); obj == nil || int64(len(obj.data)) != s3MinPartSize+4 {
+		t.Fatalf("expected the completed object, got %v", obj)
+	}
+	//a caller retrying the whole completion gets the same answer
+	if err := fs.CompleteObjectUpload(config); err != nil {
+		t.Errorf("expected a repeated completion to succeed, got %v", err)
+	}
+}
+
+func TestS3CompleteObjectUploadMissingUploadDifferentObject(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	id, etags := startS3Upload(t, fs, "/chunked", []byte("only chunk"))
+	config := CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags}
+	if err := fs.CompleteObjectUpload(config); err != nil {
+		t.Fatal(err)
+	}
+	//another writer replaced the object, so the missing upload is not ours to ignore
+	mock.put("chunked", []byte("someone else"))
+	err := fs.CompleteObjectUpload(config)
+	if err == nil || !strings.Contains(err.Error(), "NoSuchUpload") {
+		t.Errorf("expected the missing upload to be reported, got %v", err)
+	}
+}
+
+func TestBlockFSCompleteObjectUploadAfterMissingChunkWritten(t *testing.T) {
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), ChunkSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(id int64, data string) {
+		t.Helper()
+		if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", UploadId: result.ID, ChunkId: id, Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := CompletedObjectUploadConfig{UploadId: result.ID, ObjectPath: "/chunked"}
+	write(0, "abcd")
+	write(2, "ij")
+	if err := fs.CompleteObjectUpload(config); err == nil || !strings.Contains(err.Error(), "missing chunks 1 of 3") {
+		t.Fatalf("expected chunk 1 to be reported missing, got %v", err)
+	}
+	//a short chunk in the gap still leaves a hole before the last chunk
+	write(1, "ef")
+	if err := fs.CompleteObjectUpload(config); err == nil || !strings.Contains(err.Error(), "chunk 1 is 2 bytes") {
+		t.Fatalf("expected the short chunk to be rejected, got %v", err)
+	}
+	write(1, "efgh")
+	if err := fs.CompleteObjectUpload(config); err != nil {
+		t.Fatalf("expected the upload to complete once the gap was written, got %v", err)
+	}
+	content, err := GetObjectString(fs, "/chunked", 0)
+	if err != nil || content != "abcdefghij" {
+		t.Errorf("expected abcdefghij, got %q %v", content, err)
+	}
+}
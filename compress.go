@@ -0,0 +1,106 @@
+package filestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// gzipEncoding is the Content-Encoding of objects stored with WithCompression
+const gzipEncoding = "gzip"
+
+// gzipMarkerSuffix names the empty sidecar file that marks a BlockFS file as gzip compressed,
+// since a file system has nowhere else to record the content encoding
+const gzipMarkerSuffix = ".gzip-encoded"
+
+// isGzipMarker reports whether the file name is a gzip marker, which listings leave out
+func isGzipMarker(name string) bool {
+	return strings.HasSuffix(name, gzipMarkerSuffix)
+}
+
+// withoutGzipMarkers removes the gzip marker files from the directory contents
+func withoutGzipMarkers(contents []os.FileInfo) []os.FileInfo {
+	files := contents[:0]
+	for _, f := range contents {
+		if f.IsDir() || !isGzipMarker(f.Name()) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipReader compresses the source as it is read, for uploads that stream their content. It compresses a chunk of the
+// source at a time instead of piping through a goroutine, so an upload that stops reading early leaves nothing running
+type gzipReader struct {
+	source io.Reader
+	chunk  []byte
+	buf    bytes.Buffer
+	zw     *gzip.Writer
+	done   bool
+}
+
+func newGzipReader(source io.Reader) *gzipReader {
+	g := &gzipReader{source: source, chunk: make([]byte, 32*1024)}
+	g.zw = gzip.NewWriter(&g.buf)
+	return g
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for g.buf.Len() == 0 && !g.done {
+		n, err := g.source.Read(g.chunk)
+		if n > 0 {
+			if _, err := g.zw.Write(g.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			g.done = true
+			if err := g.zw.Close(); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if g.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return g.buf.Read(p)
+}
+
+// gzipReadCloser decompresses the body as it is read. Close closes both the gzip reader and the body
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func newGzipReadCloser(body io.ReadCloser) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, body: body}, nil
+}
+
+func (g *gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.body.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var compressible = []byte(strings.Repeat(`{"name":"value","count":42},`, 200))
+
+// isGzip reports whether the data starts with the gzip magic number
+func isGzip(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	blockfs := newTestBlockFS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": blockfs, "S3FS": s3fs} {
+		if _, err := fs.PutObject("/data.json", compressible, WithCompression()); err != nil {
+			t.Fatal(err)
+		}
+		content, err := GetObjectBytes(fs, "/data.json", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, compressible) {
+			t.Errorf("%s: expected the read back bytes to match the original", name)
+		}
+		info, err := fs.GetObjectInfo("/data.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentEncoding != gzipEncoding || info.Size >= int64(len(compressible)) {
+			t.Errorf("%s: expected the compressed size with a gzip encoding, got %+v", name, info)
+		}
+		if err := fs.Append("/data.json", []byte("more")); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("%s: expected appending to a compressed object to fail with ErrNotSupported, got %v", name, err)
+		}
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(blockfs.rootDir, "data.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGzip(stored) || len(stored) >= len(compressible) {
+		t.Error("expected the file on disk to be compressed")
+	}
+	obj := mock.object("data.json")
+	if !isGzip(obj.data) || obj.contentEncoding != gzipEncoding {
+		t.Errorf("expected the s3 object to be compressed with a gzip Content-Encoding, got %q", obj.contentEncoding)
+	}
+	if _, err := s3fs.GetObjectRange("/data.json", 0, 10); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected a range of a compressed object to fail with ErrNotSupported, got %v", err)
+	}
+}
+
+func TestUploadCompression(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	blockfs := newTestBlockFS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": blockfs, "S3FS": s3fs} {
+		output, err := fs.Upload(bytes.NewReader(compressible), "/data.json", WithCompression())
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := GetObjectBytes(fs, "/data.json", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, compressible) {
+			t.Errorf("%s: expected the read back bytes to match the original", name)
+		}
+		info, err := fs.GetObjectInfo("/data.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentEncoding != gzipEncoding || info.Size != output.Size || output.Size >= int64(len(compressible)) {
+			t.Errorf("%s: expected the compressed size %d with a gzip encoding, got %+v", name, output.Size, info)
+		}
+		if output.ContentType != "application/json" {
+			t.Errorf("%s: expected the content type of the original content, got %s", name, output.ContentType)
+		}
+	}
+	if obj := mock.object("data.json"); !isGzip(obj.data) || obj.contentEncoding != gzipEncoding {
+		t.Errorf("expected the s3 object to be compressed with a gzip Content-Encoding, got %q", obj.contentEncoding)
+	}
+
+	//the chunks of a large stream are compressed as they are read
+	large := bytes.Repeat(compressible, 100)
+	if _, err := blockfs.Upload(bytes.NewReader(large), "/large.json", WithCompression()); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := GetObjectBytes(blockfs, "/large.json", 0); err != nil || !bytes.Equal(content, large) {
+		t.Errorf("expected the large stream to read back, got %v", err)
+	}
+}
+
+func TestCompressionIsPerCall(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.json", compressible, WithCompression()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/data.json", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectString(fs, "/data.json", 0)
+	if err != nil || content != "plain" {
+		t.Errorf("expected the uncompressed rewrite, got %q %v", content, err)
+	}
+}
+
+func TestBlockFSListingsHideGzipMarkers(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/dir/data.json", compressible, WithCompression()); err != nil {
+		t.Fatal(err)
+	}
+	for _, recursive := range []bool{false, true} {
+		objects, err := fs.GetDir("/dir", recursive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, object := range *objects {
+			if !object.IsDir {
+				files = append(files, object.Name)
+			}
+		}
+		if len(files) != 1 || files[0] != "data.json" {
+			t.Errorf("recursive %v: expected only data.json, got %v", recursive, files)
+		}
+	}
+	visited := walkedFiles(t, func(visit FileVisitFunction) error { return fs.Walk("/dir", visit) })
+	if len(visited) != 1 {
+		t.Errorf("expected the walk to skip the marker, got %v", visited)
+	}
+	if err := fs.CopyPrefix("/dir", "/copy", nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectBytes(fs, "/copy/data.json", 0)
+	if err != nil || !bytes.Equal(content, compressible) {
+		t.Errorf("expected the copy to stay readable, got %v", err)
+	}
+}
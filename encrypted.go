@@ -0,0 +1,212 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrDecryptionFailed is returned when an object can't be decrypted, because it was written with another key,
+// wasn't written through an encrypted store or has been modified
+var ErrDecryptionFailed = errors.New("decryption failed")
+
+// Encrypted wraps a store so that objects are encrypted with AES-GCM before they are written and decrypted when they are read.
+// The key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256. Each object is stored as a random nonce followed by
+// the ciphertext, so sizes reported by GetDir and Walk include the nonce and tag, while GetObjectInfo and Size report the plaintext size.
+// GCM needs the whole object to authenticate it, so objects are buffered in memory and the chunked upload methods return ErrNotSupported
+func Encrypted(fs FileStore, key []byte) (FileStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFS{fs: fs, gcm: gcm}, nil
+}
+
+type encryptedFS struct {
+	fs  FileStore
+	gcm cipher.AEAD
+}
+
+// overhead is the number of bytes encryption adds to an object
+func (e *encryptedFS) overhead() int64 {
+	return int64(e.gcm.NonceSize() + e.gcm.Overhead())
+}
+
+func (e *encryptedFS) encrypt(data []byte) ([]byte, error) {
+	nonce := make([]byte, e.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func (e *encryptedFS) decrypt(path string, data []byte) ([]byte, error) {
+	nonceSize := e.gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("%w: %s is too short to be encrypted", ErrDecryptionFailed, path)
+	}
+	plaintext, err := e.gcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrDecryptionFailed, path, err)
+	}
+	return plaintext, nil
+}
+
+func (e *encryptedFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject, error) {
+	return e.fs.GetDir(path, recursive)
+}
+
+func (e *encryptedFS) GetDirPage(path string, token string, pageSize int) ([]FileStoreResultObject, string, error) {
+	return e.fs.GetDirPage(path, token, pageSize)
+}
+
+func (e *encryptedFS) ListDirs(path string) ([]string, error) {
+	return e.fs.ListDirs(path)
+}
+
+func (e *encryptedFS) GetObject(path string) (io.ReadCloser, error) {
+	reader, err := e.fs.GetObject(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := e.decrypt(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+func (e *encryptedFS) GetObjectInfo(path string) (*ObjectInfo, error) {
+	info, err := e.fs.GetObjectInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size >= e.overhead() {
+		info.Size -= e.overhead()
+	}
+	return info, nil
+}
+
+func (e *encryptedFS) Size(path string) (int64, error) {
+	size, err := e.fs.Size(path)
+	if err != nil {
+		return 0, err
+	}
+	if size >= e.overhead() {
+		size -= e.overhead()
+	}
+	return size, nil
+}
+
+// PutObject encrypts the data before writing it
+func (e *encryptedFS) PutObject(path string, data []byte, opts ...UploadOption) (*FileOperationOutput, error) {
+	ciphertext, err := e.encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	//the content type would otherwise be sniffed from the ciphertext
+	opts = append([]UploadOption{WithContentType(detectContentType(path, data))}, opts...)
+	return e.fs.PutObject(path, ciphertext, opts...)
+}
+
+func (e *encryptedFS) DeleteObjects(path ...string) error {
+	return e.fs.DeleteObjects(path...)
+}
+
+// Append decrypts the existing object, appends the data and encrypts the result as a new object,
+// since an authenticated ciphertext can't be extended in place
+func (e *encryptedFS) Append(path string, data []byte) error {
+	existing, err := GetObjectBytes(e, path, 0)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	_, err = e.PutObject(path, append(existing, data...))
+	return err
+}
+
+func (e *encryptedFS) CreateDir(path string) error {
+	return e.fs.CreateDir(path)
+}
+
+// CreateEmptyObject puts an encrypted empty object, so that it can be read back like any other object
+func (e *encryptedFS) CreateEmptyObject(path string) error {
+	_, err := e.PutObject(path, nil)
+	return err
+}
+
+// Touch creates an encrypted empty object when the object doesn't exist, rather than an empty file that can't be decrypted
+func (e *encryptedFS) Touch(path string) error {
+	_, err := e.fs.GetObjectInfo(path)
+	if errors.Is(err, ErrObjectNotFound) {
+		return e.CreateEmptyObject(path)
+	}
+	if err != nil {
+		return err
+	}
+	return e.fs.Touch(path)
+}
+
+func (e *encryptedFS) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := e.encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]UploadOption{WithContentType(detectContentType(key, data))}, opts...)
+	return e.fs.Upload(bytes.NewReader(ciphertext), key, opts...)
+}
+
+func (e *encryptedFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return uploadFile(e, filePath, key, opts)
+}
+
+func (e *encryptedFS) Glob(pattern string) ([]FileStoreResultObject, error) {
+	return e.fs.Glob(pattern)
+}
+
+func (e *encryptedFS) Walk(path string, vistorFunction FileVisitFunction) error {
+	return e.fs.Walk(path, vistorFunction)
+}
+
+func (e *encryptedFS) WalkDir(path string, visitorFunction WalkDirFunction) error {
+	return e.fs.WalkDir(path, visitorFunction)
+}
+
+func (e *encryptedFS) WalkContext(ctx context.Context, path string, vistorFunction FileVisitFunction) error {
+	return e.fs.WalkContext(ctx, path, vistorFunction)
+}
+
+// InitializeObjectUpload is not supported because chunks are written at fixed offsets, which encryption would shift
+func (e *encryptedFS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
+	return UploadResult{}, fmt.Errorf("%w: chunked uploads to an encrypted store", ErrNotSupported)
+}
+
+func (e *encryptedFS) WriteChunk(u UploadConfig) (UploadResult, error) {
+	return UploadResult{}, fmt.Errorf("%w: chunked uploads to an encrypted store", ErrNotSupported)
+}
+
+func (e *encryptedFS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
+	return fmt.Errorf("%w: chunked uploads to an encrypted store", ErrNotSupported)
+}
+
+func (e *encryptedFS) Close() error {
+	return e.fs.Close()
+}
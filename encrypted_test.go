@@ -0,0 +1,84 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	blockfs := newTestBlockFS(t)
+	for name, inner := range map[string]FileStore{"BlockFS": blockfs, "S3FS": s3fs} {
+		fs, err := Encrypted(inner, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.PutObject("/put.txt", []byte("secret put")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Upload(strings.NewReader("secret upload"), "/upload.txt"); err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range map[string]string{"/put.txt": "secret put", "/upload.txt": "secret upload"} {
+			content, err := GetObjectString(fs, key, 0)
+			if err != nil || content != expected {
+				t.Errorf("%s %s: expected %q, got %q %v", name, key, expected, content, err)
+			}
+			stored, err := GetObjectBytes(inner, key, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored, []byte(expected)) {
+				t.Errorf("%s %s: expected the stored object to be encrypted", name, key)
+			}
+		}
+		size, err := fs.Size("/put.txt")
+		if err != nil || size != int64(len("secret put")) {
+			t.Errorf("%s: expected the plaintext size, got %d %v", name, size, err)
+		}
+	}
+	if mock.count("PutObject") != 2 {
+		t.Errorf("expected both writes to be put to s3, got %d", mock.count("PutObject"))
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	inner := newTestBlockFS(t)
+	fs, err := Encrypted(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/data.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	other, err := Encrypted(inner, []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetObjectBytes(other, "/data.txt", 0); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed with the wrong key, got %v", err)
+	}
+	if _, err := inner.PutObject("/plain.txt", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetObjectBytes(fs, "/plain.txt", 0); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed for an unencrypted object, got %v", err)
+	}
+	if _, err := Encrypted(inner, []byte("short")); err == nil {
+		t.Error("expected an invalid key length to be rejected")
+	}
+}
+
+func TestEncryptedChunkedUploadNotSupported(t *testing.T) {
+	fs, err := Encrypted(newTestBlockFS(t), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked", Data: []byte("data")}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
@@ -1,17 +1,23 @@
 package filestore
 
 import (
+	"bufio"
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"mime"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 type PATHTYPE int
@@ -21,21 +27,131 @@ const (
 	FOLDER
 )
 
-var chunkSize int64 = 10 * 1024 * 1024
+// defaultChunkSize is the chunk size used by WriteChunk when a store config doesn't provide one
+const defaultChunkSize int64 = 10 * 1024 * 1024
+
+// s3MinPartSize is the smallest part s3 will accept in a multipart upload, other than the last part
+const s3MinPartSize int64 = 5 * 1024 * 1024
+
+// s3MaxParts is the most parts s3 allows in a multipart upload
+const s3MaxParts = 10000
+
+// s3MaxCopyPartSize is the largest part s3 will copy with a single UploadPartCopy
+const s3MaxCopyPartSize int64 = 5 * 1024 * 1024 * 1024
+
+// s3CopyPartSize is the size of the parts used to copy objects too large for a single copy, which keeps objects up to
+// the 5TB s3 maximum under the part limit
+const s3CopyPartSize int64 = 1024 * 1024 * 1024
+
+// s3MaxPresignExpiration is the longest a SigV4 presigned url can be valid for
+const s3MaxPresignExpiration = 7 * 24 * time.Hour
+
+var (
+	ErrPathTraversal  = errors.New("path traversal is not allowed")
+	ErrEmptyPath      = errors.New("path is empty")
+	ErrObjectTooLarge = errors.New("object is larger than the maximum size")
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrAccessDenied is returned when the credentials of the store don't permit the operation
+	ErrAccessDenied      = errors.New("access denied")
+	ErrUnsupportedConfig = errors.New("invalid file system type configuration")
+	// ErrNotSupported is returned by operations a backend has no equivalent for, such as object versions on a file system
+	ErrNotSupported = errors.New("operation not supported by this file store")
+	// ErrPreconditionFailed is returned by a conditional write when the stored object no longer matches the expected etag
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrAlreadyExists is returned by a write that only creates objects when the object already exists
+	ErrAlreadyExists = errors.New("object already exists")
+	// ErrStopWalk can be returned by a walk visitor to end the walk early without it being treated as a failure
+	ErrStopWalk = errors.New("stop walk")
+	// ErrMissingBucket, ErrMissingRegion and ErrMissingCredentials are returned when an S3FSConfig is incomplete
+	ErrMissingBucket      = errors.New("s3 bucket is not set")
+	ErrMissingRegion      = errors.New("s3 region is not set")
+	ErrMissingCredentials = errors.New("s3 credentials are incomplete")
+)
+
+// NotFoundError is returned when an object doesn't exist. It matches ErrObjectNotFound with errors.Is
+// and unwraps to the backend specific error
+type NotFoundError struct {
+	Path string
+	Err  error
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrObjectNotFound, e.Path)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrObjectNotFound
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// AccessDeniedError is returned when the store refuses an operation for lack of permission. It matches ErrAccessDenied
+// with errors.Is and unwraps to the backend specific error
+type AccessDeniedError struct {
+	Path string
+	Err  error
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrAccessDenied, e.Path)
+}
+
+func (e *AccessDeniedError) Is(target error) bool {
+	return target == ErrAccessDenied
+}
+
+func (e *AccessDeniedError) Unwrap() error {
+	return e.Err
+}
 
 type FileOperationOutput struct {
-	Md5 string
+	// Md5 is the hex md5 of the bytes written, computed locally
+	Md5         string
+	ContentType string
+	// Size is the number of bytes written
+	Size int64
+	// ETag is the etag s3 returned for the object, which is only the md5 of an unencrypted or SSE-S3 single part put.
+	// It is empty for Upload, whose uploader in this sdk doesn't return one, and for the file system backends
+	ETag string
+	// Location is the url of the object and VersionID its version, for backends that report them
+	Location  string
+	VersionID string
 }
 
 type FileStoreResultObject struct {
 	ID         int       `json:"id"`
 	Name       string    `json:"fileName"`
-	Size       string    `json:"size"`
+	Size       string    `json:"size"` // Deprecated: kept for JSON compatibility, use SizeBytes
+	SizeBytes  int64     `json:"sizeBytes"`
 	Path       string    `json:"filePath"`
 	Type       string    `json:"type"`
 	IsDir      bool      `json:"isdir"`
 	Modified   time.Time `json:"modified"`
 	ModifiedBy string    `json:"modifiedBy"`
+	// Metadata is the user metadata of the object, populated by S3FS.GetDir when FetchMetadata is set
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ObjectInfo is the metadata of a single object, gathered in one call
+type ObjectInfo struct {
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType"`
+	ETag        string            `json:"etag"`
+	ModTime     time.Time         `json:"modified"`
+	Metadata    map[string]string `json:"metadata"`
+	// ContentEncoding is gzip for objects written with WithCompression, whose Size is the compressed size
+	ContentEncoding string `json:"contentEncoding"`
+}
+
+// ObjectVersion is a single version of an object in a version enabled store
+type ObjectVersion struct {
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId"`
+	IsLatest  bool      `json:"isLatest"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modified"`
 }
 
 type UploadConfig struct {
@@ -48,6 +164,8 @@ type UploadConfig struct {
 	//FileId     uuid.UUID
 	UploadId string
 	Data     []byte
+	// ACL is the canned ACL of the object, used by s3 when the upload is initialized. See WithACL
+	ACL string
 }
 
 type CompletedObjectUploadConfig struct {
@@ -68,54 +186,387 @@ type UploadResult struct {
 
 type FileVisitFunction func(path string, file os.FileInfo) error
 
+// VersionVisitFunction is the visitor for WalkVersions, called for each version of an object and each delete marker
+type VersionVisitFunction func(path string, versionID string, isDeleteMarker bool, file os.FileInfo) error
+
+// WalkDirFunction is the visitor for WalkDir. Returning filepath.SkipDir for a directory prunes it from the walk
+type WalkDirFunction func(path string, file os.FileInfo, isDir bool) error
+
+// CopyProgressFunction is called after each object is copied with the source and destination paths and the number of objects copied so far
+type CopyProgressFunction func(source string, dest string, copied int)
+
+// ProgressFunction is called as an upload reads its content with the bytes read so far and the total size,
+// which is -1 when the size of the reader isn't known up front
+type ProgressFunction func(bytesTransferred int64, totalBytes int64)
+
+// UploadHook is called after an object is written by PutObject, Upload, UploadFile or CompleteObjectUpload with the key
+// and the output of the write. Outputs of CompleteObjectUpload only have the fields the backend reports on completion
+type UploadHook func(key string, output *FileOperationOutput)
+
+// MultiError collects the errors from an operation that continues past individual failures
+type MultiError []error
+
+func (me MultiError) Error() string {
+	msgs := make([]string, len(me))
+	for i, err := range me {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(me), strings.Join(msgs, "; "))
+}
+
+// errorOrNil returns nil when no errors were collected so callers can return the result directly
+func (me MultiError) errorOrNil() error {
+	if len(me) == 0 {
+		return nil
+	}
+	return me
+}
+
+// sortResults orders directory listings the same way for every backend and reassigns the IDs to match.
+// Entries are grouped by Path, then directories come before files, then entries are sorted by Name
+func sortResults(objects []FileStoreResultObject) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		a, b := objects[i], objects[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return a.Name < b.Name
+	})
+	for i := range objects {
+		objects[i].ID = i
+	}
+}
+
+// fileResult builds the listing entry for the file or directory at the store path provided
+func fileResult(id int, filePath string, fi os.FileInfo) FileStoreResultObject {
+	return FileStoreResultObject{
+		ID:        id,
+		Name:      fi.Name(),
+		Size:      strconv.FormatInt(fi.Size(), 10),
+		SizeBytes: fi.Size(),
+		Path:      path.Dir(filePath),
+		Type:      path.Ext(fi.Name()),
+		IsDir:     fi.IsDir(),
+		Modified:  fi.ModTime(),
+	}
+}
+
+// defaultPageSize is the number of entries GetDirPage returns when no page size is given, the most s3 returns in one listing
+const defaultPageSize = 1000
+
+// pageEntries emulates paged listings over a directory read for the file system backends. The entries are sorted by name
+// and the page starts after the entry named by the token, which is the name of the last entry of the previous page
+func pageEntries(entries []os.FileInfo, token string, pageSize int) ([]os.FileInfo, string) {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	start := 0
+	if token != "" {
+		start = sort.Search(len(entries), func(i int) bool {
+			return entries[i].Name() > token
+		})
+	}
+	end := start + pageSize
+	if end >= len(entries) {
+		return entries[start:], ""
+	}
+	return entries[start:end], entries[end-1].Name()
+}
+
+// dirNames returns the sorted names of the directories among the entries
+func dirNames(entries []os.FileInfo) []string {
+	dirs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
 type FileStore interface {
 	GetDir(string, bool) (*[]FileStoreResultObject, error)
+	GetDirPage(path string, token string, pageSize int) ([]FileStoreResultObject, string, error)
+	ListDirs(path string) ([]string, error)
 	GetObject(string) (io.ReadCloser, error)
-	PutObject(string, []byte) (*FileOperationOutput, error)
+	GetObjectInfo(string) (*ObjectInfo, error)
+	Size(string) (int64, error)
+	PutObject(string, []byte, ...UploadOption) (*FileOperationOutput, error)
 	DeleteObjects(path ...string) error
+	Append(path string, data []byte) error
+	CreateDir(path string) error
+	CreateEmptyObject(path string) error
+	Touch(path string) error
+	Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error)
+	UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error)
 	//PutMultipartObject(u UploadConfig) (UploadResult, error)
 	//InitializeMultipartWrite
 	//PutPart(u UploadConfig) (UploadResult, error)
+	Glob(pattern string) ([]FileStoreResultObject, error)
 	Walk(string, FileVisitFunction) error
+	WalkDir(string, WalkDirFunction) error
+	WalkContext(context.Context, string, FileVisitFunction) error
 
 	/////depricate
 	InitializeObjectUpload(UploadConfig) (UploadResult, error)
 	WriteChunk(UploadConfig) (UploadResult, error)
 	CompleteObjectUpload(CompletedObjectUploadConfig) error
+
+	Close() error
 }
 
-func NewFileStore(config interface{}) (FileStore, error) {
+// NewFileStore creates the store for the backend config provided. The options are applied to the store regardless of backend.
+// NewBlockFS, NewS3FS and NewSFTPFS return the concrete stores for callers that need their backend specific methods
+func NewFileStore(config interface{}, opts ...Option) (FileStore, error) {
 	switch scType := config.(type) {
 	case BlockFSConfig:
-		fs := BlockFS{}
-		return &fs, nil
+		fs, err := NewBlockFS(config.(BlockFSConfig), opts...)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
 
 	case S3FSConfig:
-		s3config := config.(S3FSConfig)
-		creds := credentials.NewStaticCredentials(s3config.S3Id, s3config.S3Key, "")
-		cfg := aws.NewConfig().WithRegion(s3config.S3Region).WithCredentials(creds)
-		if s3config.Mock {
-			cfg.WithDisableSSL(s3config.S3DisableSSL)
-			cfg.WithS3ForcePathStyle(s3config.S3ForcePathStyle)
-			if s3config.S3Endpoint != "" {
-				cfg.WithEndpoint(s3config.S3Endpoint)
-			}
-		}
-		sess, err := session.NewSession(cfg)
+		fs, err := NewS3FS(config.(S3FSConfig), opts...)
 		if err != nil {
 			return nil, err
 		}
+		return fs, nil
 
-		fs := S3FS{
-			session: sess,
-			config:  &s3config,
-			maxKeys: 1000,
+	case SFTPFSConfig:
+		fs, err := NewSFTPFS(config.(SFTPFSConfig), opts...)
+		if err != nil {
+			return nil, err
 		}
-		return &fs, nil
+		return fs, nil
 
 	default:
-		return nil, fmt.Errorf("Invalid File System System Type Configuration: %v", scType)
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedConfig, scType)
+	}
+}
+
+// GetObjectBytes reads the entire object at path and closes it. A maxSize greater than zero guards against
+// reading huge objects into memory, returning ErrObjectTooLarge when the object exceeds it
+func GetObjectBytes(fs FileStore, path string, maxSize int64) ([]byte, error) {
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if maxSize <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: %s exceeds %d bytes", ErrObjectTooLarge, path, maxSize)
+	}
+	return data, nil
+}
+
+// GetObjectString reads the entire object at path as a string and closes it. See GetObjectBytes for maxSize
+func GetObjectString(fs FileStore, path string, maxSize int64) (string, error) {
+	data, err := GetObjectBytes(fs, path, maxSize)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// peeker is implemented by stores that can read the start of an object without reading the rest of it
+type peeker interface {
+	PeekObject(path string, n int64) ([]byte, error)
+}
+
+// PeekObject reads the first n bytes of the object at path, such as the magic bytes of a file format, and closes it.
+// Fewer bytes are returned when the object is smaller than n. Stores that support it, such as s3, only transfer the
+// requested bytes
+func PeekObject(fs FileStore, path string, n int64) ([]byte, error) {
+	if p, ok := fs.(peeker); ok {
+		return p.PeekObject(path, n)
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, n))
+}
+
+// ReadJSON decodes the JSON object at path into v. Objects written with WithCompression are decompressed by GetObject,
+// so compressed manifests are read the same way
+func ReadJSON(fs FileStore, path string, v interface{}) error {
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+// PutObjectIfAbsent puts the data at path only when there is no object there yet, returning ErrAlreadyExists otherwise,
+// so processes racing to claim a key don't overwrite each other. See WithIfAbsent for the guarantees of each store
+func PutObjectIfAbsent(fs FileStore, path string, data []byte, opts ...UploadOption) (*FileOperationOutput, error) {
+	return fs.PutObject(path, data, append(opts, WithIfAbsent())...)
+}
+
+// WriteJSON encodes v as JSON and puts it at path with an application/json content type. The opts are passed to PutObject,
+// for example WithCompression for large manifests
+func WriteJSON(fs FileStore, path string, v interface{}, opts ...UploadOption) (*FileOperationOutput, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", path, err)
+	}
+	opts = append([]UploadOption{WithContentType("application/json")}, opts...)
+	return fs.PutObject(path, data, opts...)
+}
+
+// ScanLines reads the object at path a line at a time and calls fn with each line, without the line ending, so large
+// newline delimited objects such as CSV or JSON lines aren't held in memory. Lines can be up to maxLineSize bytes,
+// or 64KB when maxLineSize is zero or less. The line slice is reused between calls, so fn must copy it to keep it.
+// An error from fn stops the scan and is returned
+func ScanLines(fs FileStore, path string, maxLineSize int, fn func(line []byte) error) error {
+	reader, err := fs.GetObject(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	scanner := bufio.NewScanner(reader)
+	if maxLineSize > 0 {
+		//the scanner grows up to the larger of the max and the buffer capacity, so the buffer can't start out bigger
+		initial := 64 * 1024
+		if maxLineSize < initial {
+			initial = maxLineSize
+		}
+		scanner.Buffer(make([]byte, 0, initial), maxLineSize)
+	}
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanning %s: %w", path, err)
+	}
+	return nil
+}
+
+// DirStats walks everything under path and returns the number of files and their total size in bytes.
+// Directories, including the empty directory marker objects of s3, are not counted. Only listings are read, never content
+func DirStats(fs FileStore, path string) (count int64, totalBytes int64, err error) {
+	err = fs.Walk(path, func(filePath string, file os.FileInfo) error {
+		if file.IsDir() || strings.HasSuffix(filePath, "/") {
+			return nil
+		}
+		count++
+		totalBytes += file.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, totalBytes, nil
+}
+
+// CopyObjectToStore copies an object from one store to another. When both stores are S3FS the copy is done
+// server side, otherwise the object is streamed from the source store into the destination store
+func CopyObjectToStore(src FileStore, source string, dest FileStore, destPath string) error {
+	srcS3, srcIsS3 := src.(*S3FS)
+	destS3, destIsS3 := dest.(*S3FS)
+	if srcIsS3 && destIsS3 {
+		return srcS3.CopyObjectToBucket(source, destS3.config.S3Bucket, destPath)
+	}
+	return Transfer(src, source, dest, destPath)
+}
+
+// Transfer streams an object from one store into another without buffering it in memory or a temp file.
+// The source reader is always closed and the first error encountered is returned
+func Transfer(src FileStore, srcPath string, dst FileStore, dstKey string) error {
+	reader, err := src.GetObject(srcPath)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Upload(reader, dstKey)
+	closeErr := reader.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// uploadFile opens the local file and uploads its contents to the store at key
+func uploadFile(fs FileStore, filePath string, key string, opts []UploadOption) (*FileOperationOutput, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s for upload: %w", filePath, err)
+	}
+	defer f.Close()
+	return fs.Upload(f, key, opts...)
+}
+
+// fileDownloader is implemented by stores that have a faster way to download an object to a local file than reading it
+type fileDownloader interface {
+	DownloadFile(path string, localPath string) error
+}
+
+// DownloadFile writes the object at path to the local file, creating its parent directories. It is the counterpart of
+// UploadFile. The object is written to a temporary file next to the local file and renamed into place, so a failed
+// download doesn't leave a partial file behind. On s3 the object is downloaded with concurrent ranged requests
+func DownloadFile(fs FileStore, path string, localPath string) error {
+	if d, ok := fs.(fileDownloader); ok {
+		return d.DownloadFile(path, localPath)
+	}
+	return downloadFile(localPath, func(f *os.File) error {
+		reader, err := fs.GetObject(path)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		_, err = io.Copy(f, reader)
+		return err
+	})
+}
+
+// downloadFile calls write with a temporary file next to the local file and renames it to the local file when write succeeds
+func downloadFile(localPath string, write func(f *os.File) error) error {
+	dir := filepath.Dir(localPath)
+	if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(localPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), defaultFileMode)
 	}
+	if err == nil {
+		err = os.Rename(f.Name(), localPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("downloading to %s: %w", localPath, err)
+	}
+	return nil
 }
 
 type PathParts struct {
@@ -136,13 +587,33 @@ func sanitizePath(path string) string {
 	return strings.ReplaceAll(path, "..", "")
 }
 
-//@TODO this is duplicated!!!!
+// SafeBuildPath joins the path parts into a single path, returning an error rather than rewriting the path
+// when a part attempts to traverse up the tree or the parts don't contain a path
+func SafeBuildPath(parts []string, pathType PATHTYPE) (string, error) {
+	for _, p := range parts {
+		for _, segment := range strings.Split(p, "/") {
+			if segment == ".." {
+				return "", fmt.Errorf("%w: %s", ErrPathTraversal, p)
+			}
+		}
+	}
+	path := joinPath(parts, pathType)
+	if strings.Trim(path, "/") == "" {
+		return "", ErrEmptyPath
+	}
+	return path, nil
+}
+
+// buildUrl is kept for backward compatibility and silently strips traversal attempts. Prefer SafeBuildPath
 func buildUrl(urlparts []string, pathType PATHTYPE) string {
+	return sanitizePath(joinPath(urlparts, pathType))
+}
+
+func joinPath(urlparts []string, pathType PATHTYPE) string {
 	var b strings.Builder
 	t := "/%s"
 	for _, p := range urlparts {
 		p = strings.Trim(strings.ReplaceAll(p, "//", "/"), "/")
-		//p = strings.Trim(p, "/")
 		if p != "" {
 			fmt.Fprintf(&b, t, p)
 		}
@@ -150,15 +621,72 @@ func buildUrl(urlparts []string, pathType PATHTYPE) string {
 	if pathType == FOLDER {
 		fmt.Fprintf(&b, "%s", "/")
 	}
-	return sanitizePath(b.String())
+	return b.String()
 }
 
-func getFileMd5(f *os.File) string {
+func getFileMd5(f *os.File) (string, error) {
 	h := md5.New()
 	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("computing md5 of %s: %w", f.Name(), err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// checkETag returns ErrPreconditionFailed when the current etag of an object doesn't match the expected etag.
+// Surrounding quotes are ignored so s3 etags compare equal to plain md5 hashes
+func checkETag(path string, expected string, current string) error {
+	if strings.Trim(expected, `"`) != strings.Trim(current, `"`) {
+		return fmt.Errorf("%w: %s has etag %s, expected %s", ErrPreconditionFailed, path, current, expected)
+	}
+	return nil
+}
+
+// detectContentType uses the extension of the key and falls back to sniffing the first bytes of the content
+func detectContentType(key string, head []byte) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(head)
+}
+
+// sniffContentType detects the content type from the first 512 bytes of the reader
+func sniffContentType(reader io.Reader) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(reader, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// peekContentType detects the content type from the first 512 bytes of the reader. The returned reader must be used in place
+// of the original, since it still holds the peeked bytes
+func peekContentType(reader io.Reader, key string) (io.Reader, string, error) {
+	buffered := bufio.NewReaderSize(reader, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	return buffered, detectContentType(key, head), nil
+}
+
+// prepareUpload wraps the reader to report progress, apply the bandwidth limit and hash the content, and detects the
+// content type when options doesn't have one. With WithCompression the content is gzipped as it is read. The hashingReader
+// has the md5 and size of the bytes that are stored once the upload has read the reader
+func prepareUpload(reader io.Reader, key string, options *uploadOptions, storeOptions storeOptions) (io.Reader, *hashingReader, error) {
+	reader = storeOptions.limitReader(withProgress(reader, options.progress))
+	if options.contentType == "" {
+		var err error
+		reader, options.contentType, err = peekContentType(reader, key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if options.compress {
+		reader = newGzipReader(reader)
 	}
-	return fmt.Sprintf("%x", h.Sum(nil))
+	hashing := newHashingReader(reader)
+	return hashing, hashing, nil
 }
 
 func isDir(path string) bool {
@@ -168,22 +696,3 @@ func isDir(path string) bool {
 	}
 	return fi.Mode().IsDir()
 }
-
-//@TODO should be able to depricate this function
-/*
-func buildUrl(urlparts ...string) string {
-	var b strings.Builder
-	t := "%s"
-	for _, p := range urlparts {
-		fmt.Println(p)
-		if !strings.HasPrefix(p, "/") {
-			t = "/%s"
-		}
-		if strings.HasSuffix(p, "/") {
-			p = p[:len(p)-1]
-		}
-		fmt.Fprintf(&b, t, p)
-	}
-	return b.String()
-}
-*/
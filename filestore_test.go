@@ -0,0 +1,815 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trackedReader records whether it was closed, and fails after its content when failAfter is set
+type trackedReader struct {
+	reader    io.Reader
+	failAfter bool
+	closed    bool
+}
+
+func (r *trackedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF && r.failAfter {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func (r *trackedReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// readerStore returns the reader from GetObject, for tests of the helpers built on it
+type readerStore struct {
+	FileStore
+	reader *trackedReader
+}
+
+func (s *readerStore) GetObject(path string) (io.ReadCloser, error) {
+	return s.reader, nil
+}
+
+func TestGetObjectBytes(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := GetObjectBytes(fs, "/data.txt", 0)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected hello, got %q %v", data, err)
+	}
+	text, err := GetObjectString(fs, "/data.txt", 5)
+	if err != nil || text != "hello" {
+		t.Errorf("expected hello within the limit, got %q %v", text, err)
+	}
+	if _, err := GetObjectString(fs, "/data.txt", 4); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("expected ErrObjectTooLarge, got %v", err)
+	}
+	if _, err := GetObjectBytes(fs, "/missing", 0); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestGetObjectBytesClosesOnReadError(t *testing.T) {
+	for _, maxSize := range []int64{0, 100} {
+		reader := &trackedReader{reader: strings.NewReader("partial"), failAfter: true}
+		fs := &readerStore{reader: reader}
+		if _, err := GetObjectBytes(fs, "/data.txt", maxSize); err == nil {
+			t.Error("expected the read error to be returned")
+		}
+		if !reader.closed {
+			t.Errorf("expected the reader to be closed after a failed read with max size %d", maxSize)
+		}
+	}
+}
+
+func TestGetObjectBytesClosesWhenTooLarge(t *testing.T) {
+	reader := &trackedReader{reader: strings.NewReader("too large")}
+	fs := &readerStore{reader: reader}
+	if _, err := GetObjectBytes(fs, "/data.txt", 3); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("expected ErrObjectTooLarge, got %v", err)
+	}
+	if !reader.closed {
+		t.Error("expected the reader to be closed")
+	}
+}
+
+// uploadErrorStore fails every Upload with err
+type uploadErrorStore struct {
+	FileStore
+	err error
+}
+
+func (s *uploadErrorStore) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return nil, s.err
+}
+
+func TestTransfer(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	mock.put("source/data.bin", []byte("from s3"))
+	src := newTestBlockFS(t)
+	if _, err := src.PutObject("/source/data.bin", []byte("from disk")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		src      FileStore
+		expected string
+	}{
+		{"BlockFS to BlockFS", src, "from disk"},
+		{"S3FS to BlockFS", s3fs, "from s3"},
+	}
+	for _, test := range tests {
+		dst := newTestBlockFS(t)
+		if err := Transfer(test.src, "/source/data.bin", dst, "/dest/copy.bin"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		content, err := GetObjectString(dst, "/dest/copy.bin", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, content)
+		}
+	}
+}
+
+func TestTransferClosesSourceOnUploadError(t *testing.T) {
+	reader := &trackedReader{reader: strings.NewReader("data")}
+	uploadErr := errors.New("upload failed")
+	err := Transfer(&readerStore{reader: reader}, "/data", &uploadErrorStore{err: uploadErr}, "/copy")
+	if err != uploadErr {
+		t.Errorf("expected the upload error, got %v", err)
+	}
+	if !reader.closed {
+		t.Error("expected the source reader to be closed")
+	}
+}
+
+func TestTransferMissingSource(t *testing.T) {
+	err := Transfer(newTestBlockFS(t), "/missing", newTestBlockFS(t), "/copy")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestPutObjectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		key      string
+		data     []byte
+		opts     []UploadOption
+		expected string
+	}{
+		{"/page.html", []byte("<p>hello</p>"), nil, "text/html"},
+		{"/image.png", png, nil, "image/png"},
+		{"/blob", []byte{0, 1, 2, 3}, nil, "application/octet-stream"},
+		{"/sniffed", png, nil, "image/png"},
+		{"/page.html", []byte("<p>hello</p>"), []UploadOption{WithContentType("text/plain")}, "text/plain"},
+	}
+	s3fs, mock := newTestS3FS(t)
+	blockfs := newTestBlockFS(t)
+	for _, test := range tests {
+		output, err := blockfs.PutObject(test.key, test.data, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(output.ContentType, test.expected) {
+			t.Errorf("BlockFS %s: expected %s, got %s", test.key, test.expected, output.ContentType)
+		}
+		if _, err := s3fs.PutObject(test.key, test.data, test.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if ct := mock.object(strings.TrimPrefix(test.key, "/")).contentType; !strings.HasPrefix(ct, test.expected) {
+			t.Errorf("S3FS %s: expected %s, got %s", test.key, test.expected, ct)
+		}
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	objects := []FileStoreResultObject{
+		{Name: "b.txt", Path: "/data"},
+		{Name: "z", Path: "/data", IsDir: true},
+		{Name: "a.txt", Path: "/data"},
+		{Name: "c", Path: "/data", IsDir: true},
+		{Name: "d.txt", Path: "/data/c"},
+	}
+	sortResults(objects)
+	expected := []string{"/data/c", "/data/z", "/data/a.txt", "/data/b.txt", "/data/c/d.txt"}
+	for i, object := range objects {
+		if got := object.Path + "/" + object.Name; got != expected[i] || object.ID != i {
+			t.Errorf("expected %s with id %d, got %s with id %d", expected[i], i, got, object.ID)
+		}
+	}
+}
+
+func TestGetDirOrdering(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		putKeys(t, fs, "/data/b.txt", "/data/z/1", "/data/a.txt", "/data/c/1")
+		for i := 0; i < 2; i++ {
+			objects, err := fs.GetDir("/data", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for id, object := range *objects {
+				if object.ID != id {
+					t.Errorf("%s: expected the ids to follow the order, got %d at %d", name, object.ID, id)
+				}
+				names = append(names, object.Name)
+			}
+			if strings.Join(names, ",") != "c,z,a.txt,b.txt" {
+				t.Errorf("%s: expected directories then files by name, got %v", name, names)
+			}
+		}
+	}
+}
+
+func TestDirStats(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	mock.put("data/empty/", nil)
+	blockfs := newTestBlockFS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": blockfs, "S3FS": s3fs} {
+		files := map[string]int{"/data/a.bin": 10, "/data/sub/b.bin": 200, "/data/sub/deeper/c.bin": 3000, "/other/d.bin": 7}
+		for key, size := range files {
+			if _, err := fs.PutObject(key, make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count, totalBytes, err := DirStats(fs, "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 || totalBytes != 3210 {
+			t.Errorf("%s: expected 3 files of 3210 bytes, got %d files of %d bytes", name, count, totalBytes)
+		}
+	}
+	if mock.count("GetObject") != 0 {
+		t.Errorf("expected only listings to be read, got %d GetObject calls", mock.count("GetObject"))
+	}
+}
+
+func TestAppend(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		for _, line := range []string{"first\n", "second\n"} {
+			if err := fs.Append("/logs/app.log", []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content, err := GetObjectString(fs, "/logs/app.log", 0)
+		if err != nil || content != "first\nsecond\n" {
+			t.Errorf("%s: expected the appended lines, got %q %v", name, content, err)
+		}
+	}
+	large := make([]byte, s3MinPartSize)
+	mock.put("large.bin", large)
+	if err := s3fs.Append("/large.bin", []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	obj := mock.object("large.bin")
+	if int64(len(obj.data)) != s3MinPartSize+4 || string(obj.data[s3MinPartSize:]) != "tail" {
+		t.Errorf("expected the tail appended to the large object, got %d bytes", len(obj.data))
+	}
+	if mock.count("UploadPartCopy") != 1 {
+		t.Errorf("expected a large object to be appended with UploadPartCopy, got %d", mock.count("UploadPartCopy"))
+	}
+}
+
+// modifiedSinceStore is implemented by the stores that support conditional reads
+type modifiedSinceStore interface {
+	FileStore
+	GetObjectIfModifiedSince(path string, since time.Time) (io.ReadCloser, bool, error)
+}
+
+func TestGetObjectIfModifiedSince(t *testing.T) {
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	s3fs, mock := newTestS3FS(t)
+	mock.put("data.txt", []byte("data")).modified = modified
+	blockfs := newTestBlockFS(t)
+	if _, err := blockfs.PutObject("/data.txt", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(blockfs.rootDir, "data.txt"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	for name, fs := range map[string]modifiedSinceStore{"BlockFS": blockfs, "S3FS": s3fs} {
+		reader, wasModified, err := fs.GetObjectIfModifiedSince("/data.txt", modified.Add(-time.Minute))
+		if err != nil || !wasModified || reader == nil {
+			t.Fatalf("%s: expected the modified object, got %v %v", name, wasModified, err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(content) != "data" {
+			t.Errorf("%s: expected the content, got %q %v", name, content, err)
+		}
+
+		reader, wasModified, err = fs.GetObjectIfModifiedSince("/data.txt", modified.Add(time.Minute))
+		if err != nil || wasModified || reader != nil {
+			t.Errorf("%s: expected not modified without a reader, got %v %v %v", name, reader, wasModified, err)
+		}
+		if _, _, err := fs.GetObjectIfModifiedSince("/missing", modified); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("%s: expected ErrObjectNotFound, got %v", name, err)
+		}
+	}
+}
+
+type testManifest struct {
+	Name  string   `json:"name"`
+	Parts []string `json:"parts"`
+	Count int      `json:"count"`
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		written := testManifest{Name: "index", Parts: []string{"a", "b"}, Count: 2}
+		output, err := WriteJSON(fs, "/manifest.json", written, WithCompression())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.ContentType != "application/json" {
+			t.Errorf("%s: expected the json content type, got %s", name, output.ContentType)
+		}
+		var read testManifest
+		if err := ReadJSON(fs, "/manifest.json", &read); err != nil {
+			t.Fatal(err)
+		}
+		if read.Name != written.Name || strings.Join(read.Parts, ",") != "a,b" || read.Count != 2 {
+			t.Errorf("%s: expected %+v, got %+v", name, written, read)
+		}
+
+		if _, err := fs.PutObject("/invalid.json", []byte("{not json")); err != nil {
+			t.Fatal(err)
+		}
+		err = ReadJSON(fs, "/invalid.json", &read)
+		if err == nil || !strings.Contains(err.Error(), "decoding /invalid.json") {
+			t.Errorf("%s: expected a decode error, got %v", name, err)
+		}
+	}
+	if ct := mock.object("manifest.json").contentType; ct != "application/json" {
+		t.Errorf("expected the s3 object to have the json content type, got %s", ct)
+	}
+}
+
+// mergeStore is implemented by the stores that can merge objects
+type mergeStore interface {
+	FileStore
+	MergeObjects(parts []string, dest string) error
+}
+
+func TestMergeObjects(t *testing.T) {
+	large := bytes.Repeat([]byte("L"), int(s3MinPartSize))
+	parts := map[string][]byte{"/parts/1": large, "/parts/2": []byte("small two"), "/parts/3": []byte("small three"), "/parts/4": large}
+	order := []string{"/parts/1", "/parts/2", "/parts/3", "/parts/4"}
+	var expected []byte
+	for _, p := range order {
+		expected = append(expected, parts[p]...)
+	}
+	s3fs, mock := newTestS3FS(t)
+	for name, fs := range map[string]mergeStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		for _, p := range order {
+			if _, err := fs.PutObject(p, parts[p]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fs.MergeObjects(order, "/merged"); err != nil {
+			t.Fatal(err)
+		}
+		merged, err := GetObjectBytes(fs, "/merged", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(merged, expected) {
+			t.Errorf("%s: expected the parts concatenated in order, got %d bytes", name, len(merged))
+		}
+		if err := fs.MergeObjects([]string{"/parts/1", "/missing"}, "/bad"); err == nil {
+			t.Errorf("%s: expected a missing part to fail the merge", name)
+		}
+	}
+	if mock.count("UploadPartCopy") == 0 {
+		t.Error("expected the large s3 parts to be copied server side")
+	}
+	if len(mock.uploads) != 0 {
+		t.Errorf("expected failed merges to abort their uploads, got %d open", len(mock.uploads))
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.jsonl", []byte("first\n"+long+"\r\nlast")); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	err := ScanLines(fs, "/data.jsonl", 200*1024, func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0] != "first" || lines[1] != long || lines[2] != "last" {
+		t.Errorf("expected the three lines including the long one, got %d lines", len(lines))
+	}
+
+	if err := ScanLines(fs, "/data.jsonl", 0, func([]byte) error { return nil }); err == nil {
+		t.Error("expected a line over the default 64KB limit to fail")
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ScanLines(fs, "/data.jsonl", 200*1024, func([]byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("expected the callback error to stop the scan, got %v after %d calls", err, calls)
+	}
+
+	reader := &trackedReader{reader: strings.NewReader("a\nb\n")}
+	if err := ScanLines(&readerStore{reader: reader}, "/data", 0, func([]byte) error { return stop }); err != stop {
+		t.Fatal(err)
+	}
+	if !reader.closed {
+		t.Error("expected the body to be closed")
+	}
+}
+
+func TestPeekObject(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	large := append([]byte("\x89HDF\r\n\x1a\n"), make([]byte, 1024*1024)...)
+	for name, fs := range stores {
+		if _, err := fs.PutObject("/large.h5", large); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.PutObject("/short.txt", []byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.PutObject("/empty.txt", nil); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			key      string
+			expected string
+		}{
+			{"/large.h5", "\x89HDF\r\n\x1a\n"},
+			{"/short.txt", "abc"},
+			{"/empty.txt", ""},
+		}
+		for _, test := range tests {
+			head, err := PeekObject(fs, test.key, 8)
+			if err != nil {
+				t.Fatalf("%s %s: %s", name, test.key, err)
+			}
+			if string(head) != test.expected {
+				t.Errorf("%s %s: expected %q, got %q", name, test.key, test.expected, head)
+			}
+		}
+	}
+	if len(mock.ranges) != 3 || mock.ranges[0] != "bytes=0-7" {
+		t.Errorf("expected each peek to request the first 8 bytes, got %v", mock.ranges)
+	}
+}
+
+func TestWithOnUpload(t *testing.T) {
+	type upload struct {
+		key  string
+		md5  string
+		etag string
+	}
+	var uploads []upload
+	hook := WithOnUpload(func(key string, output *FileOperationOutput) {
+		if output == nil {
+			t.Errorf("expected an output for %s", key)
+			return
+		}
+		uploads = append(uploads, upload{key, output.Md5, output.ETag})
+	})
+	s3fs, mock := newTestS3FS(t, hook)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t, hook), "S3FS": s3fs}
+	sum := md5.Sum([]byte("hello"))
+	expectedMd5 := hex.EncodeToString(sum[:])
+	for name, fs := range stores {
+		uploads = nil
+		if _, err := fs.PutObject("/put.txt", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Upload(strings.NewReader("hello"), "/upload.txt"); err != nil {
+			t.Fatal(err)
+		}
+		expected := []upload{{"/put.txt", expectedMd5, ""}, {"/upload.txt", expectedMd5, ""}}
+		if len(uploads) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, uploads)
+		}
+		for i, u := range uploads {
+			if u.key != expected[i].key || u.md5 != expected[i].md5 {
+				t.Errorf("%s: expected %v, got %v", name, expected[i], u)
+			}
+		}
+	}
+
+	uploads = nil
+	failed := errors.New("put failed")
+	mock.errs["PutObject"] = failed
+	if _, err := s3fs.PutObject("/failed.txt", []byte("hello")); !errors.Is(err, failed) {
+		t.Fatalf("expected the put error to be returned, got %v", err)
+	}
+	if len(uploads) != 0 {
+		t.Errorf("expected no hook call for a failed write, got %v", uploads)
+	}
+	id, etags := startS3Upload(t, s3fs, "/chunked.txt", []byte("hello"))
+	if err := s3fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked.txt", ChunkUploadIds: etags}); err != nil {
+		t.Fatal(err)
+	}
+	//the etag of a multipart upload isn't an md5, so it is only reported as the etag
+	if len(uploads) != 1 || uploads[0].key != "/chunked.txt" || uploads[0].etag == "" || uploads[0].md5 != "" {
+		t.Errorf("expected the completed upload to be reported with only its etag, got %v", uploads)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	//larger than two of the 5MB ranges s3 downloads in
+	data := bytes.Repeat([]byte("0123456789abcdef"), 11*1024*1024/16+1)
+	for name, fs := range stores {
+		if _, err := fs.PutObject("/data/large.bin", data); err != nil {
+			t.Fatal(err)
+		}
+		localPath := filepath.Join(t.TempDir(), "nested", "dir", "large.bin")
+		if err := DownloadFile(fs, "/data/large.bin", localPath); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		downloaded, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded, data) {
+			t.Errorf("%s: expected the downloaded file to match the %d source bytes, got %d bytes", name, len(data), len(downloaded))
+		}
+	}
+	if len(mock.ranges) != 3 {
+		t.Errorf("expected the s3 download to be split into 3 ranges, got %v", mock.ranges)
+	}
+}
+
+func TestPutObjectIfAbsent(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		if _, err := PutObjectIfAbsent(fs, "/claims/run-1", []byte("first")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		_, err := PutObjectIfAbsent(fs, "/claims/run-1", []byte("second"))
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("%s: expected ErrAlreadyExists, got %v", name, err)
+		}
+		if content, err := GetObjectString(fs, "/claims/run-1", 0); err != nil || content != "first" {
+			t.Errorf("%s: expected the first claim to be kept, got %q %v", name, content, err)
+		}
+	}
+}
+
+func TestUploadIfAbsent(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		if _, err := fs.Upload(strings.NewReader("first"), "/claims/run-1", WithIfAbsent()); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		_, err := fs.Upload(strings.NewReader("second"), "/claims/run-1", WithIfAbsent())
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("%s: expected ErrAlreadyExists, got %v", name, err)
+		}
+		if content, err := GetObjectString(fs, "/claims/run-1", 0); err != nil || content != "first" {
+			t.Errorf("%s: expected the first claim to be kept, got %q %v", name, content, err)
+		}
+	}
+}
+
+func TestBlockFSPutObjectIfAbsentRace(t *testing.T) {
+	fs := newTestBlockFS(t)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := PutObjectIfAbsent(fs, "/claims/race", []byte{byte(i)})
+			if err == nil {
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrAlreadyExists) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("expected exactly one writer to claim the path, got %d", claimed)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	blockfs := newTestBlockFS(t)
+	putKeys(t, blockfs, "/a.txt", "/dir/b.txt", "/dir/nested/c.txt")
+	if err := blockfs.Empty(filepath.Join(blockfs.rootDir, "dir")); err == nil {
+		t.Error("expected a mismatched confirmation to be rejected")
+	}
+	if err := blockfs.Empty(blockfs.rootDir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(blockfs.rootDir)
+	if err != nil {
+		t.Fatalf("expected the root directory to be kept, got %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the root directory to be empty, got %d entries", len(entries))
+	}
+
+	s3fs, mock := newTestS3FS(t)
+	for i := 0; i < 1500; i++ {
+		mock.put(fmt.Sprintf("data/%05d", i), nil)
+	}
+	if err := s3fs.Empty("another-bucket"); err == nil {
+		t.Error("expected a mismatched confirmation to be rejected")
+	}
+	if len(mock.objects) != 1500 {
+		t.Fatalf("expected a rejected Empty to delete nothing, got %d objects", len(mock.objects))
+	}
+	if err := s3fs.Empty(testBucket); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.objects) != 0 {
+		t.Errorf("expected the bucket to be empty, got %d objects", len(mock.objects))
+	}
+	if mock.count("DeleteObjects") != 2 {
+		t.Errorf("expected the keys to be deleted in 2 batches, got %d", mock.count("DeleteObjects"))
+	}
+}
+
+func TestUploadIfMatch(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		first, err := fs.Upload(strings.NewReader("first"), "/state.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Upload(strings.NewReader("second"), "/state.txt", WithIfMatch(first.Md5)); err != nil {
+			t.Errorf("%s: expected the upload with the current etag to succeed, got %v", name, err)
+		}
+		_, err = fs.Upload(strings.NewReader("stale"), "/state.txt", WithIfMatch(first.Md5))
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: expected ErrPreconditionFailed for a stale etag, got %v", name, err)
+		}
+		if content, err := GetObjectString(fs, "/state.txt", 0); err != nil || content != "second" {
+			t.Errorf("%s: expected the second upload to be kept, got %q %v", name, content, err)
+		}
+	}
+}
+
+func TestPutObjectIfMatch(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		first, err := fs.PutObject("/state.json", []byte(`{"v":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := fs.PutObject("/state.json", []byte(`{"v":2}`), WithIfMatch(first.Md5))
+		if err != nil {
+			t.Fatalf("%s: expected the write with the current etag to succeed, got %v", name, err)
+		}
+		//a writer still holding the first etag lost the race
+		_, err = fs.PutObject("/state.json", []byte(`{"v":"stale"}`), WithIfMatch(first.Md5))
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: expected ErrPreconditionFailed for a stale etag, got %v", name, err)
+		}
+		if content, err := GetObjectString(fs, "/state.json", 0); err != nil || content != `{"v":2}` {
+			t.Errorf("%s: expected the second write to be kept, got %q %v", name, content, err)
+		}
+		_, err = fs.PutObject("/missing.json", []byte("{}"), WithIfMatch(second.Md5))
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: expected ErrPreconditionFailed for a missing object, got %v", name, err)
+		}
+	}
+}
+
+func TestPrefixExistsAndEmpty(t *testing.T) {
+	type prefixChecker interface {
+		PrefixExists(path string) (bool, error)
+		PrefixEmpty(path string) (bool, error)
+	}
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		putKeys(t, fs, "/full/a.txt", "/full/sub/b.txt", "/fuller/c.txt")
+		if err := fs.CreateDir("/empty"); err != nil {
+			t.Fatal(err)
+		}
+		checker := fs.(prefixChecker)
+		tests := []struct {
+			path   string
+			exists bool
+			empty  bool
+		}{
+			{"/full", true, false},
+			{"/full/", true, false},
+			{"/full/sub", true, false},
+			{"/empty", true, true},
+			{"/missing", false, true},
+			//a prefix is a directory, so a sibling that starts with the same name isn't under it
+			{"/ful", false, true},
+		}
+		for _, test := range tests {
+			exists, err := checker.PrefixExists(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != test.exists {
+				t.Errorf("%s: PrefixExists(%s) expected %v, got %v", name, test.path, test.exists, exists)
+			}
+			empty, err := checker.PrefixEmpty(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if empty != test.empty {
+				t.Errorf("%s: PrefixEmpty(%s) expected %v, got %v", name, test.path, test.empty, empty)
+			}
+		}
+	}
+}
+
+func TestSafeBuildPath(t *testing.T) {
+	tests := []struct {
+		parts    []string
+		pathType PATHTYPE
+		expected string
+	}{
+		{[]string{"data", "file.txt"}, FILE, "/data/file.txt"},
+		{[]string{"/data/", "/sub/", "file.txt"}, FILE, "/data/sub/file.txt"},
+		{[]string{"data//sub", "", "file.txt"}, FILE, "/data/sub/file.txt"},
+		{[]string{"data", "sub"}, FOLDER, "/data/sub/"},
+		//dots that aren't a whole segment are part of the name
+		{[]string{"data", "file..txt"}, FILE, "/data/file..txt"},
+		{[]string{"..data", "file.txt"}, FILE, "/..data/file.txt"},
+	}
+	for _, test := range tests {
+		p, err := SafeBuildPath(test.parts, test.pathType)
+		if err != nil {
+			t.Errorf("%v: expected no error, got %v", test.parts, err)
+			continue
+		}
+		if p != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.parts, test.expected, p)
+		}
+	}
+	for _, parts := range [][]string{{"data", ".."}, {"../data", "file.txt"}, {"data", "sub/../../file.txt"}} {
+		if _, err := SafeBuildPath(parts, FILE); !errors.Is(err, ErrPathTraversal) {
+			t.Errorf("%v: expected ErrPathTraversal, got %v", parts, err)
+		}
+	}
+	for _, parts := range [][]string{nil, {""}, {"/", "//"}} {
+		if _, err := SafeBuildPath(parts, FOLDER); !errors.Is(err, ErrEmptyPath) {
+			t.Errorf("%v: expected ErrEmptyPath, got %v", parts, err)
+		}
+	}
+}
+
+func TestCopyPrefix(t *testing.T) {
+	type prefixCopier interface {
+		CopyPrefix(source string, dest string, progress CopyProgressFunction) error
+	}
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		putKeys(t, fs, "/src/a.txt", "/src/sub/b.txt", "/srcx/c.txt")
+		copied := map[string]string{}
+		count := 0
+		err := fs.(prefixCopier).CopyPrefix("/src", "/dst/", func(source string, dest string, n int) {
+			copied[source] = dest
+			count = n
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"/src/a.txt": "/dst/a.txt", "/src/sub/b.txt": "/dst/sub/b.txt"}
+		if !reflect.DeepEqual(copied, expected) || count != 2 {
+			t.Errorf("%s: expected progress for %v, got %v with a count of %d", name, expected, copied, count)
+		}
+		for source, dest := range expected {
+			if content := readObject(t, fs, dest); content != source {
+				t.Errorf("%s: expected %s to hold the content of %s, got %q", name, dest, source, content)
+			}
+			if _, err := fs.GetObjectInfo(source); err != nil {
+				t.Errorf("%s: expected the source to remain, got %v", name, err)
+			}
+		}
+		if _, err := fs.GetObjectInfo("/dst/c.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("%s: expected the sibling prefix not to be copied, got %v", name, err)
+		}
+	}
+}
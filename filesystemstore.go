@@ -1,33 +1,168 @@
 package filestore
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-//@TODO this is kind of clunky.  BlockFSConfig is only used in NewFileStore as a type case so we know to create a Block File Store
-//as of now I don't actually need any config properties
-type BlockFSConfig struct{}
+//@TODO this is kind of clunky.  BlockFSConfig is mostly used in NewFileStore as a type case so we know to create a Block File Store
+type BlockFSConfig struct {
+	// ChunkSize is the size in bytes of the chunks written with WriteChunk. Defaults to 10MB when zero
+	ChunkSize int64
+	// FetchOwner populates ModifiedBy in GetDir with the file owner. It is opt in because it adds a user lookup per owner
+	FetchOwner bool
+	// RootDir confines the store to a directory. Paths are resolved relative to it, paths that would escape it are
+	// rejected, and paths returned by the store are relative to it. When empty, paths are used as given
+	RootDir string
+	// FileMode is the permission of files created by the store. Defaults to 0644 when zero
+	FileMode os.FileMode
+	// DirMode is the permission of directories created by the store. Defaults to 0755 when zero
+	DirMode os.FileMode
+	// Name identifies the store in logs and errors. Defaults to the RootDir when empty
+	Name string
+	// Durable flushes files to disk with fsync before PutObject, Upload and WriteChunk return, so a write that succeeded
+	// survives a power loss. It is opt in because each fsync waits on the disk
+	Durable bool
+	// TempDir is the directory staged writes are written to before they are renamed into place. PutObject, Upload,
+	// UploadFile, CopyPrefix and MergeObjects stage their writes, chunked uploads are written in place. When it is on another
+	// device than the target, where a rename can't move the file, the staged file is copied next to the target instead.
+	// Defaults to the directory of the target when empty
+	TempDir string
+	// FollowSymlinks makes GetDir, Walk, WalkDir and CopyPrefix descend into symlinked directories. A link back to a
+	// directory above it is visited but not descended into, so link loops end. Links can lead outside the RootDir
+	FollowSymlinks bool
+}
+
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+type BlockFS struct {
+	chunkSize  int64
+	fetchOwner bool
+	rootDir    string
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	name       string
+	durable    bool
+	tempDir    string
+	follow     bool
+	options    storeOptions
+	//mu serializes conditional writes so the etag check and the write happen together. Other processes are kept out
+	//by a flock on the directory of the file, except on windows where the guard is only within this process
+	mu sync.Mutex
+	//uploads tracks the chunks written to each chunked upload started by this store, guarded by uploadsMu
+	uploads   map[string]*chunkedUpload
+	uploadsMu sync.Mutex
+}
+
+// chunkedUpload is the size of each chunk written to an upload, by chunk id
+type chunkedUpload struct {
+	objectPath string
+	chunks     map[int64]int
+}
+
+// NewBlockFS creates a store rooted at the RootDir of the config
+func NewBlockFS(config BlockFSConfig, opts ...Option) (*BlockFS, error) {
+	fs := BlockFS{
+		chunkSize:  defaultChunkSize,
+		fetchOwner: config.FetchOwner,
+		rootDir:    config.RootDir,
+		fileMode:   defaultFileMode,
+		dirMode:    defaultDirMode,
+		name:       config.Name,
+		durable:    config.Durable,
+		tempDir:    config.TempDir,
+		follow:     config.FollowSymlinks,
+		options:    newStoreOptions(opts),
+	}
+	if config.ChunkSize > 0 {
+		fs.chunkSize = config.ChunkSize
+	}
+	if config.FileMode != 0 {
+		fs.fileMode = config.FileMode
+	}
+	if config.DirMode != 0 {
+		fs.dirMode = config.DirMode
+	}
+	return &fs, nil
+}
+
+// ResourceName returns the configured Name of the store, or its root directory when no name was given
+func (b *BlockFS) ResourceName() string {
+	if b.name != "" {
+		return b.name
+	}
+	return b.rootDir
+}
+
+// fsPath resolves a store path to a path on disk, rejecting paths that escape the root directory
+func (b *BlockFS) fsPath(path string) (string, error) {
+	if b.rootDir == "" {
+		return path, nil
+	}
+	sep := string(filepath.Separator)
+	rel := filepath.Clean(strings.TrimLeft(filepath.FromSlash(path), sep))
+	if rel == ".." || strings.HasPrefix(rel, ".."+sep) {
+		return "", fmt.Errorf("%w: %s", ErrPathTraversal, path)
+	}
+	return filepath.Join(b.rootDir, rel), nil
+}
+
+// storePath converts a path on disk back to a store path relative to the root directory
+func (b *BlockFS) storePath(path string) string {
+	if b.rootDir == "" {
+		return path
+	}
+	rel, err := filepath.Rel(b.rootDir, path)
+	if err != nil {
+		return path
+	}
+	if rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
 
-type BlockFS struct{}
+func (b *BlockFS) GetDir(path string, recursive bool) (_ *[]FileStoreResultObject, err error) {
+	defer b.options.observe("GetDir", 0)(&err)
+	b.options.logf("getting directory %s", path)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
 
-func (b *BlockFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject, error) {
-	fmt.Println(path)
+	var owners map[uint32]string
+	if b.fetchOwner {
+		owners = make(map[uint32]string)
+	}
+	modifiedBy := func(fi os.FileInfo) string {
+		if owners == nil {
+			return ""
+		}
+		return fileOwner(fi, owners)
+	}
 
 	var objects []FileStoreResultObject
 	switch recursive {
 	case true:
 		objects = make([]FileStoreResultObject, 0)
 		i := 0
-		err := filepath.Walk(
-			path,
+		err := b.walk(
+			dirPath,
 			func(path string, file os.FileInfo, err error) error {
 				if err != nil {
 					return err
@@ -36,11 +171,12 @@ func (b *BlockFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject,
 					ID:         i,
 					Name:       file.Name(),
 					Size:       strconv.FormatInt(file.Size(), 10),
-					Path:       filepath.Dir(path),
+					SizeBytes:  file.Size(),
+					Path:       b.storePath(filepath.Dir(path)),
 					Type:       filepath.Ext(file.Name()),
 					IsDir:      file.IsDir(),
 					Modified:   file.ModTime(),
-					ModifiedBy: "",
+					ModifiedBy: modifiedBy(file),
 				})
 				i++
 				return nil
@@ -50,105 +186,1065 @@ func (b *BlockFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject,
 		}
 
 	case false:
-		contents, err := ioutil.ReadDir(path)
+		contents, err := ioutil.ReadDir(dirPath)
 		if err != nil {
-			return nil, err
+			return nil, fsError(path, err)
 		}
+		contents = withoutGzipMarkers(contents)
 		objects = make([]FileStoreResultObject, len(contents))
 		for i, f := range contents {
 			objects[i] = FileStoreResultObject{
 				ID:         i,
 				Name:       f.Name(),
 				Size:       strconv.FormatInt(f.Size(), 10),
+				SizeBytes:  f.Size(),
 				Path:       path,
 				Type:       filepath.Ext(f.Name()),
 				IsDir:      f.IsDir(),
 				Modified:   f.ModTime(),
-				ModifiedBy: "",
+				ModifiedBy: modifiedBy(f),
 			}
 		}
 	}
+	sortResults(objects)
 	return &objects, nil
 }
 
-func (b *BlockFS) GetObject(path string) (io.ReadCloser, error) {
-	return os.Open(path)
+// GetDirPage lists a single page of the entries directly in the directory, in name order. An empty token requests the first
+// page and the returned token requests the next, with an empty token returned once the listing is done. The directory is
+// read for every page, so entries created or removed between pages may be missed or repeated
+func (b *BlockFS) GetDirPage(path string, token string, pageSize int) (_ []FileStoreResultObject, _ string, err error) {
+	defer b.options.observe("GetDirPage", 0)(&err)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, "", fsError(path, err)
+	}
+	page, next := pageEntries(withoutGzipMarkers(contents), token, pageSize)
+	objects := make([]FileStoreResultObject, len(page))
+	for i, f := range page {
+		objects[i] = fileResult(i, b.storePath(filepath.Join(dirPath, f.Name())), f)
+	}
+	return objects, next, nil
+}
+
+// ListDirs returns the names of the directories directly in the directory, sorted by name
+func (b *BlockFS) ListDirs(path string) (_ []string, err error) {
+	defer b.options.observe("ListDirs", 0)(&err)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	return dirNames(contents), nil
+}
+
+func (b *BlockFS) GetObject(path string) (reader io.ReadCloser, err error) {
+	defer b.options.observeRead("GetObject")(&reader, &err)
+	return b.getObject(path)
+}
+
+// getObject opens the file, decompressing it when it is marked as compressed
+func (b *BlockFS) getObject(path string) (io.ReadCloser, error) {
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	body := b.options.limitReadCloser(f)
+	if b.compressed(filePath) {
+		return newGzipReadCloser(body)
+	}
+	return body, nil
+}
+
+// GetObjectInfo stats the file and sniffs its content type from the first 512 bytes. The size of a file written with
+// WithCompression is its compressed size, and its ContentEncoding is gzip
+func (b *BlockFS) GetObjectInfo(path string) (_ *ObjectInfo, err error) {
+	defer b.options.observe("GetObjectInfo", 0)(&err)
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	info := &ObjectInfo{
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Metadata: map[string]string{},
+	}
+	if fi.IsDir() {
+		return info, nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	defer f.Close()
+	var content io.Reader = f
+	if b.compressed(filePath) {
+		info.ContentEncoding = gzipEncoding
+		content, err = gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info.ContentType, err = sniffContentType(content)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Size returns the size of the file in bytes
+func (b *BlockFS) Size(path string) (_ int64, err error) {
+	defer b.options.observe("Size", 0)(&err)
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return 0, fsError(path, err)
+	}
+	return fi.Size(), nil
 }
 
-func (b *BlockFS) DeleteObjects(path ...string) error {
-	var err error
+func (b *BlockFS) DeleteObjects(path ...string) (err error) {
+	defer b.options.observe("DeleteObjects", 0)(&err)
 	for _, p := range path {
-		if isDir(p) {
-			err = os.RemoveAll(p)
+		filePath, pathErr := b.fsPath(p)
+		if pathErr != nil {
+			err = pathErr
+			continue
+		}
+		var removeErr error
+		if isDir(filePath) {
+			removeErr = os.RemoveAll(filePath)
 		} else {
-			err = os.Remove(p)
+			removeErr = os.Remove(filePath)
+			os.Remove(filePath + gzipMarkerSuffix)
+		}
+		if removeErr != nil {
+			err = fsError(p, removeErr)
 		}
 	}
 	return err
 }
 
-func (b *BlockFS) PutObject(path string, data []byte) (*FileOperationOutput, error) {
-	if len(data) == 0 {
-		f := FileOperationOutput{}
-		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
-		return &f, err
-	} else {
-		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+// PutObject writes the data to the file at path, creating the parent directories as needed. Empty data writes an empty file, use CreateDir for a directory.
+// The data is written to a temp file that is renamed over the target, so readers see either the old or the new file, never a partial one,
+// and a shorter payload fully replaces a longer existing file instead of leaving its trailing bytes behind.
+// The content type of the data is detected, or taken from WithContentType, and returned in the output
+func (b *BlockFS) PutObject(path string, data []byte, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer b.options.observe("PutObject", int64(len(data)))(&err)
+	defer func() { b.options.uploaded(path, output, err) }()
+	options := newUploadOptions(opts)
+	if options.retention != nil {
+		return nil, fmt.Errorf("%w: retention on a file system", ErrNotSupported)
+	}
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	err = b.mkdirAll(filepath.Dir(filePath))
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	release, err := b.checkConditions(path, filePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { release(err != nil) }()
+	contentType := options.contentType
+	if contentType == "" {
+		contentType = detectContentType(path, data)
+	}
+	if options.compress {
+		data, err = gzipBytes(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	md5, err := b.writeFileAtomic(filePath, data)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	err = b.markCompressed(filePath, options.compress)
+	if err != nil {
+		return nil, fsError(path, err)
+	}
+	return &FileOperationOutput{
+		Md5:         md5,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+	}, nil
+}
+
+// checkConditions checks the file against WithIfMatch and WithIfAbsent before it is written. WithIfMatch holds a lock on
+// the directory of the file until release is called, and WithIfAbsent claims the path with an exclusive create, the data
+// then replaces the empty file atomically. Release is called once the write is done, and removes the claim when it failed
+func (b *BlockFS) checkConditions(path string, filePath string, options uploadOptions) (release func(failed bool), err error) {
+	release = func(bool) {}
+	if options.ifMatch != "" {
+		b.mu.Lock()
+		unlock, err := lockDir(filepath.Dir(filePath))
 		if err != nil {
+			b.mu.Unlock()
+			return nil, fsError(path, err)
+		}
+		release = func(bool) {
+			unlock()
+			b.mu.Unlock()
+		}
+		if err := b.checkETag(path, filePath, options.ifMatch); err != nil {
+			release(true)
 			return nil, err
 		}
-		defer f.Close()
-		_, err = f.Write(data)
-		md5 := getFileMd5(f)
-		output := &FileOperationOutput{
-			Md5: md5,
+	}
+	if options.ifAbsent {
+		f, err := b.openFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if os.IsExist(err) {
+			release(true)
+			return nil, fmt.Errorf("%w: %s", ErrAlreadyExists, path)
+		}
+		if err != nil {
+			release(true)
+			return nil, fsError(path, err)
+		}
+		f.Close()
+		unlock := release
+		release = func(failed bool) {
+			if failed {
+				//release the claim so the path can be written again
+				os.Remove(filePath)
+			}
+			unlock(failed)
 		}
-		return output, err
 	}
+	return release, nil
 }
 
-func (b *BlockFS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
-	fmt.Println(u.ObjectPath)
+// checkETag compares the md5 of the file on disk to the expected etag
+func (b *BlockFS) checkETag(path string, filePath string, expected string) error {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s does not exist", ErrPreconditionFailed, path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	md5, err := getFileMd5(f)
+	if err != nil {
+		return err
+	}
+	return checkETag(path, expected, md5)
+}
+
+// compressed reports whether the file is marked as gzip compressed
+func (b *BlockFS) compressed(filePath string) bool {
+	_, err := os.Stat(filePath + gzipMarkerSuffix)
+	return err == nil
+}
+
+// markCompressed creates or removes the sidecar file that marks the file as gzip compressed
+func (b *BlockFS) markCompressed(filePath string, compressed bool) error {
+	markerPath := filePath + gzipMarkerSuffix
+	if !compressed {
+		err := os.Remove(markerPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	f, err := b.openFile(markerPath, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// mkdirAll creates the directory and any missing parents with the DirMode. The mode is set with a chmod once they are
+// created, so the umask doesn't narrow it. Directories that already existed keep their permissions
+func (b *BlockFS) mkdirAll(dir string) error {
+	var created []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		created = append(created, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, b.dirMode); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := os.Chmod(d, b.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFile opens the file for writing with the flags and sets it to the FileMode. The mode is set with a chmod rather
+// than left to the create, so the umask doesn't narrow it
+func (b *BlockFS) openFile(filePath string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(filePath, flag, b.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(b.fileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// createTemp creates the file a write to filePath is staged in, in the TempDir when one is configured and otherwise
+// in the directory of filePath
+func (b *BlockFS) createTemp(filePath string) (*os.File, error) {
+	dir := b.tempDir
+	if dir == "" {
+		dir = filepath.Dir(filePath)
+	}
+	return ioutil.TempFile(dir, "."+filepath.Base(filePath)+".tmp")
+}
+
+// commitTemp renames the staged file over filePath. When the rename fails because the TempDir is on another device,
+// the staged file is copied to a temp file next to filePath, which can be renamed, and the staged file is removed
+func (b *BlockFS) commitTemp(tmpPath string, filePath string) error {
+	err := os.Rename(tmpPath, filePath)
+	if err == nil || b.tempDir == "" {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	localPath := f.Name()
+	err = f.Chmod(b.fileMode)
+	if err == nil {
+		_, err = io.Copy(f, src)
+	}
+	if err == nil {
+		err = b.sync(f)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(localPath, filePath)
+	}
+	if err != nil {
+		os.Remove(localPath)
+	}
+	return err
+}
+
+// stageFile writes a temp file with write and renames it into place. The temp file is removed if any step fails,
+// leaving the existing file untouched
+func (b *BlockFS) stageFile(filePath string, write func(f *os.File) error) error {
+	f, err := b.createTemp(filePath)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	err = write(f)
+	if err == nil {
+		err = b.sync(f)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = b.commitTemp(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// writeFileAtomic stages the data like stageFile. It returns the md5 of the written file
+func (b *BlockFS) writeFileAtomic(filePath string, data []byte) (string, error) {
+	var md5 string
+	err := b.stageFile(filePath, func(f *os.File) (err error) {
+		md5, err = writeAndHash(f, data, b.fileMode)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return md5, nil
+}
+
+func writeAndHash(f *os.File, data []byte, mode os.FileMode) (string, error) {
+	err := f.Chmod(mode)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return getFileMd5(f)
+}
+
+// Append adds the data to the end of the file, creating the file and its parent directories when they don't exist.
+// Files written with WithCompression can't be appended to
+func (b *BlockFS) Append(path string, data []byte) (err error) {
+	defer b.options.observe("Append", int64(len(data)))(&err)
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return err
+	}
+	if b.compressed(filePath) {
+		return fmt.Errorf("%w: appending to the compressed file %s", ErrNotSupported, path)
+	}
+	err = b.mkdirAll(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	f, err := b.openFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+	return b.sync(f)
+}
+
+// CreateDir creates the directory at path, along with any missing parents
+func (b *BlockFS) CreateDir(path string) (err error) {
+	defer b.options.observe("CreateDir", 0)(&err)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return err
+	}
+	return b.mkdirAll(dirPath)
+}
+
+// CreateEmptyObject creates an empty file at path, truncating the file if it already exists
+func (b *BlockFS) CreateEmptyObject(path string) error {
+	_, err := b.PutObject(path, nil)
+	return err
+}
+
+// Touch sets the modification time of the file at path to now without changing its content, creating an empty file when
+// it doesn't exist
+func (b *BlockFS) Touch(path string) (err error) {
+	defer b.options.observe("Touch", 0)(&err)
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(filePath, now, now)
+	if os.IsNotExist(err) {
+		return b.CreateEmptyObject(path)
+	}
+	return err
+}
+
+// CopyPrefix copies the source directory tree into the dest directory, recreating the directories and copying each file.
+// Failures are collected into a MultiError so one bad file doesn't stop the copy
+func (b *BlockFS) CopyPrefix(source string, dest string, progress CopyProgressFunction) (err error) {
+	defer b.options.observe("CopyPrefix", 0)(&err)
+	sourceDir, err := b.fsPath(source)
+	if err != nil {
+		return err
+	}
+	destDir, err := b.fsPath(dest)
+	if err != nil {
+		return err
+	}
+	var errs MultiError
+	copied := 0
+	err = b.walk(sourceDir, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(destDir, rel)
+		if file.IsDir() {
+			return b.mkdirAll(destPath)
+		}
+		if err := b.copyFile(path, destPath); err != nil {
+			errs = append(errs, fmt.Errorf("copying %s: %w", b.storePath(path), err))
+			return nil
+		}
+		copied++
+		if progress != nil {
+			progress(b.storePath(path), b.storePath(destPath), copied)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errs.errorOrNil()
+}
+
+// Upload writes the reader to the file at key, creating the parent directories as needed. The output has the md5 and size
+// of the content and its content type, which is detected from the key extension or the content unless WithContentType is provided.
+// WithCompression, WithIfMatch and WithIfAbsent apply as they do to PutObject
+func (b *BlockFS) Upload(reader io.Reader, key string, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer b.options.observeUpload("Upload")(&output, &err)
+	defer func() { b.options.uploaded(key, output, err) }()
+	options := newUploadOptions(opts)
+	if options.retention != nil {
+		return nil, fmt.Errorf("%w: retention on a file system", ErrNotSupported)
+	}
+	filePath, err := b.fsPath(key)
+	if err != nil {
+		return nil, err
+	}
+	err = b.mkdirAll(filepath.Dir(filePath))
+	if err != nil {
+		return nil, fsError(key, err)
+	}
+	release, err := b.checkConditions(key, filePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { release(err != nil) }()
+	reader, hashing, err := prepareUpload(reader, key, &options, b.options)
+	if err != nil {
+		return nil, err
+	}
+	err = b.writeFile(filePath, reader, options.compress)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOperationOutput{
+		Md5:         hashing.md5(),
+		ContentType: options.contentType,
+		Size:        hashing.size,
+	}, nil
+}
+
+// writeFile writes the reader to the file on disk, creating the parent directories as needed. The reader is staged like
+// PutObject, so a failed read leaves the existing file untouched. The file is marked as compressed when the reader is gzipped
+func (b *BlockFS) writeFile(filePath string, reader io.Reader, compressed bool) error {
+	err := b.mkdirAll(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	err = b.stageFile(filePath, func(f *os.File) error {
+		if err := f.Chmod(b.fileMode); err != nil {
+			return err
+		}
+		_, err := io.Copy(f, reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return b.markCompressed(filePath, compressed)
+}
+
+// sync flushes the file to disk when the store is durable
+func (b *BlockFS) sync(f *os.File) error {
+	if !b.durable {
+		return nil
+	}
+	return f.Sync()
+}
+
+// copyFile copies the file as stored, so a compressed file is copied compressed along with its marker
+func (b *BlockFS) copyFile(source string, dest string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.writeFile(dest, f, b.compressed(source))
+}
+
+func (b *BlockFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return uploadFile(b, filePath, key, opts)
+}
+
+func (b *BlockFS) InitializeObjectUpload(u UploadConfig) (_ UploadResult, err error) {
+	defer b.options.observe("InitializeObjectUpload", 0)(&err)
+	b.options.logf("initializing upload %s", u.ObjectPath)
 	result := UploadResult{}
-	os.MkdirAll(filepath.Dir(u.ObjectPath), os.ModePerm) //@TODO incomplete
-	f, err := os.Create(u.ObjectPath)                    //@TODO incomplete
+	filePath, err := b.fsPath(u.ObjectPath)
+	if err != nil {
+		return result, err
+	}
+	if err := b.mkdirAll(filepath.Dir(filePath)); err != nil {
+		return result, err
+	}
+	f, err := b.openFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
 		return result, err
 	}
 	_ = f.Close()
+	if err := b.markCompressed(filePath, false); err != nil {
+		return result, err
+	}
 	result.ID = uuid.New().String()
+	b.uploadsMu.Lock()
+	if b.uploads == nil {
+		b.uploads = make(map[string]*chunkedUpload)
+	}
+	b.uploads[result.ID] = &chunkedUpload{objectPath: u.ObjectPath, chunks: make(map[int64]int)}
+	b.uploadsMu.Unlock()
 	return result, nil
 }
 
-func (b *BlockFS) WriteChunk(u UploadConfig) (UploadResult, error) {
+func (b *BlockFS) WriteChunk(u UploadConfig) (_ UploadResult, err error) {
+	defer b.options.observe("WriteChunk", int64(len(u.Data)))(&err)
 	result := UploadResult{}
-	//var err error
-	mutex := &sync.Mutex{}
-	mutex.Lock()
-	defer mutex.Unlock()
-	f, err := os.OpenFile(u.ObjectPath, os.O_WRONLY|os.O_CREATE, 0644) //@TODO incomplete
+	if u.ChunkId < 0 {
+		return result, fmt.Errorf("chunk %d is not a valid chunk id", u.ChunkId)
+	}
+	if int64(len(u.Data)) > b.chunkSize {
+		return result, fmt.Errorf("chunk %d is %d bytes, larger than the configured chunk size of %d bytes", u.ChunkId, len(u.Data), b.chunkSize)
+	}
+	filePath, err := b.fsPath(u.ObjectPath)
+	if err != nil {
+		return result, err
+	}
+	f, err := b.openFile(filePath, os.O_WRONLY|os.O_CREATE)
 	if err != nil {
 		return result, err
 	}
 	defer f.Close()
-	_, err = f.WriteAt(u.Data, (u.ChunkId * chunkSize))
+	_, err = f.WriteAt(u.Data, (u.ChunkId * b.chunkSize))
+	if err == nil {
+		err = b.sync(f)
+	}
+	if err == nil {
+		b.uploadsMu.Lock()
+		if upload, ok := b.uploads[u.UploadId]; ok {
+			upload.chunks[u.ChunkId] = len(u.Data)
+		}
+		b.uploadsMu.Unlock()
+	}
 	result.WriteSize = len(u.Data)
 	return result, err
 }
 
-func (b *BlockFS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
-	//return md5 hash for file
+// CompleteObjectUpload checks that the chunks of the upload were all written, with no gaps between chunk ids and every chunk
+// but the last of the full chunk size, and that the file is the size of the chunks. A missing chunk would otherwise leave
+// a zero filled hole in the file. Only uploads started by this store are tracked, others complete without the check
+func (b *BlockFS) CompleteObjectUpload(u CompletedObjectUploadConfig) (err error) {
+	defer b.options.observe("CompleteObjectUpload", 0)(&err)
+	b.uploadsMu.Lock()
+	upload, ok := b.uploads[u.UploadId]
+	delete(b.uploads, u.UploadId)
+	b.uploadsMu.Unlock()
+	if ok {
+		if err := b.checkChunks(upload); err != nil {
+			//keep tracking the upload so the missing chunks can be written and the upload completed again
+			b.uploadsMu.Lock()
+			b.uploads[u.UploadId] = upload
+			b.uploadsMu.Unlock()
+			return err
+		}
+	}
+	if b.options.onUpload != nil {
+		size, err := b.Size(u.ObjectPath)
+		if err != nil {
+			return err
+		}
+		b.options.uploaded(u.ObjectPath, &FileOperationOutput{Size: size}, nil)
+	}
+	return nil
+}
+
+func (b *BlockFS) checkChunks(upload *chunkedUpload) error {
+	if len(upload.chunks) == 0 {
+		return fmt.Errorf("upload of %s has no chunks written", upload.objectPath)
+	}
+	var last int64
+	for id := range upload.chunks {
+		if id > last {
+			last = id
+		}
+	}
+	var missing []string
+	var total int64
+	for id := int64(0); id <= last; id++ {
+		size, ok := upload.chunks[id]
+		if !ok {
+			missing = append(missing, strconv.FormatInt(id, 10))
+			continue
+		}
+		if id < last && int64(size) != b.chunkSize {
+			return fmt.Errorf("chunk %d is %d bytes, only the last chunk can be less than %d bytes", id, size, b.chunkSize)
+		}
+		total += int64(size)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("upload of %s is missing chunks %s of %d", upload.objectPath, strings.Join(missing, ", "), last+1)
+	}
+	size, err := b.Size(upload.objectPath)
+	if err != nil {
+		return err
+	}
+	if size != total {
+		return fmt.Errorf("upload of %s is %d bytes but its chunks total %d bytes", upload.objectPath, size, total)
+	}
 	return nil
 }
 
 func (b *BlockFS) Walk(path string, vistorFunction FileVisitFunction) error {
-	err := filepath.Walk(path,
+	return b.WalkContext(context.Background(), path, vistorFunction)
+}
+
+// WalkContext is Walk with cancellation. The context is checked before each file is visited and ctx.Err() is returned
+// once it is cancelled. The visitor can return ErrStopWalk to end the walk early without an error
+func (b *BlockFS) WalkContext(ctx context.Context, path string, vistorFunction FileVisitFunction) (err error) {
+	defer b.options.observe("WalkContext", 0)(&err)
+	walkPath, err := b.fsPath(path)
+	if err != nil {
+		return err
+	}
+	err = b.walk(walkPath,
 		func(path string, fileinfo os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			err = vistorFunction(path, fileinfo)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err = vistorFunction(b.storePath(path), fileinfo)
 			return err
 		})
+	if errors.Is(err, ErrStopWalk) {
+		return nil
+	}
+	return err
+}
+
+// WalkDir visits every file and directory under path. Returning filepath.SkipDir from the visitor prunes that directory
+func (b *BlockFS) WalkDir(path string, visitorFunction WalkDirFunction) (err error) {
+	defer b.options.observe("WalkDir", 0)(&err)
+	walkPath, err := b.fsPath(path)
+	if err != nil {
+		return err
+	}
+	return b.walk(walkPath,
+		func(path string, fileinfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return visitorFunction(b.storePath(path), fileinfo, fileinfo.IsDir())
+		})
+}
+
+// walk walks the tree at root like filepath.Walk, following symlinked directories when the store is configured to.
+// Gzip marker files aren't visited
+func (b *BlockFS) walk(root string, walkFn filepath.WalkFunc) error {
+	walkFn = skipGzipMarkers(walkFn)
+	if !b.follow {
+		return filepath.Walk(root, walkFn)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = walkFollow(root, info, nil, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// skipGzipMarkers wraps the walk function so it isn't called for gzip marker files
+func skipGzipMarkers(walkFn filepath.WalkFunc) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isGzipMarker(info.Name()) {
+			return nil
+		}
+		return walkFn(path, info, err)
+	}
+}
+
+// walkFollow is the recursion of filepath.Walk with entries resolved through symlinks. The ancestors are the directories
+// above path, and a directory that is the same as one of them is a link loop that is visited without descending into it
+func walkFollow(path string, info os.FileInfo, ancestors []os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			return walkFn(path, info, nil)
+		}
+	}
+	entries, err := ioutil.ReadDir(path)
+	err1 := walkFn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	ancestors = append(ancestors, info)
+	for _, entry := range entries {
+		filename := filepath.Join(path, entry.Name())
+		fileInfo := entry
+		if entry.Mode()&os.ModeSymlink != 0 {
+			//a broken link is visited as the link itself
+			if target, err := os.Stat(filename); err == nil {
+				fileInfo = target
+			}
+		}
+		err = walkFollow(filename, fileInfo, ancestors, walkFn)
+		if err != nil {
+			if !fileInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Glob returns the files and directories matching the pattern, using the syntax of filepath.Match
+func (b *BlockFS) Glob(pattern string) (_ []FileStoreResultObject, err error) {
+	defer b.options.observe("Glob", 0)(&err)
+	globPath, err := b.fsPath(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(globPath)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]FileStoreResultObject, 0, len(matches))
+	for _, match := range matches {
+		if isGzipMarker(match) {
+			continue
+		}
+		fi, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, fileResult(len(objects), filepath.ToSlash(b.storePath(match)), fi))
+	}
+	sortResults(objects)
+	return objects, nil
+}
+
+// Ping checks that the root directory exists and is writable by creating and removing a temp file in it
+func (b *BlockFS) Ping() (err error) {
+	defer b.options.observe("Ping", 0)(&err)
+	dir := b.rootDir
+	if dir == "" {
+		dir = "."
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("root directory %s is not reachable: %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("root directory %s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".ping-*")
+	if err != nil {
+		return fmt.Errorf("root directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// GetObjectIfModifiedSince opens the file when its modified time is after since. Otherwise the reader is nil with modified false.
+// The caller must close the reader when it is returned
+func (b *BlockFS) GetObjectIfModifiedSince(path string, since time.Time) (reader io.ReadCloser, _ bool, err error) {
+	defer b.options.observeRead("GetObjectIfModifiedSince")(&reader, &err)
+	filePath, err := b.fsPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, false, fsError(path, err)
+	}
+	if !fi.ModTime().After(since) {
+		return nil, false, nil
+	}
+	reader, err = b.getObject(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return reader, true, nil
+}
+
+// PrefixExists reports whether the directory exists
+func (b *BlockFS) PrefixExists(path string) (_ bool, err error) {
+	defer b.options.observe("PrefixExists", 0)(&err)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(dirPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+// PrefixEmpty reports whether the directory has no entries. A directory that doesn't exist is empty, matching S3FS
+func (b *BlockFS) PrefixEmpty(path string) (_ bool, err error) {
+	defer b.options.observe("PrefixEmpty", 0)(&err)
+	dirPath, err := b.fsPath(path)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(dirPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// GetObjectVersion is not supported by the file system, which keeps a single version of each file
+func (b *BlockFS) GetObjectVersion(path string, versionID string) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// ListObjectVersions is not supported by the file system, which keeps a single version of each file
+func (b *BlockFS) ListObjectVersions(path string) ([]ObjectVersion, error) {
+	return nil, ErrNotSupported
+}
+
+// WalkVersions is not supported by the file system, which keeps a single version of each file
+func (b *BlockFS) WalkVersions(path string, visitorFunction VersionVisitFunction) error {
+	return ErrNotSupported
+}
+
+// DeleteObjectVersion is not supported by the file system, which keeps a single version of each file
+func (b *BlockFS) DeleteObjectVersion(path string, versionID string) error {
+	return ErrNotSupported
+}
+
+// MergeObjects concatenates the parts in order into dest. The merged file is staged like PutObject and renamed over dest,
+// so dest is only replaced once every part has been copied
+func (b *BlockFS) MergeObjects(parts []string, dest string) (err error) {
+	defer b.options.observe("MergeObjects", 0)(&err)
+	destPath, err := b.fsPath(dest)
+	if err != nil {
+		return err
+	}
+	if err := b.mkdirAll(filepath.Dir(destPath)); err != nil {
+		return err
+	}
+	err = b.stageFile(destPath, func(f *os.File) error {
+		if err := f.Chmod(b.fileMode); err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err := b.appendPart(f, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.markCompressed(destPath, false)
+}
+
+func (b *BlockFS) appendPart(f *os.File, part string) error {
+	reader, err := b.getObject(part)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(f, reader)
+	return err
+}
+
+// PutObjectRetention is not supported by the file system, which has no write once protection
+func (b *BlockFS) PutObjectRetention(path string, mode string, until time.Time) error {
+	return ErrNotSupported
+}
+
+// PutObjectLegalHold is not supported by the file system, which has no write once protection
+func (b *BlockFS) PutObjectLegalHold(path string, on bool) error {
+	return ErrNotSupported
+}
+
+// Empty removes everything in the root directory, leaving the directory itself. To guard against wiping the wrong
+// directory by accident, rootDir must repeat the RootDir of the config, and a store without a RootDir can't be emptied
+func (b *BlockFS) Empty(rootDir string) (err error) {
+	defer b.options.observe("Empty", 0)(&err)
+	if b.rootDir == "" {
+		return fmt.Errorf("%w: emptying a store without a RootDir", ErrUnsupportedConfig)
+	}
+	if rootDir != b.rootDir {
+		return fmt.Errorf("emptying %s: confirmation %q doesn't match the root directory", b.rootDir, rootDir)
+	}
+	contents, err := ioutil.ReadDir(b.rootDir)
+	if err != nil {
+		return fsError("/", err)
+	}
+	var errs MultiError
+	for _, f := range contents {
+		if err := os.RemoveAll(filepath.Join(b.rootDir, f.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Close is a no-op, the file system holds no resources between calls
+func (b *BlockFS) Close() error {
+	return nil
+}
+
+// fsError translates os errors into the package errors so callers get the same errors from every backend
+func fsError(path string, err error) error {
+	if os.IsNotExist(err) {
+		return &NotFoundError{Path: path, Err: err}
+	}
+	if os.IsPermission(err) {
+		return &AccessDeniedError{Path: path, Err: err}
+	}
 	return err
 }
@@ -0,0 +1,308 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockFSUpload(t *testing.T) {
+	fs := newTestBlockFS(t)
+	output, err := fs.Upload(strings.NewReader("from a reader"), "/nested/dir/reader.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Size != int64(len("from a reader")) {
+		t.Errorf("expected the size of the content, got %d", output.Size)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(fs.rootDir, "nested", "dir", "reader.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "from a reader" {
+		t.Errorf("expected the reader content at the key, got %q", content)
+	}
+}
+
+func TestBlockFSUploadFile(t *testing.T) {
+	fs := newTestBlockFS(t)
+	source := filepath.Join(t.TempDir(), "source.txt")
+	if err := ioutil.WriteFile(source, []byte("from a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.UploadFile(source, "/uploaded/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectString(fs, "/uploaded/file.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "from a file" {
+		t.Errorf("expected the file content at the key, got %q", content)
+	}
+}
+
+func TestBlockFSPutObjectCreatesParentDirs(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/tmp/newdir/sub/file.txt", []byte("data")); err != nil {
+		t.Fatalf("expected the parent directories to be created, got %v", err)
+	}
+	content, err := GetObjectString(fs, "/tmp/newdir/sub/file.txt", 0)
+	if err != nil || content != "data" {
+		t.Errorf("expected data, got %q %v", content, err)
+	}
+}
+
+func TestBlockFSConfiguredModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows doesn't have unix permissions")
+	}
+	root := t.TempDir()
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: root, FileMode: 0600, DirMode: 0700})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/put/file.txt", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Upload(strings.NewReader("data"), "/upload/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked/file.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked/file.txt", UploadId: result.ID, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"put", "upload", "chunked"} {
+		expectMode(t, filepath.Join(root, dir), 0700)
+		expectMode(t, filepath.Join(root, dir, "file.txt"), 0600)
+	}
+}
+
+func expectMode(t *testing.T, filePath string, mode os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("expected %s to have mode %o, got %o", filePath, mode, info.Mode().Perm())
+	}
+}
+
+func TestBlockFSPutObjectFailedWriteLeavesTarget(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.txt", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	//staging in a missing temp dir fails the write before the rename
+	fs.tempDir = filepath.Join(t.TempDir(), "missing")
+	if _, err := fs.PutObject("/data.txt", []byte("replacement")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	content, err := GetObjectString(fs, "/data.txt", 0)
+	if err != nil || content != "original" {
+		t.Errorf("expected the original content, got %q %v", content, err)
+	}
+	entries, err := ioutil.ReadDir(fs.rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no staged files left behind, got %d entries", len(entries))
+	}
+}
+
+func TestBlockFSStagedWritesUseTempDir(t *testing.T) {
+	fs := newTestBlockFS(t)
+	source := filepath.Join(t.TempDir(), "source.txt")
+	if err := ioutil.WriteFile(source, []byte("replacement"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, fs, "/upload.txt", "/uploadfile.txt", "/src/copy.txt", "/dest/copy.txt", "/part.txt")
+	//staging in a missing temp dir fails each write before the rename, so the targets keep their content
+	fs.tempDir = filepath.Join(t.TempDir(), "missing")
+	writes := map[string]func() error{
+		"/upload.txt": func() error {
+			_, err := fs.Upload(strings.NewReader("replacement"), "/upload.txt")
+			return err
+		},
+		"/uploadfile.txt": func() error {
+			_, err := fs.UploadFile(source, "/uploadfile.txt")
+			return err
+		},
+		"/dest/copy.txt": func() error {
+			return fs.CopyPrefix("/src", "/dest", nil)
+		},
+		"/part.txt": func() error {
+			return fs.MergeObjects([]string{"/src/copy.txt"}, "/part.txt")
+		},
+	}
+	for key, write := range writes {
+		if err := write(); err == nil {
+			t.Errorf("%s: expected the write to be staged in the missing temp dir and fail", key)
+		}
+		if content, err := GetObjectString(fs, key, 0); err != nil || content != key {
+			t.Errorf("%s: expected the original content, got %q %v", key, content, err)
+		}
+	}
+}
+
+func TestBlockFSPutObjectOverwritesLongerFile(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.bin", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/data.bin", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(fs.rootDir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 10 {
+		t.Errorf("expected the file to be 10 bytes, got %d", info.Size())
+	}
+}
+
+func TestBlockFSDurableWrites(t *testing.T) {
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/put.txt", []byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Upload(strings.NewReader("upload"), "/upload.txt"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/chunked.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteChunk(UploadConfig{ObjectPath: "/chunked.txt", UploadId: result.ID, Data: []byte("chunk")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: result.ID, ObjectPath: "/chunked.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"/put.txt": "put", "/upload.txt": "upload", "/chunked.txt": "chunk"} {
+		if content, err := GetObjectString(fs, key, 0); err != nil || content != expected {
+			t.Errorf("expected %q at %s, got %q %v", expected, key, content, err)
+		}
+	}
+}
+
+func TestBlockFSCreateDirAndEmptyObject(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if err := fs.CreateDir("/made/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateEmptyObject("/made/empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.PutObject("/made/nil.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		isDir bool
+	}{
+		{"dir", true},
+		{"empty.txt", false},
+		{"nil.txt", false},
+	}
+	for _, test := range tests {
+		info, err := os.Stat(filepath.Join(fs.rootDir, "made", test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() != test.isDir || (!test.isDir && info.Size() != 0) {
+			t.Errorf("expected %s to be a directory %v and empty, got %v with %d bytes", test.name, test.isDir, info.IsDir(), info.Size())
+		}
+	}
+}
+
+func TestBlockFSTouch(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/marker", []byte("alive")); err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(fs.rootDir, "marker")
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filePath, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Touch("/marker"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(past.Add(time.Minute)) {
+		t.Errorf("expected the modtime to advance from %s, got %s", past, info.ModTime())
+	}
+	if content, err := GetObjectString(fs, "/marker", 0); err != nil || content != "alive" {
+		t.Errorf("expected the content to be kept, got %q %v", content, err)
+	}
+	if err := fs.Touch("/new-marker"); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := fs.Size("/new-marker"); err != nil || size != 0 {
+		t.Errorf("expected touching a missing file to create it empty, got %d %v", size, err)
+	}
+}
+
+func TestBlockFSTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), TempDir: tempDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(fs.rootDir, "data", "put.txt")
+	f, err := fs.createTemp(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if filepath.Dir(f.Name()) != tempDir {
+		t.Errorf("expected the staged file in %s, got %s", tempDir, f.Name())
+	}
+	if _, err := fs.PutObject("/data/put.txt", []byte("staged")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := GetObjectString(fs, "/data/put.txt", 0); err != nil || content != "staged" {
+		t.Errorf("expected the staged content, got %q %v", content, err)
+	}
+	for _, dir := range []string{tempDir, filepath.Dir(target)} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), ".tmp") {
+				t.Errorf("expected no staged files left in %s, got %s", dir, entry.Name())
+			}
+		}
+	}
+
+	//without a TempDir the file is staged next to its target
+	local := newTestBlockFS(t)
+	f, err = local.createTemp(filepath.Join(local.rootDir, "put.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if filepath.Dir(f.Name()) != local.rootDir {
+		t.Errorf("expected the staged file in %s, got %s", local.rootDir, f.Name())
+	}
+}
@@ -5,4 +5,6 @@ go 1.15
 require (
 	github.com/aws/aws-sdk-go v1.31.0
 	github.com/google/uuid v1.1.1
+	github.com/pkg/sftp v1.13.5
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
 )
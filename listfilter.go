@@ -0,0 +1,64 @@
+package filestore
+
+import (
+	"strings"
+	"time"
+)
+
+// ListFilter narrows a directory listing. Zero values don't filter, so an empty ListFilter matches every file
+type ListFilter struct {
+	// Extensions keeps files with one of the extensions, such as ".csv". The comparison ignores case
+	Extensions []string
+	// MinSize and MaxSize keep files within the size range in bytes. A MaxSize of zero has no upper bound
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter keeps files modified after the time
+	ModifiedAfter time.Time
+	// IncludeDirs keeps directories in the listing. The other criteria only apply to files
+	IncludeDirs bool
+}
+
+func (f ListFilter) match(object FileStoreResultObject) bool {
+	if object.IsDir {
+		return f.IncludeDirs
+	}
+	if len(f.Extensions) > 0 {
+		found := false
+		for _, ext := range f.Extensions {
+			if strings.EqualFold(ext, object.Type) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if object.SizeBytes < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && object.SizeBytes > f.MaxSize {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && !object.Modified.After(f.ModifiedAfter) {
+		return false
+	}
+	return true
+}
+
+// GetDirFiltered lists the directory like GetDir and keeps the entries matching the filter. None of the backends can filter
+// on these criteria while listing, so the whole directory is still listed, but callers only receive the entries they asked for
+func GetDirFiltered(fs FileStore, dirPath string, recursive bool, filter ListFilter) (*[]FileStoreResultObject, error) {
+	objects, err := fs.GetDir(dirPath, recursive)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]FileStoreResultObject, 0, len(*objects))
+	for _, object := range *objects {
+		if filter.match(object) {
+			object.ID = len(filtered)
+			filtered = append(filtered, object)
+		}
+	}
+	return &filtered, nil
+}
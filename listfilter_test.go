@@ -0,0 +1,79 @@
+package filestore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListFilterMatch(t *testing.T) {
+	now := time.Now()
+	file := FileStoreResultObject{Name: "data.CSV", Type: ".CSV", SizeBytes: 100, Modified: now}
+	dir := FileStoreResultObject{Name: "dir", IsDir: true, Modified: now.Add(-time.Hour)}
+	tests := []struct {
+		name   string
+		filter ListFilter
+		object FileStoreResultObject
+		match  bool
+	}{
+		{"empty filter", ListFilter{}, file, true},
+		{"extension ignores case", ListFilter{Extensions: []string{".txt", ".csv"}}, file, true},
+		{"other extension", ListFilter{Extensions: []string{".txt"}}, file, false},
+		{"at min size", ListFilter{MinSize: 100}, file, true},
+		{"under min size", ListFilter{MinSize: 101}, file, false},
+		{"at max size", ListFilter{MaxSize: 100}, file, true},
+		{"over max size", ListFilter{MaxSize: 99}, file, false},
+		{"modified after", ListFilter{ModifiedAfter: now.Add(-time.Minute)}, file, true},
+		{"modified at", ListFilter{ModifiedAfter: now}, file, false},
+		{"dirs excluded by default", ListFilter{}, dir, false},
+		{"dirs ignore the file criteria", ListFilter{IncludeDirs: true, Extensions: []string{".csv"}, MinSize: 1, ModifiedAfter: now}, dir, true},
+	}
+	for _, test := range tests {
+		if match := test.filter.match(test.object); match != test.match {
+			t.Errorf("%s: expected %v, got %v", test.name, test.match, match)
+		}
+	}
+}
+
+func TestGetDirFiltered(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		files := map[string]string{
+			"/data/a.csv":     "1,2,3",
+			"/data/b.txt":     "text",
+			"/data/c.CSV":     "1,2,3,4,5,6",
+			"/data/sub/d.csv": "1",
+		}
+		for p, content := range files {
+			if _, err := fs.PutObject(p, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		objects, err := GetDirFiltered(fs, "/data", false, ListFilter{Extensions: []string{".csv"}, MinSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for i, o := range *objects {
+			if o.ID != i {
+				t.Errorf("%s: expected the ids to be renumbered, got %d at %d", name, o.ID, i)
+			}
+			names = append(names, o.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"a.csv", "c.CSV"}) {
+			t.Errorf("%s: expected [a.csv c.CSV], got %v", name, names)
+		}
+
+		objects, err = GetDirFiltered(fs, "/data", true, ListFilter{Extensions: []string{".csv"}, MaxSize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = nil
+		for _, o := range *objects {
+			names = append(names, o.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"a.csv", "d.csv"}) {
+			t.Errorf("%s: expected the recursive listing to keep [a.csv d.csv], got %v", name, names)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package filestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive flock on the directory, so writers in other processes that lock it wait for the unlock.
+// The lock is released when the returned function is called, or by the kernel if the process dies holding it
+func lockDir(dir string) (func(), error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
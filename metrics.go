@@ -0,0 +1,94 @@
+package filestore
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics records the operations of a store created WithMetrics. ObserveOp is called once per operation with the name
+// of the method, the bytes it transferred, how long it took and the error it returned. It is called from the goroutine
+// of the operation, so it must be safe for concurrent use
+type Metrics interface {
+	ObserveOp(op string, bytes int64, dur time.Duration, err error)
+}
+
+// outputSize is the bytes written by an operation that returned output
+func outputSize(output *FileOperationOutput) int64 {
+	if output == nil {
+		return 0
+	}
+	return output.Size
+}
+
+// observedReader counts the bytes read from an object and reports the read when it is first closed
+type observedReader struct {
+	reader  io.ReadCloser
+	metrics Metrics
+	op      string
+	start   time.Time
+	bytes   int64
+	err     error
+	closed  bool
+}
+
+func (o *observedReader) Read(p []byte) (int, error) {
+	n, err := o.reader.Read(p)
+	o.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		o.err = err
+	}
+	return n, err
+}
+
+func (o *observedReader) Close() error {
+	err := o.reader.Close()
+	if o.closed {
+		return err
+	}
+	o.closed = true
+	if o.err == nil {
+		o.err = err
+	}
+	o.metrics.ObserveOp(o.op, o.bytes, time.Since(o.start), o.err)
+	return err
+}
+
+// observe starts timing an operation of the store and returns the function that reports it, to be deferred with the
+// address of the named error result. bytes is the size of the data the operation writes
+func (o storeOptions) observe(op string, bytes int64) func(*error) {
+	if o.metrics == nil {
+		return func(*error) {}
+	}
+	start := time.Now()
+	return func(err *error) {
+		o.metrics.ObserveOp(op, bytes, time.Since(start), *err)
+	}
+}
+
+// observeUpload is observe for an upload, whose size is only known from its output
+func (o storeOptions) observeUpload(op string) func(**FileOperationOutput, *error) {
+	if o.metrics == nil {
+		return func(**FileOperationOutput, *error) {}
+	}
+	start := time.Now()
+	return func(output **FileOperationOutput, err *error) {
+		o.metrics.ObserveOp(op, outputSize(*output), time.Since(start), *err)
+	}
+}
+
+// observeRead is observe for an operation that returns a reader. A failed operation is reported at once, otherwise the
+// reader is wrapped to report the bytes read when it is closed. An operation that returns no reader and no error, like a
+// GetObjectIfModifiedSince of an unmodified object, is reported at once
+func (o storeOptions) observeRead(op string) func(*io.ReadCloser, *error) {
+	if o.metrics == nil {
+		return func(*io.ReadCloser, *error) {}
+	}
+	start := time.Now()
+	return func(reader *io.ReadCloser, err *error) {
+		if *err != nil || *reader == nil {
+			o.metrics.ObserveOp(op, 0, time.Since(start), *err)
+			return
+		}
+		*reader = &observedReader{reader: *reader, metrics: o.metrics, op: op, start: start}
+	}
+}
@@ -0,0 +1,170 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type observedOp struct {
+	op    string
+	bytes int64
+	err   error
+}
+
+// recordingMetrics keeps the operations it observes
+type recordingMetrics struct {
+	mu  sync.Mutex
+	ops []observedOp
+}
+
+func (r *recordingMetrics) ObserveOp(op string, bytes int64, dur time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, observedOp{op: op, bytes: bytes, err: err})
+}
+
+// named returns the operations observed with the name
+func (r *recordingMetrics) named(op string) []observedOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ops []observedOp
+	for _, o := range r.ops {
+		if o.op == op {
+			ops = append(ops, o)
+		}
+	}
+	return ops
+}
+
+func TestWithMetricsPutObject(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs := newTestBlockFS(t, WithMetrics(metrics))
+	if _, err := fs.PutObject("/data.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ops := metrics.named("PutObject")
+	if len(ops) != 1 {
+		t.Fatalf("expected one PutObject, got %v", metrics.ops)
+	}
+	if ops[0].bytes != 5 || ops[0].err != nil {
+		t.Errorf("expected 5 bytes and no error, got %+v", ops[0])
+	}
+}
+
+func TestWithMetricsReportsErrors(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs := newTestBlockFS(t, WithMetrics(metrics))
+	_, err := fs.GetObject("/missing")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+	ops := metrics.named("GetObject")
+	if len(ops) != 1 || !errors.Is(ops[0].err, ErrObjectNotFound) {
+		t.Errorf("expected the failed GetObject to be reported, got %v", metrics.ops)
+	}
+}
+
+func TestWithMetricsGetObjectReportedOnClose(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs := newTestBlockFS(t, WithMetrics(metrics))
+	if _, err := fs.PutObject("/data.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fs.GetObject("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if ops := metrics.named("GetObject"); len(ops) != 0 {
+		t.Fatalf("expected GetObject to be reported on close, got %v", ops)
+	}
+	reader.Close()
+	reader.Close()
+	ops := metrics.named("GetObject")
+	if len(ops) != 1 {
+		t.Fatalf("expected a single GetObject for two closes, got %v", ops)
+	}
+	if ops[0].bytes != 5 {
+		t.Errorf("expected 5 bytes read, got %d", ops[0].bytes)
+	}
+}
+
+func TestWithMetricsS3Operations(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs, mock := newTestS3FS(t, WithMetrics(metrics))
+	mock.put("a", []byte("a"))
+	mock.put("b", []byte("b"))
+	if err := fs.CopyObject("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append("/c", []byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Empty(testBucket); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"CopyObject", "Append", "Empty"} {
+		if ops := metrics.named(op); len(ops) != 1 || ops[0].err != nil {
+			t.Errorf("expected one successful %s, got %v", op, ops)
+		}
+	}
+	if ops := metrics.named("Append"); len(ops) == 1 && ops[0].bytes != 4 {
+		t.Errorf("expected the Append of 4 bytes, got %d", ops[0].bytes)
+	}
+}
+
+func TestWithMetricsWalkReportedOnce(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs := newTestBlockFS(t, WithMetrics(metrics))
+	if _, err := fs.PutObject("/dir/file", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Walk("/dir", func(string, os.FileInfo) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ops := metrics.named("WalkContext"); len(ops) != 1 {
+		t.Errorf("expected Walk to be reported once as WalkContext, got %v", metrics.ops)
+	}
+	if ops := metrics.named("Walk"); len(ops) != 0 {
+		t.Errorf("expected no Walk, got %v", ops)
+	}
+}
+
+func TestWithMetricsGetObjectClosedTwice(t *testing.T) {
+	metrics := &recordingMetrics{}
+	fs := newTestBlockFS(t, WithMetrics(metrics))
+	if _, err := fs.PutObject("/data.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fs.GetObject("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(reader)
+	reader.Close()
+	reader.Close()
+	if ops := metrics.named("GetObject"); len(ops) != 1 {
+		t.Errorf("expected a single GetObject for two closes, got %v", ops)
+	}
+}
+
+func TestWithoutMetrics(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/data.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fs.GetObject("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, ok := reader.(*observedReader); ok {
+		t.Error("expected the reader to be unwrapped without metrics")
+	}
+}
@@ -0,0 +1,940 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const testBucket = "test-bucket"
+
+// mockS3 is an in memory bucket behind the s3 client interface. Calls the tests don't use fall through to the embedded
+// nil interface and panic
+type mockS3 struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects map[string]*mockObject
+	uploads map[string]*mockUpload
+	//versions are the versions and delete markers of the objects written with putVersion, oldest first
+	versions []*mockVersion
+	//versionPageSize is the number of entries in each page of ListObjectVersionsPages, 1000 when zero
+	versionPageSize int
+	calls           map[string]int
+	//errs fails the named call with the error instead of running it
+	errs map[string]error
+	//failNext fails the next calls of the name with the queued errors, one call each, before errs is checked
+	failNext map[string][]error
+	//lose runs the next call of the name and then fails it with the error, as if its response was lost
+	lose map[string]error
+	//headers are the request headers set by the request options of each PutObjectWithContext
+	headers []http.Header
+	//region is the region of the requests that are presigned, an empty region fails the presign
+	region string
+	//signedHeaders are added to presigned requests, as the sdk does for headers that must be sent with the url
+	signedHeaders http.Header
+	nextID        int
+	//copies keeps the input of each copy
+	copies []*s3.CopyObjectInput
+	//presigned keeps the method of each request built for presigning
+	presigned []string
+	//ranges keeps the range of each ranged get
+	ranges []string
+	//copyRanges keeps the source range of each part copy
+	copyRanges []string
+}
+
+type mockObject struct {
+	data               []byte
+	etag               string
+	modified           time.Time
+	contentType        string
+	contentEncoding    string
+	cacheControl       string
+	contentDisposition string
+	contentLanguage    string
+	sse                string
+	kmsKeyID           string
+	storageClass       string
+	acl                string
+	metadata           map[string]*string
+	tags               []*s3.Tag
+	expires            time.Time
+	lockMode           string
+	lockUntil          time.Time
+	legalHold          string
+	//size is reported instead of the length of the data when set, for objects too large to hold
+	size int64
+	//contentMD5 is the Content-MD5 the object was put with
+	contentMD5 string
+	//restore is the Restore header of an archived object, set by RestoreObject
+	restore string
+}
+
+type mockVersion struct {
+	key             string
+	id              string
+	data            []byte
+	contentEncoding string
+	modified        time.Time
+	deleteMarker    bool
+}
+
+type mockUpload struct {
+	key   string
+	input *s3.CreateMultipartUploadInput
+	parts map[int64][]byte
+}
+
+func newMockS3() *mockS3 {
+	return &mockS3{
+		objects:  make(map[string]*mockObject),
+		uploads:  make(map[string]*mockUpload),
+		calls:    make(map[string]int),
+		errs:     make(map[string]error),
+		failNext: make(map[string][]error),
+		lose:     make(map[string]error),
+		region:   "us-east-1",
+	}
+}
+
+// newTestS3FS returns a store backed by a new mock bucket
+func newTestS3FS(t *testing.T, opts ...Option) (*S3FS, *mockS3) {
+	t.Helper()
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, S3Region: "us-east-1"}, mock, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, mock
+}
+
+// newTestBlockFS returns a store rooted at a new temp directory
+func newTestBlockFS(t *testing.T, opts ...Option) *BlockFS {
+	t.Helper()
+	fs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir()}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// call counts the call and returns the error it was set up to fail with
+func (m *mockS3) call(name string) error {
+	m.calls[name]++
+	if queued := m.failNext[name]; len(queued) > 0 {
+		m.failNext[name] = queued[1:]
+		return queued[0]
+	}
+	return m.errs[name]
+}
+
+func (m *mockS3) count(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[name]
+}
+
+// put stores an object directly, for the tests to set up the bucket
+func (m *mockS3) put(key string, data []byte) *mockObject {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj := &mockObject{data: data, etag: md5ETag(data), modified: time.Now()}
+	m.objects[key] = obj
+	return obj
+}
+
+// putVersion writes a new current version of the object and returns its version id
+func (m *mockS3) putVersion(key string, data []byte) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	version := &mockVersion{key: key, id: fmt.Sprintf("v%d", m.nextID), data: data, modified: time.Now()}
+	m.versions = append(m.versions, version)
+	m.objects[key] = &mockObject{data: data, etag: md5ETag(data), modified: version.modified}
+	return version.id
+}
+
+func (m *mockS3) object(key string) *mockObject {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.objects[key]
+}
+
+// mockOwner is the display name of the owner of the objects in the mock
+const mockOwner = "mock-owner"
+
+func md5ETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+func noSuchKey(key string) error {
+	return awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist. "+key, nil), http.StatusNotFound, "")
+}
+
+func decodeTagSet(tagging *string) []*s3.Tag {
+	values, _ := url.ParseQuery(aws.StringValue(tagging))
+	var tags []*s3.Tag
+	for k := range values {
+		tags = append(tags, &s3.Tag{Key: aws.String(k), Value: aws.String(values.Get(k))})
+	}
+	return tags
+}
+
+// parseByteRange parses bytes=first-last for an object of size bytes
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	var first, last int64
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &first, &last); err != nil {
+		return 0, 0, err
+	}
+	if first >= size {
+		return 0, 0, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+	}
+	if last >= size {
+		last = size - 1
+	}
+	return first, last, nil
+}
+
+// sourceKey strips the bucket from an escaped CopySource
+func sourceKey(copySource *string) string {
+	source, _ := url.PathUnescape(aws.StringValue(copySource))
+	return strings.TrimPrefix(source, testBucket+"/")
+}
+
+func (m *mockS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("HeadBucket"); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *mockS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("HeadObject"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	size := int64(len(obj.data))
+	if obj.size > 0 {
+		size = obj.size
+	}
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(size),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+		Metadata:      obj.metadata,
+	}
+	for field, value := range map[**string]string{
+		&output.ContentType:          obj.contentType,
+		&output.ContentEncoding:      obj.contentEncoding,
+		&output.CacheControl:         obj.cacheControl,
+		&output.ContentDisposition:   obj.contentDisposition,
+		&output.ContentLanguage:      obj.contentLanguage,
+		&output.ServerSideEncryption: obj.sse,
+		&output.SSEKMSKeyId:          obj.kmsKeyID,
+		&output.StorageClass:         obj.storageClass,
+		&output.Restore:              obj.restore,
+	} {
+		if value != "" {
+			*field = aws.String(value)
+		}
+	}
+	if !obj.expires.IsZero() {
+		output.Expires = aws.String(obj.expires.UTC().Format(http.TimeFormat))
+	}
+	return output, nil
+}
+
+func (m *mockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetObject"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if input.VersionId != nil {
+		obj, ok = m.version(aws.StringValue(input.Key), aws.StringValue(input.VersionId))
+	}
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	if input.IfMatch != nil && aws.StringValue(input.IfMatch) != obj.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "")
+	}
+	if input.IfModifiedSince != nil && !obj.modified.After(*input.IfModifiedSince) {
+		return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), http.StatusNotModified, "")
+	}
+	data := obj.data
+	var contentRange string
+	if input.Range != nil {
+		m.ranges = append(m.ranges, aws.StringValue(input.Range))
+		first, last, err := parseByteRange(aws.StringValue(input.Range), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", first, last, len(data))
+		data = data[first : last+1]
+	}
+	output := &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+		Metadata:      obj.metadata,
+	}
+	if contentRange != "" {
+		output.ContentRange = aws.String(contentRange)
+	}
+	if obj.contentType != "" {
+		output.ContentType = aws.String(obj.contentType)
+	}
+	if obj.contentEncoding != "" {
+		output.ContentEncoding = aws.String(obj.contentEncoding)
+	}
+	return output, nil
+}
+
+// objectURL is the virtual hosted url of the object
+func objectURL(bucket *string, key *string, query url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   "https",
+		Host:     aws.StringValue(bucket) + ".s3.amazonaws.com",
+		Path:     "/" + aws.StringValue(key),
+		RawQuery: query.Encode(),
+	}
+}
+
+// presignRequest builds a request for the object url. Its signer stands in for sigv4, adding the expiry of the presign to
+// the query and returning signedHeaders as the headers that were signed with it
+func (m *mockS3) presignRequest(method string, bucket *string, key *string, query url.Values) *request.Request {
+	m.presigned = append(m.presigned, method)
+	req := &request.Request{
+		Config:      aws.Config{Region: aws.String(m.region)},
+		Operation:   &request.Operation{Name: method + "Object", HTTPMethod: method},
+		HTTPRequest: &http.Request{Method: method, URL: objectURL(bucket, key, query), Header: http.Header{}},
+	}
+	signedHeaders := m.signedHeaders.Clone()
+	req.Handlers.Sign.PushBack(func(r *request.Request) {
+		q := r.HTTPRequest.URL.Query()
+		q.Set("X-Amz-Expires", strconv.FormatInt(int64(r.ExpireTime/time.Second), 10))
+		r.HTTPRequest.URL.RawQuery = q.Encode()
+		r.SignedHeaderVals = signedHeaders
+	})
+	return req
+}
+
+func (m *mockS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.call("GetObjectRequest")
+	query := url.Values{}
+	if input.ResponseContentDisposition != nil {
+		query.Set("response-content-disposition", aws.StringValue(input.ResponseContentDisposition))
+	}
+	if input.ResponseContentType != nil {
+		query.Set("response-content-type", aws.StringValue(input.ResponseContentType))
+	}
+	req := m.presignRequest(http.MethodGet, input.Bucket, input.Key, query)
+	req.Error = err
+	return req, &s3.GetObjectOutput{}
+}
+
+func (m *mockS3) HeadObjectRequest(input *s3.HeadObjectInput) (*request.Request, *s3.HeadObjectOutput) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req := m.presignRequest(http.MethodHead, input.Bucket, input.Key, url.Values{})
+	req.Error = m.call("HeadObjectRequest")
+	return req, &s3.HeadObjectOutput{}
+}
+
+func (m *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return m.PutObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *mockS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	req, output := m.PutObjectRequest(input)
+	req.SetContext(ctx)
+	req.ApplyOptions(opts...)
+	return output, req.Send()
+}
+
+// PutObjectRequest builds the request that the s3manager uploader sends for a single part upload. Sending it runs the put
+// with the headers set by the request options
+func (m *mockS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	//the request needs a retryer for Send to report an error, the mock fails the put once rather than retrying it
+	operation := &request.Operation{Name: "PutObject", HTTPMethod: http.MethodPut}
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, client.DefaultRetryer{NumMaxRetries: 0}, operation, input, output)
+	req.HTTPRequest.URL = objectURL(input.Bucket, input.Key, url.Values{})
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		put, err := m.putObject(input, r.HTTPRequest.Header)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		*output = *put
+	})
+	return req, output
+}
+
+func (m *mockS3) putObject(input *s3.PutObjectInput, header http.Header) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("PutObject"); err != nil {
+		return nil, err
+	}
+	m.headers = append(m.headers, header)
+	var data []byte
+	if input.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	//s3 rejects a body that doesn't match the Content-MD5 sent with it
+	sum := md5.Sum(data)
+	if input.ContentMD5 != nil && aws.StringValue(input.ContentMD5) != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, awserr.NewRequestFailure(awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received", nil), http.StatusBadRequest, "")
+	}
+	etag := md5ETag(data)
+	if aws.StringValue(input.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		//the etag of an SSE-KMS object isn't the md5 of its content
+		etag = md5ETag(append([]byte(aws.StringValue(input.SSEKMSKeyId)), data...))
+	}
+	obj := &mockObject{
+		data:               data,
+		etag:               etag,
+		modified:           time.Now(),
+		contentType:        aws.StringValue(input.ContentType),
+		contentEncoding:    aws.StringValue(input.ContentEncoding),
+		cacheControl:       aws.StringValue(input.CacheControl),
+		contentDisposition: aws.StringValue(input.ContentDisposition),
+		contentLanguage:    aws.StringValue(input.ContentLanguage),
+		sse:                aws.StringValue(input.ServerSideEncryption),
+		kmsKeyID:           aws.StringValue(input.SSEKMSKeyId),
+		storageClass:       aws.StringValue(input.StorageClass),
+		acl:                aws.StringValue(input.ACL),
+		metadata:           input.Metadata,
+		tags:               decodeTagSet(input.Tagging),
+		expires:            aws.TimeValue(input.Expires),
+		lockMode:           aws.StringValue(input.ObjectLockMode),
+		lockUntil:          aws.TimeValue(input.ObjectLockRetainUntilDate),
+		legalHold:          aws.StringValue(input.ObjectLockLegalHoldStatus),
+		contentMD5:         aws.StringValue(input.ContentMD5),
+	}
+	m.objects[aws.StringValue(input.Key)] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (m *mockS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copies = append(m.copies, input)
+	if err := m.call("CopyObject"); err != nil {
+		return nil, err
+	}
+	source, ok := m.objects[sourceKey(input.CopySource)]
+	if !ok {
+		return nil, noSuchKey(sourceKey(input.CopySource))
+	}
+	if input.CopySourceIfMatch != nil && aws.StringValue(input.CopySourceIfMatch) != source.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "")
+	}
+	obj := *source
+	obj.modified = time.Now()
+	obj.acl = aws.StringValue(input.ACL)
+	obj.sse = aws.StringValue(input.ServerSideEncryption)
+	obj.kmsKeyID = aws.StringValue(input.SSEKMSKeyId)
+	obj.storageClass = aws.StringValue(input.StorageClass)
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		obj.metadata = input.Metadata
+		obj.contentType = aws.StringValue(input.ContentType)
+		obj.contentEncoding = aws.StringValue(input.ContentEncoding)
+		obj.cacheControl = aws.StringValue(input.CacheControl)
+		obj.contentDisposition = aws.StringValue(input.ContentDisposition)
+		obj.contentLanguage = aws.StringValue(input.ContentLanguage)
+		obj.expires = aws.TimeValue(input.Expires)
+	}
+	if aws.StringValue(input.TaggingDirective) == "REPLACE" {
+		obj.tags = decodeTagSet(input.Tagging)
+	}
+	m.objects[aws.StringValue(input.Key)] = &obj
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{ETag: aws.String(obj.etag)}}, nil
+}
+
+func (m *mockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("DeleteObject"); err != nil {
+		return nil, err
+	}
+	key := aws.StringValue(input.Key)
+	if input.VersionId != nil {
+		//deleting a version removes it for good, leaving the current object to the tests
+		for i, v := range m.versions {
+			if v.key == key && v.id == aws.StringValue(input.VersionId) {
+				m.versions = append(m.versions[:i], m.versions[i+1:]...)
+				break
+			}
+		}
+		return &s3.DeleteObjectOutput{VersionId: input.VersionId}, nil
+	}
+	delete(m.objects, key)
+	for _, v := range m.versions {
+		if v.key == key {
+			//a versioned object gets a delete marker in place of its current version
+			m.nextID++
+			m.versions = append(m.versions, &mockVersion{key: key, id: fmt.Sprintf("v%d", m.nextID), modified: time.Now(), deleteMarker: true})
+			return &s3.DeleteObjectOutput{DeleteMarker: aws.Bool(true)}, nil
+		}
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("DeleteObjects"); err != nil {
+		return nil, err
+	}
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		delete(m.objects, aws.StringValue(object.Key))
+		output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: object.Key})
+	}
+	return output, nil
+}
+
+func (m *mockS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		after = aws.StringValue(input.ContinuationToken)
+	}
+	maxKeys := aws.Int64Value(input.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	seen := make(map[string]bool)
+	var count int64
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		entry, isPrefix := key, false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				//a key ending at the delimiter, like a directory marker, is rolled up into the prefix too
+				entry, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if isPrefix && seen[entry] {
+			continue
+		}
+		if count == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(after)
+			break
+		}
+		if isPrefix {
+			seen[entry] = true
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+			//the rest of the common prefix is skipped by continuing after its last possible key
+			after = entry + "\xff"
+		} else {
+			obj := m.objects[key]
+			object := &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.data))),
+				ETag:         aws.String(obj.etag),
+				LastModified: aws.Time(obj.modified),
+			}
+			//s3 only returns the owner of each object when asked to
+			if aws.BoolValue(input.FetchOwner) {
+				object.Owner = &s3.Owner{DisplayName: aws.String(mockOwner), ID: aws.String("0123")}
+			}
+			output.Contents = append(output.Contents, object)
+			after = key
+		}
+		count++
+	}
+	output.KeyCount = aws.Int64(count)
+	return output, nil
+}
+
+func (m *mockS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	return m.ListObjectsV2(input)
+}
+
+func (m *mockS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	page := *input
+	for {
+		output, err := m.ListObjectsV2(&page)
+		if err != nil {
+			return err
+		}
+		last := !aws.BoolValue(output.IsTruncated)
+		if !fn(output, last) || last {
+			return nil
+		}
+		page.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// version returns the content of a version of the object as an object
+func (m *mockS3) version(key string, id string) (*mockObject, bool) {
+	for _, v := range m.versions {
+		if v.key == key && v.id == id && !v.deleteMarker {
+			return &mockObject{data: v.data, etag: md5ETag(v.data), modified: v.modified, contentEncoding: v.contentEncoding}, true
+		}
+	}
+	return nil, false
+}
+
+func (m *mockS3) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	m.mu.Lock()
+	var entries []*mockVersion
+	for _, v := range m.versions {
+		if strings.HasPrefix(v.key, aws.StringValue(input.Prefix)) {
+			entries = append(entries, v)
+		}
+	}
+	m.mu.Unlock()
+	//s3 lists by key and then from the newest version to the oldest
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	pageSize := m.versionPageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	for start := 0; ; start += pageSize {
+		m.mu.Lock()
+		err := m.call("ListObjectVersions")
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		end := start + pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		page := &s3.ListObjectVersionsOutput{IsTruncated: aws.Bool(end < len(entries))}
+		for i := start; i < end; i++ {
+			v := entries[i]
+			latest := i == 0 || entries[i-1].key != v.key
+			if v.deleteMarker {
+				page.DeleteMarkers = append(page.DeleteMarkers, &s3.DeleteMarkerEntry{
+					Key: aws.String(v.key), VersionId: aws.String(v.id), IsLatest: aws.Bool(latest), LastModified: aws.Time(v.modified),
+				})
+				continue
+			}
+			page.Versions = append(page.Versions, &s3.ObjectVersion{
+				Key: aws.String(v.key), VersionId: aws.String(v.id), IsLatest: aws.Bool(latest),
+				Size: aws.Int64(int64(len(v.data))), LastModified: aws.Time(v.modified), ETag: aws.String(md5ETag(v.data)),
+			})
+		}
+		last := end == len(entries)
+		if !fn(page, last) || last {
+			return nil
+		}
+	}
+}
+
+func (m *mockS3) PutObjectRetention(input *s3.PutObjectRetentionInput) (*s3.PutObjectRetentionOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("PutObjectRetention"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	obj.lockMode = aws.StringValue(input.Retention.Mode)
+	obj.lockUntil = aws.TimeValue(input.Retention.RetainUntilDate)
+	return &s3.PutObjectRetentionOutput{}, nil
+}
+
+func (m *mockS3) PutObjectLegalHold(input *s3.PutObjectLegalHoldInput) (*s3.PutObjectLegalHoldOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("PutObjectLegalHold"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	obj.legalHold = aws.StringValue(input.LegalHold.Status)
+	return &s3.PutObjectLegalHoldOutput{}, nil
+}
+
+func (m *mockS3) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetObjectTagging"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: obj.tags}, nil
+}
+
+func (m *mockS3) PutObjectTagging(input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("PutObjectTagging"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	obj.tags = input.Tagging.TagSet
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (m *mockS3) RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RestoreObject"); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey(aws.StringValue(input.Key))
+	}
+	if obj.storageClass != s3.StorageClassGlacier && obj.storageClass != s3.StorageClassDeepArchive {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidObjectState", "Restore is not allowed for the object's current storage class", nil), http.StatusForbidden, "")
+	}
+	if strings.Contains(obj.restore, `ongoing-request="true"`) {
+		return nil, awserr.NewRequestFailure(awserr.New("RestoreAlreadyInProgress", "Object restore is already in progress", nil), http.StatusConflict, "")
+	}
+	obj.restore = `ongoing-request="true"`
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (m *mockS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	m.nextID++
+	id := strconv.Itoa(m.nextID)
+	m.uploads[id] = &mockUpload{key: aws.StringValue(input.Key), input: input, parts: make(map[int64][]byte)}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id), Bucket: input.Bucket, Key: input.Key}, nil
+}
+
+func (m *mockS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("UploadPart"); err != nil {
+		return nil, err
+	}
+	upload, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(md5ETag(data))}, nil
+}
+
+func (m *mockS3) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("UploadPartCopy"); err != nil {
+		return nil, err
+	}
+	upload, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	source, ok := m.objects[sourceKey(input.CopySource)]
+	if !ok {
+		return nil, noSuchKey(sourceKey(input.CopySource))
+	}
+	m.copyRanges = append(m.copyRanges, aws.StringValue(input.CopySourceRange))
+	data := source.data
+	if source.size > 0 {
+		//the data of a stubbed size isn't held, so its parts are empty
+		data = nil
+	} else if input.CopySourceRange != nil {
+		first, last, err := parseByteRange(aws.StringValue(input.CopySourceRange), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = data[first : last+1]
+	}
+	upload.parts[aws.Int64Value(input.PartNumber)] = append([]byte(nil), data...)
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(md5ETag(data))}}, nil
+}
+
+func (m *mockS3) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListParts"); err != nil {
+		return err
+	}
+	upload, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	output := &s3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+	for number, data := range upload.parts {
+		output.Parts = append(output.Parts, &s3.Part{
+			PartNumber: aws.Int64(number),
+			Size:       aws.Int64(int64(len(data))),
+			ETag:       aws.String(md5ETag(data)),
+		})
+	}
+	sort.Slice(output.Parts, func(i, j int) bool {
+		return aws.Int64Value(output.Parts[i].PartNumber) < aws.Int64Value(output.Parts[j].PartNumber)
+	})
+	fn(output, true)
+	return nil
+}
+
+func (m *mockS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	upload, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	var data []byte
+	//the etag of a multipart object is the md5 of the part md5s followed by the number of parts
+	partSums := md5.New()
+	for _, part := range input.MultipartUpload.Parts {
+		partData, ok := upload.parts[aws.Int64Value(part.PartNumber)]
+		if !ok {
+			return nil, awserr.New("InvalidPart", "One or more of the specified parts could not be found", nil)
+		}
+		data = append(data, partData...)
+		sum := md5.Sum(partData)
+		partSums.Write(sum[:])
+	}
+	delete(m.uploads, aws.StringValue(input.UploadId))
+	obj := &mockObject{
+		data:               data,
+		etag:               fmt.Sprintf("\"%x-%d\"", partSums.Sum(nil), len(input.MultipartUpload.Parts)),
+		modified:           time.Now(),
+		contentType:        aws.StringValue(upload.input.ContentType),
+		contentEncoding:    aws.StringValue(upload.input.ContentEncoding),
+		cacheControl:       aws.StringValue(upload.input.CacheControl),
+		contentDisposition: aws.StringValue(upload.input.ContentDisposition),
+		contentLanguage:    aws.StringValue(upload.input.ContentLanguage),
+		expires:            aws.TimeValue(upload.input.Expires),
+		sse:                aws.StringValue(upload.input.ServerSideEncryption),
+		kmsKeyID:           aws.StringValue(upload.input.SSEKMSKeyId),
+		storageClass:       aws.StringValue(upload.input.StorageClass),
+		acl:                aws.StringValue(upload.input.ACL),
+		metadata:           upload.input.Metadata,
+		tags:               decodeTagSet(upload.input.Tagging),
+	}
+	m.objects[upload.key] = obj
+	if err := m.lose["CompleteMultipartUpload"]; err != nil {
+		delete(m.lose, "CompleteMultipartUpload")
+		return nil, err
+	}
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (m *mockS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	delete(m.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func (m *mockS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return m.CreateMultipartUpload(input)
+}
+
+func (m *mockS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	return m.UploadPart(input)
+}
+
+func (m *mockS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return m.CompleteMultipartUpload(input)
+}
+
+func (m *mockS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return m.AbortMultipartUpload(input)
+}
+
+func TestMockS3PutObjectError(t *testing.T) {
+	mock := newMockS3()
+	failed := errors.New("put failed")
+	mock.errs["PutObject"] = failed
+	input := &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("data.txt"), Body: bytes.NewReader([]byte("data"))}
+	if _, err := mock.PutObject(input); err != failed {
+		t.Errorf("expected PutObject to return the error, got %v", err)
+	}
+	if _, err := mock.PutObjectWithContext(aws.BackgroundContext(), input); err != failed {
+		t.Errorf("expected PutObjectWithContext to return the error, got %v", err)
+	}
+	req, _ := mock.PutObjectRequest(input)
+	if err := req.Send(); err != failed {
+		t.Errorf("expected sending the request to return the error, got %v", err)
+	}
+	if mock.count("PutObject") != 3 || mock.object("data.txt") != nil {
+		t.Errorf("expected each put to fail once without writing the object, got %d puts", mock.count("PutObject"))
+	}
+}
@@ -0,0 +1,285 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Logger is the logging dependency used by the stores. It is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option configures settings that are shared by every backend, as opposed to the backend specific config structs
+type Option func(*storeOptions)
+
+type storeOptions struct {
+	logger     Logger
+	httpClient *http.Client
+	retries    int
+	retry      retryPolicy
+	limiter    *rateLimiter
+	onUpload   UploadHook
+	metrics    Metrics
+}
+
+// WithLogger sets the logger used by the store. Stores don't log when no logger is provided
+func WithLogger(logger Logger) Option {
+	return func(o *storeOptions) {
+		o.logger = logger
+	}
+}
+
+// WithHTTPClient sets the http client used by backends that make http requests
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *storeOptions) {
+		o.httpClient = client
+	}
+}
+
+// WithRetries sets the maximum number of times a failed request is retried by backends that support retries
+func WithRetries(retries int) Option {
+	return func(o *storeOptions) {
+		o.retries = retries
+	}
+}
+
+// WithRetryPolicy retries GetObject, PutObject and CompleteObjectUpload on transient errors such as SlowDown,
+// RequestTimeout and 5xx responses, on top of any retries done by the backend sdk. maxAttempts includes the first
+// attempt and the wait before each retry doubles, starting at baseBackoff. Errors that aren't transient are returned immediately
+func WithRetryPolicy(maxAttempts int, baseBackoff time.Duration) Option {
+	return func(o *storeOptions) {
+		o.retry = retryPolicy{maxAttempts: maxAttempts, baseBackoff: baseBackoff}
+	}
+}
+
+// WithBandwidthLimit throttles the store so that GetObject and Upload transfer at most bytesPerSec bytes per second,
+// shared by every transfer the store makes at once. Transfer and CopyObjectToStore are throttled by the limits of the stores
+// they read and write. Zero or less means no limit
+func WithBandwidthLimit(bytesPerSec int64) Option {
+	return func(o *storeOptions) {
+		o.limiter = nil
+		if bytesPerSec > 0 {
+			o.limiter = newRateLimiter(bytesPerSec)
+		}
+	}
+}
+
+// WithOnUpload calls the hook after each successful write, for indexing or notifications without wrapping every call site.
+// The hook is called synchronously before the write returns, so slow work should be started in its own goroutine
+func WithOnUpload(hook UploadHook) Option {
+	return func(o *storeOptions) {
+		o.onUpload = hook
+	}
+}
+
+// WithMetrics reports every operation of the store to the metrics, including those that aren't part of FileStore, such
+// as CopyObject, MergeObjects and Empty on S3FS. An operation that is a thin wrapper of another is reported as that one,
+// for example Walk as WalkContext and CreateDir as PutObject, and one made of others reports those as well, like the
+// CopyObject of each object of a CopyPrefix. Stores report nothing when no metrics are provided
+func WithMetrics(metrics Metrics) Option {
+	return func(o *storeOptions) {
+		o.metrics = metrics
+	}
+}
+
+// UploadOption configures a single PutObject or Upload call
+type UploadOption func(*uploadOptions)
+
+type uploadOptions struct {
+	contentType string
+	ifMatch     string
+	ifAbsent    bool
+	compress    bool
+	progress    ProgressFunction
+	acl         string
+	retention   *retention
+	expires     time.Time
+	tags        map[string]string
+	checksum    ChecksumAlgo
+}
+
+type retention struct {
+	mode  string
+	until time.Time
+}
+
+// WithContentType overrides the content type that is otherwise detected from the key extension or the content
+func WithContentType(contentType string) UploadOption {
+	return func(o *uploadOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithIfMatch makes PutObject, Upload and UploadFile conditional on the stored object having the etag provided, which is
+// the ETag returned by a previous PutObject on s3 and its Md5 on the file system backends. ErrPreconditionFailed is
+// returned when the object has changed or doesn't exist. BlockFS checks and writes under a flock on the directory of the
+// file, which other processes using BlockFS also take. On windows there is no flock and only writes from the same
+// process are kept apart
+func WithIfMatch(etag string) UploadOption {
+	return func(o *uploadOptions) {
+		o.ifMatch = etag
+	}
+}
+
+// WithIfAbsent makes PutObject, Upload and UploadFile fail with ErrAlreadyExists when an object already exists at the path.
+// BlockFS and SFTP claim the path by creating the file exclusively, so only one writer succeeds. This sdk predates
+// conditional s3 puts, so s3 checks with a HeadObject before the put and two writers racing between the calls can both succeed
+func WithIfAbsent() UploadOption {
+	return func(o *uploadOptions) {
+		o.ifAbsent = true
+	}
+}
+
+// WithCompression gzips the data of PutObject, Upload and UploadFile before it is stored. GetObject decompresses it again,
+// so callers read back the original bytes. S3 records the compression as the gzip Content-Encoding and BlockFS records it
+// in a sidecar file next to the data. SFTP returns ErrNotSupported
+func WithCompression() UploadOption {
+	return func(o *uploadOptions) {
+		o.compress = true
+	}
+}
+
+// WithACL sets the canned ACL of the uploaded object, such as bucket-owner-full-control so the owner of the bucket keeps
+// access to objects written from another account. It only applies to s3 and is ignored by the file system backends
+func WithACL(acl string) UploadOption {
+	return func(o *uploadOptions) {
+		o.acl = acl
+	}
+}
+
+// WithRetention protects the uploaded object with s3 Object Lock in the GOVERNANCE or COMPLIANCE mode until the time given.
+// The bucket must have Object Lock enabled. The file system backends can't protect files and return ErrNotSupported
+func WithRetention(mode string, until time.Time) UploadOption {
+	return func(o *uploadOptions) {
+		o.retention = &retention{mode: mode, until: until}
+	}
+}
+
+// ExpireAfterTag is the tag WithExpireAfter sets, for s3 lifecycle rules that expire objects by tag
+const ExpireAfterTag = "expire-after"
+
+// WithExpires sets the Expires header of the uploaded s3 object, which tells caches when the object is stale.
+// It doesn't delete the object, use WithExpireAfter and a lifecycle rule for that
+func WithExpires(expires time.Time) UploadOption {
+	return func(o *uploadOptions) {
+		o.expires = expires
+	}
+}
+
+// WithChecksum has s3 validate the data of a PutObject with the algorithm, on top of the Content-MD5 that is always sent,
+// so a put whose body was corrupted in transit is rejected. This sdk predates ChecksumAlgorithm, so PutObject computes the
+// x-amz-checksum header itself. S3 Upload and UploadFile return ErrNotSupported, and BlockFS and SFTP ignore the option
+func WithChecksum(algo ChecksumAlgo) UploadOption {
+	return func(o *uploadOptions) {
+		o.checksum = algo
+	}
+}
+
+// WithTags sets tags on the uploaded s3 object. Tags from repeated options are merged
+func WithTags(tags map[string]string) UploadOption {
+	return func(o *uploadOptions) {
+		if o.tags == nil {
+			o.tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			o.tags[k] = v
+		}
+	}
+}
+
+// WithExpireAfter tags the uploaded s3 object with expire-after set to the number of days, such as 7d, so a lifecycle
+// rule filtered on that tag can delete it. The bucket needs a rule for each value used
+func WithExpireAfter(days int) UploadOption {
+	return WithTags(map[string]string{ExpireAfterTag: fmt.Sprintf("%dd", days)})
+}
+
+// WithProgress calls progress as Upload and UploadFile read the content being uploaded
+func WithProgress(progress ProgressFunction) UploadOption {
+	return func(o *uploadOptions) {
+		o.progress = progress
+	}
+}
+
+// PresignOption configures a single presigned url
+type PresignOption func(*presignOptions)
+
+type presignOptions struct {
+	contentDisposition string
+	contentType        string
+}
+
+// WithContentDisposition sets the Content-Disposition returned when the url is fetched, for example
+// `attachment; filename="report.pdf"` to download the object under a name other than its key
+func WithContentDisposition(contentDisposition string) PresignOption {
+	return func(o *presignOptions) {
+		o.contentDisposition = contentDisposition
+	}
+}
+
+// WithResponseContentType sets the Content-Type returned when the url is fetched, overriding the stored content type
+func WithResponseContentType(contentType string) PresignOption {
+	return func(o *presignOptions) {
+		o.contentType = contentType
+	}
+}
+
+func newPresignOptions(opts []PresignOption) presignOptions {
+	options := presignOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func newUploadOptions(opts []UploadOption) uploadOptions {
+	options := uploadOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func newStoreOptions(opts []Option) storeOptions {
+	options := storeOptions{
+		retries: -1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func (o storeOptions) logf(format string, v ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, v...)
+	}
+}
+
+// uploaded calls the upload hook when the write succeeded
+func (o storeOptions) uploaded(key string, output *FileOperationOutput, err error) {
+	if err == nil && o.onUpload != nil {
+		o.onUpload(key, output)
+	}
+}
+
+// limitReader applies the bandwidth limit to the reader, returning it unchanged when there is no limit
+func (o storeOptions) limitReader(reader io.Reader) io.Reader {
+	if o.limiter == nil {
+		return reader
+	}
+	return &rateLimitedReader{reader: reader, limiter: o.limiter}
+}
+
+// limitReadCloser applies the bandwidth limit to the reader, returning it unchanged when there is no limit
+func (o storeOptions) limitReadCloser(reader io.ReadCloser) io.ReadCloser {
+	if o.limiter == nil {
+		return reader
+	}
+	return &rateLimitedReadCloser{
+		rateLimitedReader: rateLimitedReader{reader: reader, limiter: o.limiter},
+		closer:            reader,
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package filestore
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner looks up the user name of the file owner, caching names by uid since listings often share owners
+func fileOwner(fi os.FileInfo, cache map[uint32]string) string {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	if name, ok := cache[stat.Uid]; ok {
+		return name
+	}
+	name := strconv.FormatUint(uint64(stat.Uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	cache[stat.Uid] = name
+	return name
+}
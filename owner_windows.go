@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package filestore
+
+import (
+	"os"
+)
+
+// fileOwner isn't supported on windows, where file ownership isn't exposed through os.FileInfo
+func fileOwner(fi os.FileInfo, cache map[uint32]string) string {
+	return ""
+}
@@ -0,0 +1,54 @@
+package filestore
+
+import (
+	"io"
+	"os"
+)
+
+// progressReader reports the bytes read through it to a ProgressFunction
+type progressReader struct {
+	reader   io.Reader
+	progress ProgressFunction
+	read     int64
+	total    int64
+}
+
+// withProgress wraps the reader so progress is called after each read. It returns the reader unchanged when progress is nil
+func withProgress(reader io.Reader, progress ProgressFunction) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	return &progressReader{
+		reader:   reader,
+		progress: progress,
+		total:    readerSize(reader),
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.progress(p.read, p.total)
+	}
+	return n, err
+}
+
+// readerSize returns the number of bytes left in readers that know their size, and -1 for other readers
+func readerSize(reader io.Reader) int64 {
+	switch r := reader.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - offset
+	}
+	return -1
+}
@@ -0,0 +1,65 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// progressRecorder keeps the progress reported for an upload
+type progressRecorder struct {
+	transferred []int64
+	total       int64
+}
+
+func (p *progressRecorder) record(bytesTransferred int64, totalBytes int64) {
+	p.transferred = append(p.transferred, bytesTransferred)
+	p.total = totalBytes
+}
+
+// check asserts the progress was reported in several increasing steps up to size
+func (p *progressRecorder) check(t *testing.T, name string, size int64, total int64) {
+	t.Helper()
+	if len(p.transferred) < 2 {
+		t.Fatalf("%s: expected progress to be reported as the content is read, got %v", name, p.transferred)
+	}
+	for i := 1; i < len(p.transferred); i++ {
+		if p.transferred[i] <= p.transferred[i-1] {
+			t.Errorf("%s: expected the progress to increase, got %v", name, p.transferred)
+		}
+	}
+	if last := p.transferred[len(p.transferred)-1]; last != size || p.total != total {
+		t.Errorf("%s: expected %d of %d bytes, got %d of %d", name, size, total, last, p.total)
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	source := filepath.Join(t.TempDir(), "source.bin")
+	if err := ioutil.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		known := &progressRecorder{}
+		if _, err := fs.Upload(bytes.NewReader(data), "/known.bin", WithProgress(known.record)); err != nil {
+			t.Fatal(err)
+		}
+		known.check(t, name+" reader", int64(len(data)), int64(len(data)))
+
+		unknown := &progressRecorder{}
+		reader := io.MultiReader(bytes.NewReader(data))
+		if _, err := fs.Upload(reader, "/unknown.bin", WithProgress(unknown.record)); err != nil {
+			t.Fatal(err)
+		}
+		unknown.check(t, name+" unknown size", int64(len(data)), -1)
+
+		file := &progressRecorder{}
+		if _, err := fs.UploadFile(source, "/file.bin", WithProgress(file.record)); err != nil {
+			t.Fatal(err)
+		}
+		file.check(t, name+" file", int64(len(data)), int64(len(data)))
+	}
+}
@@ -0,0 +1,58 @@
+package filestore
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter spreads reads over time so that they don't exceed a number of bytes per second. It is shared by every
+// stream of a store so the limit applies to the store as a whole rather than to each stream
+type rateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	next        time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{bytesPerSec: bytesPerSec}
+}
+
+// wait blocks until n more bytes can be transferred without exceeding the rate
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.bytesPerSec) * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	//reading at most a second's worth keeps a large buffer from bursting past the limit
+	if int64(len(p)) > r.limiter.bytesPerSec {
+		p = p[:r.limiter.bytesPerSec]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+type rateLimitedReadCloser struct {
+	rateLimitedReader
+	closer io.Closer
+}
+
+func (r *rateLimitedReadCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,90 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const (
+	testBandwidth = 10 * 1024 * 1024
+	//at 10MB/s the 3MB takes 300ms, less the first read which isn't delayed
+	throttledSize    = 3 * 1024 * 1024
+	throttledMinimum = 200 * time.Millisecond
+)
+
+// timed returns how long fn takes
+func timed(t *testing.T, fn func() error) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if err := fn(); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	data := make([]byte, throttledSize)
+	s3fs, mock := newTestS3FS(t, WithBandwidthLimit(testBandwidth))
+	mock.put("data.bin", data)
+	blockfs := newTestBlockFS(t, WithBandwidthLimit(testBandwidth))
+	unlimited := newTestBlockFS(t)
+	if _, err := unlimited.PutObject("/data.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	read := func(fs FileStore) func() error {
+		return func() error {
+			reader, err := fs.GetObject("/data.bin")
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			_, err = io.Copy(ioutil.Discard, reader)
+			return err
+		}
+	}
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"BlockFS Upload", func() error {
+			_, err := blockfs.Upload(bytes.NewReader(data), "/data.bin")
+			return err
+		}},
+		{"BlockFS GetObject", read(blockfs)},
+		{"S3FS GetObject", read(s3fs)},
+		{"S3FS GetObjectRange", func() error {
+			reader, err := s3fs.GetObjectRange("/data.bin", 0, throttledSize)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			_, err = io.Copy(ioutil.Discard, reader)
+			return err
+		}},
+		{"S3FS GetObjectIfModifiedSince", func() error {
+			reader, _, err := s3fs.GetObjectIfModifiedSince("/data.bin", time.Time{})
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			_, err = io.Copy(ioutil.Discard, reader)
+			return err
+		}},
+		{"S3FS PeekObject", func() error {
+			_, err := s3fs.PeekObject("/data.bin", throttledSize)
+			return err
+		}},
+		{"Transfer", func() error { return Transfer(s3fs, "/data.bin", unlimited, "/copy.bin") }},
+	}
+	for _, test := range tests {
+		if elapsed := timed(t, test.fn); elapsed < throttledMinimum {
+			t.Errorf("%s: expected the transfer to be throttled to at least %s, took %s", test.name, throttledMinimum, elapsed)
+		}
+	}
+	if elapsed := timed(t, read(unlimited)); elapsed >= throttledMinimum {
+		t.Errorf("expected the unlimited store not to be throttled, took %s", elapsed)
+	}
+}
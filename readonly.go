@@ -0,0 +1,107 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrReadOnly is returned by every mutating operation on a store wrapped with ReadOnly
+var ErrReadOnly = errors.New("file store is read only")
+
+// ReadOnly wraps a store so that reads are delegated and every write fails with ErrReadOnly without touching the backend
+func ReadOnly(fs FileStore) FileStore {
+	return &readOnlyFS{fs: fs}
+}
+
+type readOnlyFS struct {
+	fs FileStore
+}
+
+func (r *readOnlyFS) GetDir(path string, recursive bool) (*[]FileStoreResultObject, error) {
+	return r.fs.GetDir(path, recursive)
+}
+
+func (r *readOnlyFS) GetDirPage(path string, token string, pageSize int) ([]FileStoreResultObject, string, error) {
+	return r.fs.GetDirPage(path, token, pageSize)
+}
+
+func (r *readOnlyFS) ListDirs(path string) ([]string, error) {
+	return r.fs.ListDirs(path)
+}
+
+func (r *readOnlyFS) GetObject(path string) (io.ReadCloser, error) {
+	return r.fs.GetObject(path)
+}
+
+func (r *readOnlyFS) GetObjectInfo(path string) (*ObjectInfo, error) {
+	return r.fs.GetObjectInfo(path)
+}
+
+func (r *readOnlyFS) Size(path string) (int64, error) {
+	return r.fs.Size(path)
+}
+
+func (r *readOnlyFS) PutObject(path string, data []byte, opts ...UploadOption) (*FileOperationOutput, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *readOnlyFS) DeleteObjects(path ...string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) Append(path string, data []byte) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) CreateDir(path string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) CreateEmptyObject(path string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) Touch(path string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *readOnlyFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *readOnlyFS) Glob(pattern string) ([]FileStoreResultObject, error) {
+	return r.fs.Glob(pattern)
+}
+
+func (r *readOnlyFS) Walk(path string, vistorFunction FileVisitFunction) error {
+	return r.fs.Walk(path, vistorFunction)
+}
+
+func (r *readOnlyFS) WalkDir(path string, visitorFunction WalkDirFunction) error {
+	return r.fs.WalkDir(path, visitorFunction)
+}
+
+func (r *readOnlyFS) WalkContext(ctx context.Context, path string, vistorFunction FileVisitFunction) error {
+	return r.fs.WalkContext(ctx, path, vistorFunction)
+}
+
+func (r *readOnlyFS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
+	return UploadResult{}, ErrReadOnly
+}
+
+func (r *readOnlyFS) WriteChunk(u UploadConfig) (UploadResult, error) {
+	return UploadResult{}, ErrReadOnly
+}
+
+func (r *readOnlyFS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyFS) Close() error {
+	return r.fs.Close()
+}
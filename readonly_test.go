@@ -0,0 +1,78 @@
+package filestore
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyDelegatesReads(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	mock.put("dir/data.txt", []byte("content"))
+	fs := ReadOnly(s3fs)
+	if content := readObject(t, fs, "/dir/data.txt"); content != "content" {
+		t.Errorf("expected the content, got %q", content)
+	}
+	size, err := fs.Size("/dir/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 7 {
+		t.Errorf("expected a size of 7, got %d", size)
+	}
+	objects, err := fs.GetDir("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*objects) != 1 || (*objects)[0].Name != "data.txt" {
+		t.Errorf("expected the listing of the backend, got %v", *objects)
+	}
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	mock.put("data.txt", []byte("content"))
+	fs := ReadOnly(s3fs)
+	writes := map[string]func() error{
+		"PutObject": func() error {
+			_, err := fs.PutObject("/data.txt", []byte("replaced"))
+			return err
+		},
+		"DeleteObjects":     func() error { return fs.DeleteObjects("/data.txt") },
+		"Append":            func() error { return fs.Append("/data.txt", []byte("more")) },
+		"CreateDir":         func() error { return fs.CreateDir("/dir") },
+		"CreateEmptyObject": func() error { return fs.CreateEmptyObject("/empty") },
+		"Touch":             func() error { return fs.Touch("/data.txt") },
+		"Upload": func() error {
+			_, err := fs.Upload(strings.NewReader("replaced"), "/data.txt")
+			return err
+		},
+		"UploadFile": func() error {
+			_, err := fs.UploadFile("/does/not/matter", "/data.txt")
+			return err
+		},
+		"InitializeObjectUpload": func() error {
+			_, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/data.txt"})
+			return err
+		},
+		"WriteChunk": func() error {
+			_, err := fs.WriteChunk(UploadConfig{ObjectPath: "/data.txt", Data: []byte("replaced")})
+			return err
+		},
+		"CompleteObjectUpload": func() error {
+			return fs.CompleteObjectUpload(CompletedObjectUploadConfig{ObjectPath: "/data.txt"})
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+	if len(mock.calls) != 0 {
+		t.Errorf("expected no calls to reach the backend, got %v", mock.calls)
+	}
+	if obj := mock.object("data.txt"); !reflect.DeepEqual(obj.data, []byte("content")) {
+		t.Errorf("expected the object to be untouched, got %q", obj.data)
+	}
+}
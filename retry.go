@@ -0,0 +1,43 @@
+package filestore
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// retryPolicy retries operations that fail with a transient error, doubling the backoff after each attempt.
+// The zero value makes a single attempt
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+}
+
+// do calls fn until it succeeds, returns an error that isn't retryable, or the attempts run out
+func (p retryPolicy) do(fn func() error) error {
+	backoff := p.baseBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= p.maxAttempts || !isRetryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isRetryable reports whether an aws error is transient: throttling, timeouts and server errors. A skewed clock isn't,
+// since it is just as skewed after the backoff
+func isRetryable(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "Throttling", "ThrottlingException":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package filestore
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func slowDown() error {
+	return awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), http.StatusServiceUnavailable, "")
+}
+
+func TestRetryPolicySucceedsAfterTransientErrors(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithRetryPolicy(3, time.Millisecond))
+	mock.put("data.txt", []byte("data"))
+	mock.failNext["GetObject"] = []error{slowDown(), awserr.New("RequestTimeout", "timed out", nil)}
+	mock.failNext["PutObject"] = []error{slowDown(), slowDown()}
+
+	content, err := GetObjectString(fs, "/data.txt", 0)
+	if err != nil || content != "data" {
+		t.Errorf("expected the third GetObject to succeed, got %q %v", content, err)
+	}
+	if _, err := fs.PutObject("/put.txt", []byte("put")); err != nil {
+		t.Errorf("expected the third PutObject to succeed, got %v", err)
+	}
+	if mock.count("GetObject") != 3 || mock.count("PutObject") != 3 {
+		t.Errorf("expected 3 attempts each, got %v", mock.calls)
+	}
+}
+
+func TestRetryPolicyRangedAndConditionalReads(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithRetryPolicy(3, time.Millisecond))
+	mock.put("data.txt", []byte("data"))
+	reads := map[string]func() error{
+		"GetObjectRange": func() error {
+			reader, err := fs.GetObjectRange("/data.txt", 0, 2)
+			if err == nil {
+				reader.Close()
+			}
+			return err
+		},
+		"GetObjectIfModifiedSince": func() error {
+			reader, _, err := fs.GetObjectIfModifiedSince("/data.txt", time.Time{})
+			if err == nil {
+				reader.Close()
+			}
+			return err
+		},
+		"PeekObject": func() error {
+			_, err := fs.PeekObject("/data.txt", 2)
+			return err
+		},
+	}
+	for name, read := range reads {
+		before := mock.count("GetObject")
+		mock.failNext["GetObject"] = []error{slowDown(), slowDown()}
+		if err := read(); err != nil {
+			t.Errorf("%s: expected the third attempt to succeed, got %v", name, err)
+		}
+		if attempts := mock.count("GetObject") - before; attempts != 3 {
+			t.Errorf("%s: expected 3 attempts, got %d", name, attempts)
+		}
+	}
+}
+
+func TestRetryPolicyCompleteObjectUpload(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithRetryPolicy(3, time.Millisecond))
+	id, etags := startS3Upload(t, fs, "/chunked", []byte("chunk"))
+	mock.failNext["CompleteMultipartUpload"] = []error{awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), http.StatusInternalServerError, "")}
+	err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/chunked", ChunkUploadIds: etags})
+	if err != nil {
+		t.Errorf("expected the retried completion to succeed, got %v", err)
+	}
+}
+
+func TestRetryPolicyGivesUp(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithRetryPolicy(3, time.Millisecond))
+	mock.put("data.txt", []byte("data"))
+	mock.errs["GetObject"] = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+	if _, err := fs.GetObject("/data.txt"); err == nil {
+		t.Error("expected the error")
+	}
+	if mock.count("GetObject") != 1 {
+		t.Errorf("expected a non retryable error to be returned after one attempt, got %d", mock.count("GetObject"))
+	}
+
+	mock.errs["GetObject"] = slowDown()
+	if _, err := fs.GetObject("/data.txt"); err == nil {
+		t.Error("expected the error once the attempts run out")
+	}
+	if mock.count("GetObject") != 4 {
+		t.Errorf("expected 3 more attempts, got %d", mock.count("GetObject")-1)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{slowDown(), true},
+		{awserr.New("RequestTimeout", "timed out", nil), true},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "bad gateway", nil), http.StatusBadGateway, ""), true},
+		{awserr.New("NoSuchKey", "missing", nil), false},
+		{awserr.NewRequestFailure(awserr.New("RequestTimeTooSkewed", "clock skew", nil), http.StatusForbidden, ""), false},
+		{errors.New("plain error"), false},
+	}
+	for _, test := range tests {
+		if isRetryable(test.err) != test.expected {
+			t.Errorf("expected isRetryable(%v) to be %v", test.err, test.expected)
+		}
+	}
+}
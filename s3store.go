@@ -2,17 +2,34 @@ package filestore
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // S3FileInfo is a wrapper around the s3.Object struct that implements the os.FileInfo interface
@@ -30,8 +47,11 @@ func (obj *S3FileInfo) Size() int64 {
 	return *obj.s3.Size
 }
 
-// Mode defaults to Irregular
+// Mode defaults to Irregular, or Dir for the empty marker objects whose keys end in "/"
 func (obj *S3FileInfo) Mode() os.FileMode {
+	if obj.IsDir() {
+		return os.ModeDir
+	}
 	return os.ModeIrregular
 }
 
@@ -40,9 +60,10 @@ func (obj *S3FileInfo) ModTime() time.Time {
 	return *obj.s3.LastModified
 }
 
-// IsDir returns a boolean determining whether an object is a directory or not
+// IsDir returns a boolean determining whether an object is a directory or not. Only the empty marker objects that some
+// tools create for folders, whose keys end in "/", are directories
 func (obj *S3FileInfo) IsDir() bool {
-	return false
+	return strings.HasSuffix(aws.StringValue(obj.s3.Key), "/")
 }
 
 // Sys defaults to nil for objects of s3
@@ -50,6 +71,41 @@ func (obj *S3FileInfo) Sys() interface{} {
 	return nil
 }
 
+// S3DirInfo implements os.FileInfo for a common prefix, which s3 lists in place of a directory
+type S3DirInfo struct {
+	prefix string
+}
+
+// Name returns the prefix, ending in "/"
+func (dir *S3DirInfo) Name() string {
+	return dir.prefix
+}
+
+// Size is always zero, since a prefix has no content
+func (dir *S3DirInfo) Size() int64 {
+	return 0
+}
+
+// Mode is always Dir
+func (dir *S3DirInfo) Mode() os.FileMode {
+	return os.ModeDir
+}
+
+// ModTime is always the zero time, since s3 doesn't track prefixes
+func (dir *S3DirInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+// IsDir is always true
+func (dir *S3DirInfo) IsDir() bool {
+	return true
+}
+
+// Sys defaults to nil for prefixes of s3
+func (dir *S3DirInfo) Sys() interface{} {
+	return nil
+}
+
 // S3FSConfig stores the configuration and credentials necessary to create an s3 instance of the filestore
 type S3FSConfig struct {
 	S3Id             string
@@ -61,28 +117,152 @@ type S3FSConfig struct {
 	S3ForcePathStyle bool
 	S3Prefix         string
 	Mock             bool
+	// UploadConcurrency is the number of parts uploaded in parallel by PutLargeObject. Defaults to the s3manager default when zero
+	UploadConcurrency int
+	// UploadPartSize is the size in bytes of each part uploaded by PutLargeObject. Defaults to the s3manager default when zero
+	UploadPartSize int64
+	// ChunkSize is the size in bytes of the chunks written with WriteChunk. It can't be less than 5MB, the s3 minimum part size
+	ChunkSize int64
+	// FetchOwner populates ModifiedBy in GetDir, GetDirPage and Glob with the object owner. It is opt in because s3 does
+	// extra work to return owners
+	FetchOwner bool
+	// FetchMetadata populates Metadata in GetDir with the user metadata of each object. Listings don't include metadata,
+	// so it costs a HeadObject request per object, made 8 at a time
+	FetchMetadata bool
+	// ServerSideEncryption encrypts the objects written by the store at rest, with AES256 or aws:kms. It applies to
+	// PutObject, Upload and chunked uploads alike. When empty the bucket default encryption applies
+	ServerSideEncryption string
+	// SSEKMSKeyId is the KMS key used when ServerSideEncryption is aws:kms. When empty the aws managed key is used
+	SSEKMSKeyId string
+	// UseAccelerateEndpoint sends requests, including the parts of uploads, through the s3 transfer acceleration endpoint.
+	// The bucket must have transfer acceleration enabled and a dns compatible name without dots
+	UseAccelerateEndpoint bool
 }
 
 // S3FS satisfies the FileStore interface, allowing for generic file operations to be done on s3 blobs
 type S3FS struct {
-	session *session.Session
-	config  *S3FSConfig
-	maxKeys int64
+	svc       s3iface.S3API
+	uploader  *s3manager.Uploader
+	config    *S3FSConfig
+	maxKeys   int64
+	chunkSize int64
+	options   storeOptions
+}
+
+// NewS3FS creates an S3FS with its own session, built from the credentials, region and endpoint of the config.
+// When S3Id and S3Key are both empty the credentials are found by the default aws credential chain
+func NewS3FS(config S3FSConfig, opts ...Option) (*S3FS, error) {
+	if config.S3Region == "" {
+		return nil, ErrMissingRegion
+	}
+	if (config.S3Id == "") != (config.S3Key == "") {
+		return nil, fmt.Errorf("%w: S3Id and S3Key must both be set, or both be empty to use the default credential chain", ErrMissingCredentials)
+	}
+	cfg, err := newS3Config(config, newStoreOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewS3FSWithClient(config, s3.New(sess), opts...)
+}
+
+// newS3Config returns the aws config of the session NewS3FS creates for the config
+func newS3Config(config S3FSConfig, options storeOptions) (*aws.Config, error) {
+	cfg := aws.NewConfig().WithRegion(config.S3Region)
+	if config.S3Id != "" {
+		cfg.WithCredentials(credentials.NewStaticCredentials(config.S3Id, config.S3Key, ""))
+	}
+	if config.UseAccelerateEndpoint {
+		if config.Mock && config.S3ForcePathStyle {
+			return nil, fmt.Errorf("%w: UseAccelerateEndpoint can't be used with S3ForcePathStyle", ErrUnsupportedConfig)
+		}
+		cfg.WithS3UseAccelerate(true)
+	}
+	if config.Mock {
+		cfg.WithDisableSSL(config.S3DisableSSL)
+		cfg.WithS3ForcePathStyle(config.S3ForcePathStyle)
+		if config.S3Endpoint != "" {
+			cfg.WithEndpoint(config.S3Endpoint)
+		}
+	}
+	if options.httpClient != nil {
+		cfg.WithHTTPClient(options.httpClient)
+	}
+	if options.retries >= 0 {
+		cfg.WithMaxRetries(options.retries)
+	}
+	return cfg, nil
+}
+
+// NewS3FSWithClient creates an S3FS that uses an existing client rather than building its own session.
+// This allows a tuned session to be shared across stores and lets tests substitute an s3iface.S3API mock
+func NewS3FSWithClient(config S3FSConfig, client s3iface.S3API, opts ...Option) (*S3FS, error) {
+	if config.S3Bucket == "" {
+		return nil, ErrMissingBucket
+	}
+	if config.ChunkSize > 0 && config.ChunkSize < s3MinPartSize {
+		return nil, fmt.Errorf("S3 chunk size %d is less than the minimum part size of %d bytes", config.ChunkSize, s3MinPartSize)
+	}
+	if config.UploadPartSize > 0 && config.UploadPartSize < s3MinPartSize {
+		return nil, fmt.Errorf("S3 upload part size %d is less than the minimum part size of %d bytes", config.UploadPartSize, s3MinPartSize)
+	}
+	switch config.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, fmt.Errorf("invalid server side encryption %q, expected %s or %s", config.ServerSideEncryption, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+	if config.SSEKMSKeyId != "" && config.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return nil, fmt.Errorf("SSEKMSKeyId requires a ServerSideEncryption of %s", s3.ServerSideEncryptionAwsKms)
+	}
+	fs := S3FS{
+		svc:       client,
+		config:    &config,
+		maxKeys:   1000,
+		chunkSize: defaultChunkSize,
+		options:   newStoreOptions(opts),
+	}
+	if config.ChunkSize > 0 {
+		fs.chunkSize = config.ChunkSize
+	}
+	fs.uploader = s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		if config.UploadPartSize > 0 {
+			u.PartSize = config.UploadPartSize
+		}
+	})
+	return &fs, nil
+}
+
+// GetDir is similar to an ls unix call. It lists the objects at an s3 prefix, with the option of being recursive.
+// Results are sorted by path, with directories before files and then by name, the same as the other backends
+func (s3fs *S3FS) GetDir(dirPath string, recursive bool) (_ *[]FileStoreResultObject, err error) {
+	defer s3fs.options.observe("GetDir", 0)(&err)
+	return s3fs.getDir(dirPath, "", recursive)
+}
+
+// GetDirAfter is GetDir starting the listing after the startAfter key, so only the entries that sort after it are listed
+func (s3fs *S3FS) GetDirAfter(dirPath string, startAfter string, recursive bool) (_ *[]FileStoreResultObject, err error) {
+	defer s3fs.options.observe("GetDirAfter", 0)(&err)
+	return s3fs.getDir(dirPath, startAfter, recursive)
 }
 
-// GetDir is similar to an ls unix call. It lists the objects at an s3 prefix, with the option of being recursive
-func (s3fs *S3FS) GetDir(path string, recursive bool) (*[]FileStoreResultObject, error) {
-	s3Path := strings.Trim(path, "/") + "/"
+func (s3fs *S3FS) getDir(dirPath string, startAfter string, recursive bool) (*[]FileStoreResultObject, error) {
+	s3Path := dirPrefix(dirPath)
 	var delim string
 	if !recursive {
 		delim = "/"
 	}
-	s3client := s3.New(s3fs.session)
 	query := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s3fs.config.S3Bucket),
-		Prefix:    aws.String(s3Path),
-		Delimiter: aws.String(delim),
-		MaxKeys:   aws.Int64(s3fs.maxKeys),
+		Bucket:     aws.String(s3fs.config.S3Bucket),
+		Prefix:     aws.String(s3Path),
+		Delimiter:  aws.String(delim),
+		MaxKeys:    aws.Int64(s3fs.maxKeys),
+		FetchOwner: aws.Bool(s3fs.config.FetchOwner),
+	}
+	if startAfter != "" {
+		query.StartAfter = aws.String(strings.TrimPrefix(startAfter, "/"))
 	}
 
 	result := []FileStoreResultObject{}
@@ -90,86 +270,365 @@ func (s3fs *S3FS) GetDir(path string, recursive bool) (*[]FileStoreResultObject,
 	var count int
 	for truncatedListing {
 
-		resp, err := s3client.ListObjectsV2(query)
+		resp, err := s3fs.svc.ListObjectsV2(query)
 		if err != nil {
+			return nil, s3Error(dirPath, err)
+		}
+
+		listed := s3ListResults(resp, count)
+		count += len(listed)
+		result = append(result, listed...)
+
+		query.ContinuationToken = resp.NextContinuationToken
+		truncatedListing = *resp.IsTruncated
+	}
+
+	if s3fs.config.FetchMetadata {
+		if err := s3fs.fetchMetadata(result); err != nil {
 			return nil, err
 		}
+	}
+	sortResults(result)
+	return &result, nil
+}
 
-		for _, cp := range resp.CommonPrefixes {
-			w := FileStoreResultObject{
-				ID:         count,
-				Name:       filepath.Base(*cp.Prefix),
-				Size:       "",
-				Path:       *cp.Prefix,
-				Type:       "",
-				IsDir:      true,
-				ModifiedBy: "",
-			}
-			count++
-			result = append(result, w)
-		}
-
-		for _, object := range resp.Contents {
-			parts := strings.Split(filepath.Dir(*object.Key), "/")
-			isSelf := filepath.Base(*object.Key) == parts[len(parts)-1]
-
-			if !isSelf {
-				w := FileStoreResultObject{
-					ID:         count,
-					Name:       filepath.Base(*object.Key),
-					Size:       strconv.FormatInt(*object.Size, 10),
-					Path:       filepath.Dir(*object.Key),
-					Type:       filepath.Ext(*object.Key),
-					IsDir:      false,
-					Modified:   *object.LastModified,
-					ModifiedBy: "",
+// fetchMetadata fills in the user metadata of the objects in the listing with HeadObject requests from a pool of workers.
+// The first error is returned once the requests in flight finish
+func (s3fs *S3FS) fetchMetadata(objects []FileStoreResultObject) error {
+	jobs := make(chan int)
+	errs := make(chan error, len(objects))
+	var wg sync.WaitGroup
+	for w := 0; w < defaultBatchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				key := path.Join(objects[i].Path, objects[i].Name)
+				info, err := s3fs.GetObjectInfo(key)
+				if err != nil {
+					errs <- err
+					continue
 				}
-
-				count++
-				result = append(result, w)
+				objects[i].Metadata = info.Metadata
 			}
+		}()
+	}
+	for i := range objects {
+		if !objects[i].IsDir {
+			jobs <- i
 		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
 
-		query.ContinuationToken = resp.NextContinuationToken
-		truncatedListing = *resp.IsTruncated
+// s3ListResults builds the listing entries for the common prefixes and objects of a single listing, numbering them from firstID
+func s3ListResults(resp *s3.ListObjectsV2Output, firstID int) []FileStoreResultObject {
+	result := []FileStoreResultObject{}
+	count := firstID
+	for _, cp := range resp.CommonPrefixes {
+		result = append(result, s3DirResult(count, *cp.Prefix))
+		count++
 	}
 
-	return &result, nil
+	for _, object := range resp.Contents {
+		parts := strings.Split(path.Dir(*object.Key), "/")
+		isSelf := path.Base(*object.Key) == parts[len(parts)-1]
+
+		if !isSelf {
+			result = append(result, s3ObjectResult(count, object))
+			count++
+		}
+	}
+	return result
+}
+
+// s3DirResult builds the listing entry for a directory, which only exists as the prefix of the keys under it
+func s3DirResult(id int, prefix string) FileStoreResultObject {
+	return FileStoreResultObject{
+		ID:    id,
+		Name:  path.Base(prefix),
+		Path:  s3Parent(strings.TrimSuffix(prefix, "/")),
+		IsDir: true,
+	}
+}
+
+// s3ObjectResult builds the listing entry for an object
+func s3ObjectResult(id int, object *s3.Object) FileStoreResultObject {
+	key := aws.StringValue(object.Key)
+	return FileStoreResultObject{
+		ID:         id,
+		Name:       path.Base(key),
+		Size:       strconv.FormatInt(aws.Int64Value(object.Size), 10),
+		SizeBytes:  aws.Int64Value(object.Size),
+		Path:       s3Parent(key),
+		Type:       path.Ext(key),
+		Modified:   aws.TimeValue(object.LastModified),
+		ModifiedBy: objectOwner(object.Owner),
+	}
+}
+
+// s3Parent returns the parent of the key, which is "/" for a key at the root of the bucket. It is the Path of listing
+// entries for both directories and objects, so path.Join(Path, Name) is always the key
+func s3Parent(key string) string {
+	//s3 keys always use "/" so they are parsed with path rather than filepath, which uses the os separator
+	parent := path.Dir(key)
+	if parent == "." {
+		return "/"
+	}
+	return parent
+}
+
+// GetDirPage lists a single page of the entries directly under the prefix, for callers such as web UIs that page through
+// large directories. An empty token requests the first page and the returned token requests the next, with an empty token
+// returned once the listing is done. The token is the s3 continuation token. Pages hold at most pageSize entries, defaulting
+// to 1000, in key order with the common prefixes of the page before its objects
+func (s3fs *S3FS) GetDirPage(dirPath string, token string, pageSize int) (_ []FileStoreResultObject, _ string, err error) {
+	defer s3fs.options.observe("GetDirPage", 0)(&err)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	query := &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s3fs.config.S3Bucket),
+		Prefix:     aws.String(dirPrefix(dirPath)),
+		Delimiter:  aws.String("/"),
+		MaxKeys:    aws.Int64(int64(pageSize)),
+		FetchOwner: aws.Bool(s3fs.config.FetchOwner),
+	}
+	if token != "" {
+		query.ContinuationToken = aws.String(token)
+	}
+	resp, err := s3fs.svc.ListObjectsV2(query)
+	if err != nil {
+		return nil, "", s3Error(dirPath, err)
+	}
+	var next string
+	if aws.BoolValue(resp.IsTruncated) {
+		next = aws.StringValue(resp.NextContinuationToken)
+	}
+	result := s3ListResults(resp, 0)
+	if s3fs.config.FetchMetadata {
+		if err := s3fs.fetchMetadata(result); err != nil {
+			return nil, "", err
+		}
+	}
+	return result, next, nil
+}
+
+// ListDirs returns the names of the prefixes directly under the path, sorted by name, without building entries for the objects
+func (s3fs *S3FS) ListDirs(dirPath string) (_ []string, err error) {
+	defer s3fs.options.observe("ListDirs", 0)(&err)
+	query := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s3fs.config.S3Bucket),
+		Prefix:    aws.String(dirPrefix(dirPath)),
+		Delimiter: aws.String("/"),
+	}
+	dirs := []string{}
+	err = s3fs.svc.ListObjectsV2Pages(query, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, cp := range page.CommonPrefixes {
+			dirs = append(dirs, path.Base(aws.StringValue(cp.Prefix)))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(dirPath, err)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
 }
 
 // GetObject will return the body of an s3 object as a ReadCloser, meaning it has the basic Read and Close methods
-func (s3fs *S3FS) GetObject(path string) (io.ReadCloser, error) {
+func (s3fs *S3FS) GetObject(path string) (reader io.ReadCloser, err error) {
+	defer s3fs.options.observeRead("GetObject")(&reader, &err)
+	return s3fs.getObject(path, &s3.GetObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+	})
+}
+
+// getObject gets the object with retries and returns its body under the bandwidth limit, decompressing the body of an
+// object written with WithCompression
+func (s3fs *S3FS) getObject(path string, input *s3.GetObjectInput) (io.ReadCloser, error) {
+	var output *s3.GetObjectOutput
+	err := s3fs.options.retry.do(func() error {
+		var err error
+		output, err = s3fs.svc.GetObject(input)
+		return err
+	})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	body := s3fs.options.limitReadCloser(output.Body)
+	if aws.StringValue(output.ContentEncoding) == gzipEncoding {
+		return newGzipReadCloser(body)
+	}
+	return body, nil
+}
+
+// GetObjectInfo returns the size, content type, etag, modified time and user metadata of an object from a single HeadObject call
+func (s3fs *S3FS) GetObjectInfo(path string) (_ *ObjectInfo, err error) {
+	defer s3fs.options.observe("GetObjectInfo", 0)(&err)
 	s3Path := strings.TrimPrefix(path, "/")
-	svc := s3.New(s3fs.session)
-	input := &s3.GetObjectInput{
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	}
+	output, err := s3fs.svc.HeadObject(input)
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	return &ObjectInfo{
+		Size:            aws.Int64Value(output.ContentLength),
+		ContentType:     aws.StringValue(output.ContentType),
+		ETag:            aws.StringValue(output.ETag),
+		ModTime:         aws.TimeValue(output.LastModified),
+		Metadata:        aws.StringValueMap(output.Metadata),
+		ContentEncoding: aws.StringValue(output.ContentEncoding),
+	}, nil
+}
+
+// Size returns the size of an object in bytes from a HeadObject call
+func (s3fs *S3FS) Size(path string) (_ int64, err error) {
+	defer s3fs.options.observe("Size", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.HeadObjectInput{
 		Bucket: aws.String(s3fs.config.S3Bucket),
 		Key:    aws.String(s3Path),
 	}
-	output, err := svc.GetObject(input)
-	return output.Body, err
+	output, err := s3fs.svc.HeadObject(input)
+	if err != nil {
+		return 0, s3Error(path, err)
+	}
+	return aws.Int64Value(output.ContentLength), nil
 }
 
-// PutObject will take the data provided and put it on s3 at the path provided
-func (s3fs *S3FS) PutObject(path string, data []byte) (*FileOperationOutput, error) {
+// PutObject will take the data provided and put it on s3 at the path provided.
+// The content type is detected from the path extension or the data unless WithContentType is provided.
+// WithCompression stores the data gzipped with a gzip Content-Encoding
+func (s3fs *S3FS) PutObject(path string, data []byte, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer s3fs.options.observe("PutObject", int64(len(data)))(&err)
+	defer func() { s3fs.options.uploaded(path, output, err) }()
+	options := newUploadOptions(opts)
+	if options.contentType == "" {
+		options.contentType = detectContentType(path, data)
+	}
+	if err := s3fs.checkConditions(path, options); err != nil {
+		return nil, err
+	}
 	s3Path := strings.TrimPrefix(path, "/")
-	svc := s3.New(s3fs.session)
+	if options.compress {
+		var err error
+		data, err = gzipBytes(data)
+		if err != nil {
+			return nil, err
+		}
+	}
 	reader := bytes.NewReader(data)
 	input := &s3.PutObjectInput{
 		Bucket:        aws.String(s3fs.config.S3Bucket),
 		Body:          reader,
 		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(options.contentType),
 		Key:           aws.String(s3Path),
 	}
-	s3output, err := svc.PutObject(input)
+	//s3 rejects the put when the body it receives doesn't match the Content-MD5, catching corruption in transit.
+	//It is also required on writes that set a retention
+	sum := md5.Sum(data)
+	input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.encryption()
+	if options.acl != "" {
+		if err := validateACL(options.acl); err != nil {
+			return nil, err
+		}
+		input.ACL = aws.String(options.acl)
+	}
+	if options.compress {
+		input.ContentEncoding = aws.String(gzipEncoding)
+	}
+	if !options.expires.IsZero() {
+		input.Expires = aws.Time(options.expires)
+	}
+	if len(options.tags) > 0 {
+		input.Tagging = aws.String(encodeTags(options.tags))
+	}
+	if options.retention != nil {
+		if err := validateRetentionMode(options.retention.mode); err != nil {
+			return nil, err
+		}
+		input.ObjectLockMode = aws.String(options.retention.mode)
+		input.ObjectLockRetainUntilDate = aws.Time(options.retention.until)
+	}
+	var requestOptions []request.Option
+	if options.checksum != "" {
+		header, value, err := checksumHeader(options.checksum, data)
+		if err != nil {
+			return nil, err
+		}
+		if header != "" {
+			//the header is set before the request is signed, so it is signed along with the rest
+			requestOptions = append(requestOptions, func(r *request.Request) {
+				r.HTTPRequest.Header.Set(header, value)
+			})
+		}
+	}
+	var s3output *s3.PutObjectOutput
+	err = s3fs.options.retry.do(func() error {
+		//rewind the body in case a previous attempt read from it
+		_, err := reader.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		s3output, err = s3fs.svc.PutObjectWithContext(context.Background(), input, requestOptions...)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, s3Error(path, err)
+	}
+	return &FileOperationOutput{
+		Md5:         hex.EncodeToString(sum[:]),
+		ContentType: options.contentType,
+		Size:        *input.ContentLength,
+		ETag:        aws.StringValue(s3output.ETag),
+	}, nil
+}
+
+// checkConditions checks the object against WithIfMatch and WithIfAbsent before it is written
+func (s3fs *S3FS) checkConditions(path string, options uploadOptions) error {
+	if options.ifMatch != "" {
+		if err := s3fs.checkETag(path, options.ifMatch); err != nil {
+			return err
+		}
+	}
+	if options.ifAbsent {
+		_, err := s3fs.GetObjectInfo(path)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrAlreadyExists, path)
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkETag compares the etag of the stored object to the expected etag. This sdk predates conditional PutObject,
+// so the check is a HeadObject before the put and a write between the two calls can still be lost
+func (s3fs *S3FS) checkETag(path string, expected string) error {
+	info, err := s3fs.GetObjectInfo(path)
+	if errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("%w: %s does not exist", ErrPreconditionFailed, path)
+	}
+	if err != nil {
+		return err
 	}
-	return &FileOperationOutput{Md5: *s3output.ETag}, nil
+	return checkETag(path, expected, info.ETag)
 }
 
 // DeleteObjects will take one or more paths, and delete them from the s3 file system
-func (s3fs *S3FS) DeleteObjects(path ...string) error {
-	svc := s3.New(s3fs.session)
+func (s3fs *S3FS) DeleteObjects(path ...string) (err error) {
+	defer s3fs.options.observe("DeleteObjects", 0)(&err)
 	objects := make([]*s3.ObjectIdentifier, 0, len(path))
 	for _, p := range path {
 		s3Path := strings.TrimPrefix(p, "/")
@@ -187,33 +646,71 @@ func (s3fs *S3FS) DeleteObjects(path ...string) error {
 		},
 	}
 
-	_, err := svc.DeleteObjects(input)
-	return err
+	output, err := s3fs.svc.DeleteObjects(input)
+	if err != nil {
+		return s3Error(strings.Join(path, ", "), err)
+	}
+	//a batch delete succeeds as a whole while reporting the keys it couldn't delete
+	var errs MultiError
+	for _, e := range output.Errors {
+		keyErr := awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)
+		errs = append(errs, s3Error("/"+aws.StringValue(e.Key), keyErr))
+	}
+	return errs.errorOrNil()
 }
 
-func (s3fs *S3FS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
+func (s3fs *S3FS) InitializeObjectUpload(u UploadConfig) (_ UploadResult, err error) {
+	defer s3fs.options.observe("InitializeObjectUpload", 0)(&err)
 	output := UploadResult{}
-	svc := s3.New(s3fs.session)
 	s3path := u.ObjectPath //@TODO incomplete
 	s3path = strings.TrimPrefix(s3path, "/")
 	input := &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(s3fs.config.S3Bucket),
 		Key:    aws.String(s3path),
 	}
+	//the encryption is set when the upload is created, the parts are encrypted with it without UploadPart naming it again
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.encryption()
+	if u.ACL != "" {
+		if err := validateACL(u.ACL); err != nil {
+			return output, err
+		}
+		input.ACL = aws.String(u.ACL)
+	}
 
-	resp, err := svc.CreateMultipartUpload(input)
+	resp, err := s3fs.svc.CreateMultipartUpload(input)
 	if err != nil {
-		return output, err
+		return output, s3Error(u.ObjectPath, err)
 	}
 	output.ID = *resp.UploadId
 	return output, nil
 }
 
-func (s3fs *S3FS) WriteChunk(u UploadConfig) (UploadResult, error) {
+// Close closes the idle connections of the http client given with WithHTTPClient. Requests made after Close open new connections
+func (s3fs *S3FS) Close() error {
+	if s3fs.options.httpClient != nil {
+		s3fs.options.httpClient.CloseIdleConnections()
+	}
+	return nil
+}
+
+// ChunkSize returns the size in bytes of the chunks written with WriteChunk. S3 allows 10000 parts in an upload,
+// so objects written in chunks can be at most ChunkSize times 10000 bytes. Set S3FSConfig.ChunkSize to write larger objects
+func (s3fs *S3FS) ChunkSize() int64 {
+	return s3fs.chunkSize
+}
+
+func (s3fs *S3FS) WriteChunk(u UploadConfig) (_ UploadResult, err error) {
+	defer s3fs.options.observe("WriteChunk", int64(len(u.Data)))(&err)
 	s3path := u.ObjectPath //@TODO incomplete
 	s3path = strings.TrimPrefix(s3path, "/")
-	svc := s3.New(s3fs.session)
+	if int64(len(u.Data)) > s3fs.chunkSize {
+		return UploadResult{}, fmt.Errorf("chunk %d is %d bytes, larger than the configured chunk size of %d bytes", u.ChunkId, len(u.Data), s3fs.chunkSize)
+	}
 	partNumber := u.ChunkId + 1 //aws chunks are 1 to n, our chunks are 0 referenced
+	if partNumber < 1 || partNumber > s3MaxParts {
+		return UploadResult{}, fmt.Errorf("chunk %d is outside the %d parts s3 allows in an upload, chunks of %d bytes can write objects up to %d bytes",
+			u.ChunkId, s3MaxParts, s3fs.chunkSize, s3fs.chunkSize*s3MaxParts)
+	}
 	partInput := &s3.UploadPartInput{
 		Body:          bytes.NewReader(u.Data),
 		Bucket:        aws.String(s3fs.config.S3Bucket),
@@ -222,10 +719,9 @@ func (s3fs *S3FS) WriteChunk(u UploadConfig) (UploadResult, error) {
 		UploadId:      aws.String(u.UploadId),
 		ContentLength: aws.Int64(int64(len(u.Data))),
 	}
-	result, err := svc.UploadPart(partInput)
-
+	result, err := s3fs.svc.UploadPart(partInput)
 	if err != nil {
-		return UploadResult{}, err
+		return UploadResult{}, s3Error(u.ObjectPath, err)
 	}
 	output := UploadResult{
 		WriteSize: len(u.Data),
@@ -234,10 +730,20 @@ func (s3fs *S3FS) WriteChunk(u UploadConfig) (UploadResult, error) {
 	return output, nil
 }
 
-func (s3fs *S3FS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
+// CompleteObjectUpload validates the chunks against the parts s3 recorded and completes the upload. Completing an upload
+// that s3 already completed, such as a retry after the response to the first completion was lost, succeeds when the
+// object's ETag matches the chunks, since s3 reports the upload as missing once it is complete
+func (s3fs *S3FS) CompleteObjectUpload(u CompletedObjectUploadConfig) (err error) {
+	defer s3fs.options.observe("CompleteObjectUpload", 0)(&err)
 	s3path := u.ObjectPath //@TODO incomplete
 	s3path = strings.TrimPrefix(s3path, "/")
-	svc := s3.New(s3fs.session)
+	if err := s3fs.validateChunks(s3path, u); err != nil {
+		if err := s3fs.alreadyCompleted(s3path, u, err); err != nil {
+			return err
+		}
+		s3fs.options.uploaded(u.ObjectPath, &FileOperationOutput{}, nil)
+		return nil
+	}
 	cp := []*s3.CompletedPart{}
 	for i, cuID := range u.ChunkUploadIds {
 		cp = append(cp, &s3.CompletedPart{
@@ -253,79 +759,1631 @@ func (s3fs *S3FS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
 			Parts: cp,
 		},
 	}
-	_, err := svc.CompleteMultipartUpload(input)
-	return err
+	var s3output *s3.CompleteMultipartUploadOutput
+	err = s3fs.options.retry.do(func() error {
+		var err error
+		s3output, err = s3fs.svc.CompleteMultipartUpload(input)
+		return err
+	})
+	if err != nil {
+		if err := s3fs.alreadyCompleted(s3path, u, err); err != nil {
+			return err
+		}
+		s3fs.options.uploaded(u.ObjectPath, &FileOperationOutput{}, nil)
+		return nil
+	}
+	s3fs.options.uploaded(u.ObjectPath, &FileOperationOutput{
+		ETag:      aws.StringValue(s3output.ETag),
+		Location:  aws.StringValue(s3output.Location),
+		VersionID: aws.StringValue(s3output.VersionId),
+	}, nil)
+	return nil
 }
 
-// Walk will traverse an s3 file system recursively, starting at the provided prefix, and apply the visitorFunction to each s3 object
-func (s3fs *S3FS) Walk(path string, vistorFunction FileVisitFunction) error {
-	s3Path := strings.TrimPrefix(path, "/")
-	s3delim := ""
-	query := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s3fs.config.S3Bucket),
-		Prefix:    aws.String(s3Path),
-		Delimiter: aws.String(s3delim),
+// alreadyCompleted returns nil when err is s3 reporting the upload missing and the object at the key is the result of
+// completing the chunks, which is recognized by its multipart ETag. Otherwise err is returned
+func (s3fs *S3FS) alreadyCompleted(s3path string, u CompletedObjectUploadConfig, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != s3.ErrCodeNoSuchUpload {
+		return err
 	}
-	svc := s3.New(s3fs.session)
-
-	truncatedListing := true
+	expected, etagErr := multipartETag(u.ChunkUploadIds)
+	if etagErr != nil {
+		return err
+	}
+	head, headErr := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3path),
+	})
+	if headErr != nil || strings.Trim(aws.StringValue(head.ETag), `"`) != expected {
+		return err
+	}
+	return nil
+}
 
-	for truncatedListing {
-		resp, err := svc.ListObjectsV2(query)
+// multipartETag computes the ETag s3 gives an object completed from parts with the etags provided,
+// the md5 of the concatenated part md5s followed by the number of parts
+func multipartETag(partETags []string) (string, error) {
+	h := md5.New()
+	for _, etag := range partETags {
+		sum, err := hex.DecodeString(strings.Trim(etag, `"`))
 		if err != nil {
-			return err
+			return "", err
 		}
-		for _, content := range resp.Contents {
-			fileInfo := &S3FileInfo{content}
-			err := vistorFunction("/"+*content.Key, fileInfo)
-			if err != nil {
-				return err
-			}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(partETags)), nil
+}
+
+// validateChunks checks that the chunk etags are contiguous and match the parts s3 has recorded for the upload
+// chunk numbers in the errors are 0 referenced to match UploadConfig.ChunkId
+func (s3fs *S3FS) validateChunks(s3path string, u CompletedObjectUploadConfig) error {
+	total := len(u.ChunkUploadIds)
+	if total == 0 {
+		return errors.New("no chunks provided to complete the upload")
+	}
+	for i, cuID := range u.ChunkUploadIds {
+		if cuID == "" {
+			return fmt.Errorf("missing chunk %d of %d", i, total)
+		}
+	}
+	parts := make(map[int64]*s3.Part)
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(s3fs.config.S3Bucket),
+		Key:      aws.String(s3path),
+		UploadId: aws.String(u.UploadId),
+	}
+	err := s3fs.svc.ListPartsPages(input, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts[*p.PartNumber] = p
+		}
+		return true
+	})
+	if err != nil {
+		return s3Error(s3path, err)
+	}
+	for i, cuID := range u.ChunkUploadIds {
+		part, ok := parts[int64(i+1)]
+		if !ok {
+			return fmt.Errorf("missing chunk %d of %d", i, total)
+		}
+		if *part.ETag != cuID {
+			return fmt.Errorf("chunk %d of %d does not match the uploaded part", i, total)
+		}
+		if i < total-1 && *part.Size < s3MinPartSize {
+			return fmt.Errorf("chunk %d of %d is %d bytes, only the last chunk can be less than %d bytes", i, total, *part.Size, s3MinPartSize)
 		}
-		query.ContinuationToken = resp.NextContinuationToken
-		truncatedListing = *resp.IsTruncated
+	}
+	if len(parts) != total {
+		return fmt.Errorf("upload has %d parts written but %d chunks were provided", len(parts), total)
 	}
 	return nil
 }
 
-/*
-  these functions are not part of the filestore interface and are unique to the S3FS
-*/
-
-// SharedAccessURL will create a presigned url that can be used to access/download an object from an s3 bucket. It will only be valid for the duration specified
-func (s3fs *S3FS) SharedAccessURL(path string, expiration time.Duration) (string, error) {
-	s3Path := strings.TrimPrefix(path, "/")
-	svc := s3.New(s3fs.session)
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3fs.config.S3Bucket),
-		Key:    aws.String(s3Path),
+// CopyPrefix copies every object under the source prefix to the dest prefix, preserving the relative structure.
+// Objects are copied server side and failures are collected into a MultiError so one bad key doesn't stop the copy
+func (s3fs *S3FS) CopyPrefix(source string, dest string, progress CopyProgressFunction) (err error) {
+	defer s3fs.options.observe("CopyPrefix", 0)(&err)
+	sourcePrefix := "/" + strings.Trim(source, "/") + "/"
+	destPrefix := "/" + strings.Trim(dest, "/") + "/"
+	var errs MultiError
+	copied := 0
+	err = s3fs.Walk(sourcePrefix, func(path string, file os.FileInfo) error {
+		destPath := destPrefix + strings.TrimPrefix(path, sourcePrefix)
+		if err := s3fs.CopyObject(path, destPath); err != nil {
+			errs = append(errs, fmt.Errorf("copying %s: %w", path, err))
+			return nil
+		}
+		copied++
+		if progress != nil {
+			progress(path, destPath, copied)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	req, _ := svc.GetObjectRequest(input)
-	return req.Presign(expiration)
+	return errs.errorOrNil()
 }
 
-// SetObjectPublic will change the acl permissions on an s3 object and make it publically readable
-func (s3fs *S3FS) SetObjectPublic(path string) (string, error) {
-	s3Path := strings.TrimPrefix(path, "/")
-	svc := s3.New(s3fs.session)
-	acl := "public-read"
-	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s3fs.config.S3Bucket, s3Path)
-	input := &s3.PutObjectAclInput{
-		Bucket: aws.String(s3fs.config.S3Bucket),
-		Key:    aws.String(s3Path),
-		ACL:    aws.String(acl),
-	}
-	_, err := svc.PutObjectAcl(input)
-	return url, err
+// Upload streams the reader to s3 at the key provided, using a multipart upload for large streams.
+// The content type is detected from the key extension or the start of the stream unless WithContentType is provided.
+// The output has the md5 of the content, computed as it was uploaded since the ETag of a multipart upload isn't an md5,
+// along with the Location of the object and its VersionID in a version enabled bucket. WithCompression, WithIfMatch and
+// WithIfAbsent apply as they do to PutObject
+func (s3fs *S3FS) Upload(reader io.Reader, key string, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer s3fs.options.observeUpload("Upload")(&output, &err)
+	output, err = s3fs.upload(reader, key, s3fs.config.UploadConcurrency, newUploadOptions(opts))
+	s3fs.options.uploaded(key, output, err)
+	return output, err
 }
 
-// Ping makes a cheap call to the s3 bucket to ensure connection
-func (s3fs *S3FS) Ping() error {
-	svc := s3.New(s3fs.session)
-	listInput := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(s3fs.config.S3Bucket),
-		MaxKeys: aws.Int64(1),
-	}
-	_, err := svc.ListObjectsV2(listInput)
+// UploadFile uploads the local file to s3 at the key provided
+func (s3fs *S3FS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return uploadFile(s3fs, filePath, key, opts)
+}
+
+func (s3fs *S3FS) upload(reader io.Reader, key string, concurrency int, options uploadOptions) (*FileOperationOutput, error) {
+	s3Path := strings.TrimPrefix(key, "/")
+	if options.acl != "" {
+		if err := validateACL(options.acl); err != nil {
+			return nil, err
+		}
+	}
+	if options.retention != nil {
+		if err := validateRetentionMode(options.retention.mode); err != nil {
+			return nil, err
+		}
+	}
+	if options.checksum != "" {
+		return nil, fmt.Errorf("%w: checksums on a multipart upload", ErrNotSupported)
+	}
+	if err := s3fs.checkConditions(key, options); err != nil {
+		return nil, err
+	}
+	reader, hashing, err := prepareUpload(reader, key, &options, s3fs.options)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s3fs.config.S3Bucket),
+		Key:         aws.String(s3Path),
+		Body:        reader,
+		ContentType: aws.String(options.contentType),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.encryption()
+	if options.acl != "" {
+		input.ACL = aws.String(options.acl)
+	}
+	if options.compress {
+		input.ContentEncoding = aws.String(gzipEncoding)
+	}
+	if !options.expires.IsZero() {
+		input.Expires = aws.Time(options.expires)
+	}
+	if len(options.tags) > 0 {
+		input.Tagging = aws.String(encodeTags(options.tags))
+	}
+	output, err := s3fs.uploader.Upload(input, func(u *s3manager.Uploader) {
+		if concurrency > 0 {
+			u.Concurrency = concurrency
+		}
+	})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	if options.retention != nil {
+		//the uploader doesn't send the Content-MD5 each part would need, so the retention is set once the object exists
+		_, err = s3fs.svc.PutObjectRetention(&s3.PutObjectRetentionInput{
+			Bucket:    aws.String(s3fs.config.S3Bucket),
+			Key:       aws.String(s3Path),
+			VersionId: output.VersionID,
+			Retention: &s3.ObjectLockRetention{
+				Mode:            aws.String(options.retention.mode),
+				RetainUntilDate: aws.Time(options.retention.until),
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("setting the retention of %s: %w", key, s3Error(key, err))
+		}
+	}
+	return &FileOperationOutput{
+		Md5:         hashing.md5(),
+		ContentType: options.contentType,
+		Size:        hashing.size,
+		Location:    output.Location,
+		VersionID:   aws.StringValue(output.VersionID),
+	}, nil
+}
+
+// Glob returns the objects and directories matching the pattern, using the syntax of path.Match. The keys under the
+// pattern's leading literal prefix are listed and matched, so a pattern that starts with a wildcard lists the whole bucket
+func (s3fs *S3FS) Glob(pattern string) (_ []FileStoreResultObject, err error) {
+	defer s3fs.options.observe("Glob", 0)(&err)
+	pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	segments := strings.Count(pattern, "/") + 1
+	query := &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s3fs.config.S3Bucket),
+		Prefix:     aws.String(prefix),
+		FetchOwner: aws.Bool(s3fs.config.FetchOwner),
+	}
+	objects := []FileStoreResultObject{}
+	dirs := make(map[string]bool)
+	err = s3fs.svc.ListObjectsV2Pages(query, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			parts := strings.Split(key, "/")
+			if len(parts) > segments {
+				//a wildcard can match a directory, which only exists as the prefix of the keys under it
+				dir := strings.Join(parts[:segments], "/")
+				if match, _ := path.Match(pattern, dir); match && !dirs[dir] {
+					dirs[dir] = true
+					objects = append(objects, s3DirResult(len(objects), dir))
+				}
+				continue
+			}
+			if match, _ := path.Match(pattern, key); match && len(parts) == segments {
+				objects = append(objects, s3ObjectResult(len(objects), object))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(pattern, err)
+	}
+	sortResults(objects)
+	return objects, nil
+}
+
+// Walk will traverse an s3 file system recursively, starting at the provided prefix, and apply the visitorFunction to each s3 object.
+// The walk stops at the first error returned by the visitor and returns it, the same as BlockFS.Walk
+func (s3fs *S3FS) Walk(path string, vistorFunction FileVisitFunction) error {
+	return s3fs.WalkContext(context.Background(), path, vistorFunction)
+}
+
+// WalkContext is Walk with cancellation. The context is checked between pages and between objects, and ctx.Err() is returned
+// as soon as it is cancelled. The visitor can return ErrStopWalk to end the walk early without an error
+func (s3fs *S3FS) WalkContext(ctx context.Context, path string, vistorFunction FileVisitFunction) (err error) {
+	defer s3fs.options.observe("WalkContext", 0)(&err)
+	return s3fs.walk(ctx, path, "", vistorFunction)
+}
+
+// WalkAfter is Walk starting after the key startAfter, which s3 skips to without listing the keys before it
+func (s3fs *S3FS) WalkAfter(path string, startAfter string, vistorFunction FileVisitFunction) (err error) {
+	defer s3fs.options.observe("WalkAfter", 0)(&err)
+	return s3fs.walk(context.Background(), path, startAfter, vistorFunction)
+}
+
+func (s3fs *S3FS) walk(ctx context.Context, path string, startAfter string, vistorFunction FileVisitFunction) error {
+	s3Path := strings.TrimPrefix(path, "/")
+	s3delim := ""
+	query := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s3fs.config.S3Bucket),
+		Prefix:    aws.String(s3Path),
+		Delimiter: aws.String(s3delim),
+	}
+	if startAfter != "" {
+		query.StartAfter = aws.String(strings.TrimPrefix(startAfter, "/"))
+	}
+
+	truncatedListing := true
+
+	for truncatedListing {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		resp, err := s3fs.svc.ListObjectsV2WithContext(ctx, query)
+		if err != nil {
+			return s3Error(path, err)
+		}
+		for _, content := range resp.Contents {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fileInfo := &S3FileInfo{content}
+			err := vistorFunction("/"+*content.Key, fileInfo)
+			if errors.Is(err, ErrStopWalk) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		query.ContinuationToken = resp.NextContinuationToken
+		truncatedListing = *resp.IsTruncated
+	}
+	return nil
+}
+
+// WalkDir will traverse an s3 file system recursively, emulating directories with the common prefixes under each "/" delimited level.
+// Returning filepath.SkipDir from the visitor for a directory skips that prefix, and for an object skips the rest of its directory
+func (s3fs *S3FS) WalkDir(path string, visitorFunction WalkDirFunction) (err error) {
+	defer s3fs.options.observe("WalkDir", 0)(&err)
+	s3Path := strings.Trim(path, "/")
+	if s3Path != "" {
+		s3Path += "/"
+	}
+	err = s3fs.walkDir(s3Path, visitorFunction)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (s3fs *S3FS) walkDir(prefix string, visitorFunction WalkDirFunction) error {
+	query := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s3fs.config.S3Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	truncatedListing := true
+
+	for truncatedListing {
+		resp, err := s3fs.svc.ListObjectsV2(query)
+		if err != nil {
+			return s3Error(prefix, err)
+		}
+		for _, cp := range resp.CommonPrefixes {
+			dirInfo := &S3DirInfo{prefix: aws.StringValue(cp.Prefix)}
+			err := visitorFunction("/"+*cp.Prefix, dirInfo, true)
+			if err == filepath.SkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = s3fs.walkDir(*cp.Prefix, visitorFunction)
+			if err != nil {
+				return err
+			}
+		}
+		for _, content := range resp.Contents {
+			if *content.Key == prefix {
+				continue
+			}
+			err := visitorFunction("/"+*content.Key, &S3FileInfo{content}, false)
+			if err == filepath.SkipDir {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		query.ContinuationToken = resp.NextContinuationToken
+		truncatedListing = *resp.IsTruncated
+	}
+	return nil
+}
+
+// objectOwner returns the display name of the owner, falling back to the canonical id when s3 doesn't return a name
+func objectOwner(owner *s3.Owner) string {
+	if owner == nil {
+		return ""
+	}
+	if name := aws.StringValue(owner.DisplayName); name != "" {
+		return name
+	}
+	return aws.StringValue(owner.ID)
+}
+
+// Append adds the data to the end of the object, creating it when it doesn't exist. S3 objects can't be modified, so every
+// append rewrites the whole object and costs more the larger the object gets. After a HeadObject and a GetObjectTagging,
+// objects under 5MB are downloaded, extended and put again. Larger objects aren't downloaded, they are copied server side
+// into a multipart upload with an UploadPartCopy per 1GB, followed by an UploadPart of the data. Either way the content
+// headers, user metadata, tags and encryption of the object are kept. Concurrent appends to the same object can be lost.
+// Objects written with WithCompression can't be appended to
+func (s3fs *S3FS) Append(path string, data []byte) (err error) {
+	defer s3fs.options.observe("Append", int64(len(data)))(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		err = s3Error(path, err)
+		if errors.Is(err, ErrObjectNotFound) {
+			_, err = s3fs.PutObject(path, data)
+		}
+		return err
+	}
+	if aws.StringValue(head.ContentEncoding) == gzipEncoding {
+		return fmt.Errorf("%w: appending to the compressed object %s", ErrNotSupported, path)
+	}
+	tagging, err := s3fs.objectTagging(path)
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(head.ContentLength) < s3MinPartSize {
+		return s3fs.appendPut(path, head, tagging, data)
+	}
+	return s3fs.appendMultipart(path, head, tagging, data)
+}
+
+// appendPut rewrites a small object with a put of its content followed by the data, keeping the attributes in head
+func (s3fs *S3FS) appendPut(path string, head *s3.HeadObjectOutput, tagging *string, data []byte) error {
+	existing, err := GetObjectBytes(s3fs, path, 0)
+	if err != nil {
+		return err
+	}
+	content := append(existing, data...)
+	sum := md5.Sum(content)
+	input := &s3.PutObjectInput{
+		Bucket:             aws.String(s3fs.config.S3Bucket),
+		Key:                aws.String(strings.TrimPrefix(path, "/")),
+		Body:               bytes.NewReader(content),
+		ContentLength:      aws.Int64(int64(len(content))),
+		ContentMD5:         aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		Metadata:           head.Metadata,
+		StorageClass:       head.StorageClass,
+		Tagging:            tagging,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	_, err = s3fs.svc.PutObject(input)
+	return s3Error(path, err)
+}
+
+// appendMultipart rewrites the object as a multipart upload of a server side copy of the object followed by the data,
+// keeping the attributes in head
+func (s3fs *S3FS) appendMultipart(path string, head *s3.HeadObjectOutput, tagging *string, data []byte) error {
+	s3Path := strings.TrimPrefix(path, "/")
+	bucket := s3fs.config.S3Bucket
+	input := copyUploadInput(head, bucket, s3Path)
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	input.Tagging = tagging
+	upload, err := s3fs.svc.CreateMultipartUpload(input)
+	if err != nil {
+		return s3Error(path, err)
+	}
+	parts, err := s3fs.copyParts(bucket+"/"+s3Path, aws.Int64Value(head.ContentLength), bucket, s3Path, upload.UploadId, 1)
+	if err == nil {
+		partNumber := aws.Int64(int64(len(parts) + 1))
+		var uploaded *s3.UploadPartOutput
+		uploaded, err = s3fs.svc.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(bucket),
+			Key:           aws.String(s3Path),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+			PartNumber:    partNumber,
+			UploadId:      upload.UploadId,
+		})
+		if err == nil {
+			parts = append(parts, &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: partNumber})
+		}
+	}
+	if err == nil {
+		_, err = s3fs.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(s3Path),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		s3fs.abortUpload(bucket, s3Path, upload.UploadId)
+		return s3Error(path, err)
+	}
+	return nil
+}
+
+// CreateDir puts a zero byte object with a trailing slash at path, which the s3 console and other tools show as a folder
+func (s3fs *S3FS) CreateDir(path string) error {
+	_, err := s3fs.PutObject(strings.TrimSuffix(path, "/")+"/", nil)
+	return err
+}
+
+// CreateEmptyObject puts an empty object at path, replacing the object if it already exists
+func (s3fs *S3FS) CreateEmptyObject(path string) error {
+	_, err := s3fs.PutObject(path, nil)
+	return err
+}
+
+// Touch refreshes the LastModified time of the object, creating an empty object when it doesn't exist. S3 can't change
+// LastModified directly, so the object is copied over itself, replacing the metadata with its current values so the content
+// type, encoding, user metadata and storage class are kept. The copy is encrypted like CopyObject, with the encryption
+// configured for the store or else the encryption of the object. Objects over 5GB are copied with a multipart upload,
+// which also keeps their tags. A copy doesn't keep the ACL of the object, so the touched object is private, and an object
+// made public with SetObjectPublic has to be made public again
+func (s3fs *S3FS) Touch(path string) (err error) {
+	defer s3fs.options.observe("Touch", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		err = s3Error(path, err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return s3fs.CreateEmptyObject(path)
+		}
+		return err
+	}
+	if aws.Int64Value(head.ContentLength) > s3MaxCopyPartSize {
+		return s3fs.copyMultipart(path, head, s3fs.config.S3Bucket, s3Path)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(s3fs.config.S3Bucket),
+		CopySource:         aws.String(url.PathEscape(s3fs.config.S3Bucket + "/" + s3Path)),
+		Key:                aws.String(s3Path),
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		Metadata:           head.Metadata,
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		StorageClass:       head.StorageClass,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	_, err = s3fs.svc.CopyObject(input)
+	return s3Error(path, err)
+}
+
+// encryption returns the configured server side encryption and KMS key for a write, nil when they aren't set
+func (s3fs *S3FS) encryption() (*string, *string) {
+	var sse, kmsKey *string
+	if s3fs.config.ServerSideEncryption != "" {
+		sse = aws.String(s3fs.config.ServerSideEncryption)
+	}
+	if s3fs.config.SSEKMSKeyId != "" {
+		kmsKey = aws.String(s3fs.config.SSEKMSKeyId)
+	}
+	return sse, kmsKey
+}
+
+// encodeTags encodes the tags as the url query that the Tagging field of an upload takes
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// cannedACLs are the canned ACLs s3 accepts on objects
+var cannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+// validateACL checks the acl is a canned ACL before it is sent, rather than letting s3 reject the upload after the body is read
+func validateACL(acl string) error {
+	for _, canned := range cannedACLs {
+		if acl == canned {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid acl %q, expected one of %s", acl, strings.Join(cannedACLs, ", "))
+}
+
+// s3Error translates s3 error codes into the package errors so callers don't need to inspect aws errors
+func s3Error(path string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return &NotFoundError{Path: path, Err: err}
+		case "AccessDenied", "Forbidden":
+			return &AccessDeniedError{Path: path, Err: err}
+		}
+	}
+	return err
+}
+
+/*
+  these functions are not part of the filestore interface and are unique to the S3FS
+*/
+
+// SharedAccessURL will create a presigned url that can be used to access/download an object from an s3 bucket. It will only be valid for the duration specified.
+// WithContentDisposition and WithResponseContentType override the headers returned with the download.
+// The url is signed with SigV4 for the region of the client, which SSE-KMS encrypted objects require. Fetching a KMS encrypted
+// object also needs kms:Decrypt on the key for the credentials that signed the url, and the url must be fetched over https
+func (s3fs *S3FS) SharedAccessURL(path string, expiration time.Duration, opts ...PresignOption) (string, error) {
+	url, headers, err := s3fs.SharedAccessRequest(path, expiration, opts...)
+	if err != nil {
+		return "", err
+	}
+	if len(headers) > 0 {
+		//a bare url can't carry signed headers, so fetching it would fail the signature check
+		return "", fmt.Errorf("presigning %s: the url must be sent with signed headers, use SharedAccessRequest", path)
+	}
+	return url, nil
+}
+
+// SharedAccessRequest creates a presigned url like SharedAccessURL and also returns the headers that were signed with it,
+// which must be sent with the request for the signature to match
+func (s3fs *S3FS) SharedAccessRequest(path string, expiration time.Duration, opts ...PresignOption) (string, http.Header, error) {
+	if expiration <= 0 || expiration > s3MaxPresignExpiration {
+		return "", nil, fmt.Errorf("presign expiration %s must be more than zero and no more than %s", expiration, s3MaxPresignExpiration)
+	}
+	options := newPresignOptions(opts)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	}
+	if options.contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(options.contentDisposition)
+	}
+	if options.contentType != "" {
+		input.ResponseContentType = aws.String(options.contentType)
+	}
+	req, _ := s3fs.svc.GetObjectRequest(input)
+	if aws.StringValue(req.Config.Region) == "" {
+		//SigV4 signatures are scoped to a region, without one the url is rejected
+		return "", nil, fmt.Errorf("%w: presigning %s needs the region of the bucket", ErrUnsupportedConfig, path)
+	}
+	return req.PresignRequest(expiration)
+}
+
+// SharedAccessHeadURL creates a presigned url for a HEAD request of the object, so a client can check that it exists and
+// read its Content-Length and ETag without downloading it. The url is only valid for HEAD requests, for the duration specified
+func (s3fs *S3FS) SharedAccessHeadURL(path string, expiration time.Duration) (string, error) {
+	if expiration <= 0 || expiration > s3MaxPresignExpiration {
+		return "", fmt.Errorf("presign expiration %s must be more than zero and no more than %s", expiration, s3MaxPresignExpiration)
+	}
+	req, _ := s3fs.svc.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+	})
+	if aws.StringValue(req.Config.Region) == "" {
+		//SigV4 signatures are scoped to a region, without one the url is rejected
+		return "", fmt.Errorf("%w: presigning %s needs the region of the bucket", ErrUnsupportedConfig, path)
+	}
+	return req.Presign(expiration)
+}
+
+// SharedAccessURLs creates a presigned url for each path, returning a map of path to url. Presigning is done locally,
+// so the urls are signed sequentially. Paths that fail to sign are left out of the map and their errors returned in a MultiError
+func (s3fs *S3FS) SharedAccessURLs(paths []string, expiration time.Duration, opts ...PresignOption) (map[string]string, error) {
+	urls := make(map[string]string, len(paths))
+	var errs MultiError
+	for _, p := range paths {
+		url, err := s3fs.SharedAccessURL(p, expiration, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("presigning %s: %w", p, err))
+			continue
+		}
+		urls[p] = url
+	}
+	return urls, errs.errorOrNil()
+}
+
+// SetObjectPublic will change the acl permissions on an s3 object and make it publically readable
+func (s3fs *S3FS) SetObjectPublic(path string) (_ string, err error) {
+	defer s3fs.options.observe("SetObjectPublic", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	acl := "public-read"
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s3fs.config.S3Bucket, s3Path)
+	input := &s3.PutObjectAclInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+		ACL:    aws.String(acl),
+	}
+	_, err = s3fs.svc.PutObjectAcl(input)
+	return url, err
+}
+
+// PutLargeObject streams the reader to s3 at the key provided, uploading parts in parallel.
+// A concurrency of zero or less falls back to the UploadConcurrency in the config
+func (s3fs *S3FS) PutLargeObject(reader io.Reader, key string, concurrency int, opts ...UploadOption) (err error) {
+	defer s3fs.options.observe("PutLargeObject", 0)(&err)
+	if concurrency <= 0 {
+		concurrency = s3fs.config.UploadConcurrency
+	}
+	_, err = s3fs.upload(reader, key, concurrency, newUploadOptions(opts))
 	return err
 }
+
+// PutObjectStream streams the reader to s3 at the key provided without buffering it, returning the md5 of the content.
+// It is the same as Upload, with the arguments in the order of PutObject
+func (s3fs *S3FS) PutObjectStream(key string, reader io.Reader, opts ...UploadOption) (*FileOperationOutput, error) {
+	return s3fs.Upload(reader, key, opts...)
+}
+
+// CopyObject will copy an object to a new path in the same bucket, without downloading it
+func (s3fs *S3FS) CopyObject(source string, dest string) (err error) {
+	defer s3fs.options.observe("CopyObject", 0)(&err)
+	return s3fs.copyObject(source, s3fs.config.S3Bucket, dest)
+}
+
+// CopyObjectWithMetadata copies the object to dest, replacing its user metadata and content type with the ones given
+// instead of keeping those of the source. Copying an object onto itself fixes its metadata in place. An empty contentType
+// is taken from the dest key extension, and left to the s3 default when the extension isn't known. The other content
+// headers and the encryption of the source are kept, and objects larger than 5GB are copied like CopyObject copies them
+func (s3fs *S3FS) CopyObjectWithMetadata(source string, dest string, metadata map[string]string, contentType string) (err error) {
+	defer s3fs.options.observe("CopyObjectWithMetadata", 0)(&err)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(dest))
+	}
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(source, "/")),
+	})
+	if err != nil {
+		return s3Error(source, err)
+	}
+	//a REPLACE copy drops every header it isn't sent, so the replaced head carries the content headers of the source
+	replaced := *head
+	replaced.Metadata = aws.StringMap(metadata)
+	replaced.ContentType = nil
+	if contentType != "" {
+		replaced.ContentType = aws.String(contentType)
+	}
+	if aws.Int64Value(head.ContentLength) > s3MaxCopyPartSize {
+		return s3fs.copyMultipart(source, &replaced, s3fs.config.S3Bucket, strings.TrimPrefix(dest, "/"))
+	}
+	copySource := s3fs.config.S3Bucket + "/" + strings.TrimPrefix(source, "/")
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(s3fs.config.S3Bucket),
+		CopySource:         aws.String(url.PathEscape(copySource)),
+		Key:                aws.String(strings.TrimPrefix(dest, "/")),
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		Metadata:           replaced.Metadata,
+		ContentType:        replaced.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		Expires:            headExpires(head),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	_, err = s3fs.svc.CopyObject(input)
+	return s3Error(source, err)
+}
+
+// CopyObjectToBucket will copy an object to a path in another bucket, without downloading it.
+// The credentials for the store must have access to both buckets. Objects larger than 5GB, the most a single copy can take,
+// are copied server side in 1GB parts with a multipart upload that keeps the content headers, user metadata and tags
+func (s3fs *S3FS) CopyObjectToBucket(source string, destBucket string, dest string) (err error) {
+	defer s3fs.options.observe("CopyObjectToBucket", 0)(&err)
+	return s3fs.copyObject(source, destBucket, dest)
+}
+
+func (s3fs *S3FS) copyObject(source string, destBucket string, dest string) error {
+	copySource := s3fs.config.S3Bucket + "/" + strings.TrimPrefix(source, "/")
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(source, "/")),
+	})
+	if err != nil {
+		return s3Error(source, err)
+	}
+	if aws.Int64Value(head.ContentLength) > s3MaxCopyPartSize {
+		return s3fs.copyMultipart(source, head, destBucket, strings.TrimPrefix(dest, "/"))
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(destBucket),
+		CopySource: aws.String(url.PathEscape(copySource)),
+		Key:        aws.String(strings.TrimPrefix(dest, "/")),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	_, err = s3fs.svc.CopyObject(input)
+	return s3Error(source, err)
+}
+
+// copyMultipart copies the source to the dest key with a multipart upload of UploadPartCopy ranges. A multipart upload
+// doesn't copy the attributes of the source the way CopyObject does, so they are set on the upload from the head of the
+// source and its tags
+func (s3fs *S3FS) copyMultipart(source string, head *s3.HeadObjectOutput, destBucket string, destKey string) error {
+	input := copyUploadInput(head, destBucket, destKey)
+	input.ServerSideEncryption, input.SSEKMSKeyId = s3fs.copyEncryption(head)
+	tagging, err := s3fs.objectTagging(source)
+	if err != nil {
+		return err
+	}
+	input.Tagging = tagging
+	upload, err := s3fs.svc.CreateMultipartUpload(input)
+	if err != nil {
+		return s3Error(destKey, err)
+	}
+	copySource := s3fs.config.S3Bucket + "/" + strings.TrimPrefix(source, "/")
+	parts, err := s3fs.copyParts(copySource, aws.Int64Value(head.ContentLength), destBucket, destKey, upload.UploadId, 1)
+	if err == nil {
+		_, err = s3fs.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(destBucket),
+			Key:             aws.String(destKey),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		//parts of an upload that isn't completed or aborted are stored, and billed, until a lifecycle rule removes them
+		s3fs.abortUpload(destBucket, destKey, upload.UploadId)
+		return s3Error(source, err)
+	}
+	return nil
+}
+
+// copyUploadInput returns the input of a multipart upload to the key that keeps the content headers, user metadata and
+// storage class of the object in head
+func copyUploadInput(head *s3.HeadObjectOutput, bucket string, key string) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(key),
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		Expires:            headExpires(head),
+		Metadata:           head.Metadata,
+		StorageClass:       head.StorageClass,
+	}
+}
+
+// headExpires returns the Expires header of the object in head, or nil when it has none or it isn't a valid date
+func headExpires(head *s3.HeadObjectOutput) *time.Time {
+	expires, err := http.ParseTime(aws.StringValue(head.Expires))
+	if err != nil {
+		return nil
+	}
+	return &expires
+}
+
+// copyEncryption returns the encryption of a copy of the object in head: the encryption configured for the store, or the
+// encryption of the source when none is configured, since a copy is only encrypted when asked to be
+func (s3fs *S3FS) copyEncryption(head *s3.HeadObjectOutput) (*string, *string) {
+	sse, kmsKey := s3fs.encryption()
+	if sse != nil || head.ServerSideEncryption == nil {
+		return sse, kmsKey
+	}
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return head.ServerSideEncryption, head.SSEKMSKeyId
+	}
+	return head.ServerSideEncryption, nil
+}
+
+// copyParts adds size bytes of the copy source to the multipart upload as UploadPartCopy parts of about 1GB, numbered
+// from firstPart. A remainder smaller than the s3 minimum part size is copied with the part before it, so more parts can
+// follow the copied ones
+func (s3fs *S3FS) copyParts(copySource string, size int64, bucket string, key string, uploadID *string, firstPart int64) ([]*s3.CompletedPart, error) {
+	var parts []*s3.CompletedPart
+	for offset := int64(0); offset < size; offset += s3CopyPartSize {
+		last := offset + s3CopyPartSize - 1
+		if last >= size || size-last-1 < s3MinPartSize {
+			last = size - 1
+		}
+		partNumber := aws.Int64(firstPart + int64(len(parts)))
+		copied, err := s3fs.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			CopySource:      aws.String(url.PathEscape(copySource)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+			PartNumber:      partNumber,
+			UploadId:        uploadID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: partNumber})
+		if last == size-1 {
+			break
+		}
+	}
+	return parts, nil
+}
+
+// objectTagging returns the tags of the object encoded for the Tagging field of a write, or nil when it has none
+func (s3fs *S3FS) objectTagging(path string) (*string, error) {
+	tags, err := s3fs.GetObjectTags(path)
+	if err != nil || len(tags) == 0 {
+		return nil, err
+	}
+	return aws.String(encodeTags(tags)), nil
+}
+
+// abortUpload aborts the multipart upload so its parts are removed. It is called after a failure, so its own error is
+// ignored in favor of the error that caused it
+func (s3fs *S3FS) abortUpload(bucket string, key string, uploadID *string) {
+	s3fs.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+}
+
+// GetObjectVerifiedETag fetches the ETag of the object and returns the body wrapped in a reader that verifies it on Close.
+// ETags of multipart uploads and of SSE-KMS encrypted objects aren't an md5 of the content, and the ETag of an object
+// written with WithCompression is the md5 of the compressed bytes rather than of the decompressed body, so those objects
+// are returned without verification
+func (s3fs *S3FS) GetObjectVerifiedETag(path string) (io.ReadCloser, error) {
+	s3Path := strings.TrimPrefix(path, "/")
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	etag := strings.Trim(aws.StringValue(head.ETag), "\"")
+	if etag == "" || strings.Contains(etag, "-") || aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms ||
+		aws.StringValue(head.ContentEncoding) == gzipEncoding {
+		return s3fs.GetObject(path)
+	}
+	return GetObjectVerified(s3fs, path, etag)
+}
+
+// Ping checks that the bucket exists and the credentials can access it with a HeadBucket call, so a startup probe can fail fast
+func (s3fs *S3FS) Ping() (err error) {
+	defer s3fs.options.observe("Ping", 0)(&err)
+	input := &s3.HeadBucketInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+	}
+	_, err = s3fs.svc.HeadBucket(input)
+	if err != nil {
+		return fmt.Errorf("bucket %s is not reachable: %w", s3fs.config.S3Bucket, err)
+	}
+	return nil
+}
+
+// PrefixExists reports whether any object, including a directory marker, exists under the prefix
+func (s3fs *S3FS) PrefixExists(prefix string) (_ bool, err error) {
+	defer s3fs.options.observe("PrefixExists", 0)(&err)
+	keys, err := s3fs.prefixKeys(prefix, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(keys) > 0, nil
+}
+
+// PrefixEmpty reports whether there are no objects under the prefix other than its directory marker.
+// A prefix that doesn't exist is empty
+func (s3fs *S3FS) PrefixEmpty(prefix string) (_ bool, err error) {
+	defer s3fs.options.observe("PrefixEmpty", 0)(&err)
+	keys, err := s3fs.prefixKeys(prefix, 2)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key != dirPrefix(prefix) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// prefixKeys lists up to maxKeys keys under the prefix
+func (s3fs *S3FS) prefixKeys(prefix string, maxKeys int64) ([]string, error) {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s3fs.config.S3Bucket),
+		Prefix:  aws.String(dirPrefix(prefix)),
+		MaxKeys: aws.Int64(maxKeys),
+	}
+	output, err := s3fs.svc.ListObjectsV2(listInput)
+	if err != nil {
+		return nil, s3Error(prefix, err)
+	}
+	keys := make([]string, len(output.Contents))
+	for i, object := range output.Contents {
+		keys[i] = aws.StringValue(object.Key)
+	}
+	return keys, nil
+}
+
+// dirPrefix converts a directory path to the s3 prefix of the objects in it
+func dirPrefix(dirPath string) string {
+	prefix := strings.Trim(dirPath, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// GetObjectVersion returns a reader for a specific version of an object in a version enabled bucket. The caller must close it.
+// The body is read like GetObject, decompressing a version written with WithCompression under the bandwidth limit
+func (s3fs *S3FS) GetObjectVersion(path string, versionID string) (reader io.ReadCloser, err error) {
+	defer s3fs.options.observeRead("GetObjectVersion")(&reader, &err)
+	return s3fs.getObject(path, &s3.GetObjectInput{
+		Bucket:    aws.String(s3fs.config.S3Bucket),
+		Key:       aws.String(strings.TrimPrefix(path, "/")),
+		VersionId: aws.String(versionID),
+	})
+}
+
+// ListObjectVersions lists every version of the objects under the path, paging through the results.
+// Delete markers are not included
+func (s3fs *S3FS) ListObjectVersions(path string) (_ []ObjectVersion, err error) {
+	defer s3fs.options.observe("ListObjectVersions", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Prefix: aws.String(s3Path),
+	}
+	versions := []ObjectVersion{}
+	err = s3fs.svc.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			versions = append(versions, ObjectVersion{
+				Key:       "/" + aws.StringValue(v.Key),
+				VersionID: aws.StringValue(v.VersionId),
+				IsLatest:  aws.BoolValue(v.IsLatest),
+				Size:      aws.Int64Value(v.Size),
+				ModTime:   aws.TimeValue(v.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	return versions, nil
+}
+
+// WalkVersions visits every version of the objects under the path along with the delete markers, paging through the
+// results. Entries are visited by key and, for each key, from the newest to the oldest. Delete markers have a size of zero.
+// The visitor can return ErrStopWalk to end the walk early without an error
+func (s3fs *S3FS) WalkVersions(path string, visitorFunction VersionVisitFunction) (err error) {
+	defer s3fs.options.observe("WalkVersions", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Prefix: aws.String(s3Path),
+	}
+	type entry struct {
+		object       *s3.Object
+		versionID    string
+		deleteMarker bool
+	}
+	var visitErr error
+	err = s3fs.svc.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		//s3 lists the versions and the delete markers of a page separately, so they are merged back into key order
+		entries := make([]entry, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for _, v := range page.Versions {
+			entries = append(entries, entry{
+				object: &s3.Object{
+					Key:          v.Key,
+					Size:         v.Size,
+					LastModified: v.LastModified,
+					ETag:         v.ETag,
+					StorageClass: v.StorageClass,
+				},
+				versionID: aws.StringValue(v.VersionId),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			entries = append(entries, entry{
+				object: &s3.Object{
+					Key:          m.Key,
+					Size:         aws.Int64(0),
+					LastModified: m.LastModified,
+				},
+				versionID:    aws.StringValue(m.VersionId),
+				deleteMarker: true,
+			})
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			ki, kj := aws.StringValue(entries[i].object.Key), aws.StringValue(entries[j].object.Key)
+			if ki != kj {
+				return ki < kj
+			}
+			return aws.TimeValue(entries[i].object.LastModified).After(aws.TimeValue(entries[j].object.LastModified))
+		})
+		for _, e := range entries {
+			visitErr = visitorFunction("/"+aws.StringValue(e.object.Key), e.versionID, e.deleteMarker, &S3FileInfo{e.object})
+			if visitErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return s3Error(path, err)
+	}
+	if errors.Is(visitErr, ErrStopWalk) {
+		return nil
+	}
+	return visitErr
+}
+
+// DeleteObjectVersion permanently deletes a specific version of an object. An empty versionID deletes the current
+// version as DeleteObjects does, which adds a delete marker in a version enabled bucket
+func (s3fs *S3FS) DeleteObjectVersion(path string, versionID string) (err error) {
+	defer s3fs.options.observe("DeleteObjectVersion", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	_, err = s3fs.svc.DeleteObject(input)
+	return s3Error(path, err)
+}
+
+// GetObjectRange returns a reader for length bytes of the object starting at offset. The caller must close it.
+// A range of an object written with WithCompression can't be decompressed on its own, so those objects return ErrNotSupported
+func (s3fs *S3FS) GetObjectRange(path string, offset int64, length int64) (reader io.ReadCloser, err error) {
+	defer s3fs.options.observeRead("GetObjectRange")(&reader, &err)
+	output, err := s3fs.getObjectRange(path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(output.ContentEncoding) == gzipEncoding {
+		output.Body.Close()
+		return nil, fmt.Errorf("%w: ranges of the compressed object %s", ErrNotSupported, path)
+	}
+	return output.Body, nil
+}
+
+func (s3fs *S3FS) getObjectRange(path string, offset int64, length int64) (*s3.GetObjectOutput, error) {
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	var output *s3.GetObjectOutput
+	err := s3fs.options.retry.do(func() error {
+		var err error
+		output, err = s3fs.svc.GetObject(input)
+		return err
+	})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	output.Body = s3fs.options.limitReadCloser(output.Body)
+	return output, nil
+}
+
+// GetObjectIfModifiedSince returns the object when it was modified after since. When it wasn't, s3 answers 304 Not Modified
+// and the reader is nil with modified false. The caller must close the reader when it is returned
+func (s3fs *S3FS) GetObjectIfModifiedSince(path string, since time.Time) (reader io.ReadCloser, _ bool, err error) {
+	defer s3fs.options.observeRead("GetObjectIfModifiedSince")(&reader, &err)
+	s3Path := strings.TrimPrefix(path, "/")
+	input := &s3.GetObjectInput{
+		Bucket:          aws.String(s3fs.config.S3Bucket),
+		Key:             aws.String(s3Path),
+		IfModifiedSince: aws.Time(since),
+	}
+	var output *s3.GetObjectOutput
+	err = s3fs.options.retry.do(func() error {
+		var err error
+		output, err = s3fs.svc.GetObject(input)
+		return err
+	})
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotModified {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, s3Error(path, err)
+	}
+	body := s3fs.options.limitReadCloser(output.Body)
+	if aws.StringValue(output.ContentEncoding) == gzipEncoding {
+		body, err := newGzipReadCloser(body)
+		return body, err == nil, err
+	}
+	return body, true, nil
+}
+
+// PutObjectRetention protects the object with s3 Object Lock until the time given. The mode is GOVERNANCE, which users with
+// the s3:BypassGovernanceRetention permission can override, or COMPLIANCE, which nobody can shorten or remove.
+// The bucket must have Object Lock enabled
+func (s3fs *S3FS) PutObjectRetention(path string, mode string, until time.Time) (err error) {
+	defer s3fs.options.observe("PutObjectRetention", 0)(&err)
+	if err := validateRetentionMode(mode); err != nil {
+		return err
+	}
+	input := &s3.PutObjectRetentionInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+		Retention: &s3.ObjectLockRetention{
+			Mode:            aws.String(mode),
+			RetainUntilDate: aws.Time(until),
+		},
+	}
+	_, err = s3fs.svc.PutObjectRetention(input)
+	return s3Error(path, err)
+}
+
+// PutObjectLegalHold places or removes a legal hold on the object, which prevents it from being deleted or overwritten
+// until the hold is removed, independent of any retention period
+func (s3fs *S3FS) PutObjectLegalHold(path string, on bool) (err error) {
+	defer s3fs.options.observe("PutObjectLegalHold", 0)(&err)
+	status := s3.ObjectLockLegalHoldStatusOff
+	if on {
+		status = s3.ObjectLockLegalHoldStatusOn
+	}
+	input := &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(s3fs.config.S3Bucket),
+		Key:       aws.String(strings.TrimPrefix(path, "/")),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(status)},
+	}
+	_, err = s3fs.svc.PutObjectLegalHold(input)
+	return s3Error(path, err)
+}
+
+// validateRetentionMode checks the mode is one of the Object Lock retention modes
+func validateRetentionMode(mode string) error {
+	switch mode {
+	case s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance:
+		return nil
+	}
+	return fmt.Errorf("invalid retention mode %q, expected %s or %s", mode, s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance)
+}
+
+// MergeObjects concatenates the parts in order into dest without downloading them where it can. The parts are stitched
+// together with a multipart upload that copies them server side, but every part of a multipart upload other than the last
+// must be at least 5MB, so parts smaller than that are downloaded and combined with their neighbours before they are uploaded.
+// Parts larger than 5GB, the most a single part copy can take, return an error
+func (s3fs *S3FS) MergeObjects(parts []string, dest string) (err error) {
+	defer s3fs.options.observe("MergeObjects", 0)(&err)
+	if len(parts) == 0 {
+		return fmt.Errorf("merging into %s: %w", dest, ErrEmptyPath)
+	}
+	s3Path := strings.TrimPrefix(dest, "/")
+	bucket := aws.String(s3fs.config.S3Bucket)
+	sse, kmsKey := s3fs.encryption()
+	upload, err := s3fs.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               bucket,
+		Key:                  aws.String(s3Path),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKey,
+	})
+	if err != nil {
+		return s3Error(dest, err)
+	}
+	completed, err := s3fs.mergeParts(parts, s3Path, upload.UploadId)
+	if err == nil {
+		_, err = s3fs.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          bucket,
+			Key:             aws.String(s3Path),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		err = s3Error(dest, err)
+	}
+	if err != nil {
+		s3fs.abortUpload(s3fs.config.S3Bucket, s3Path, upload.UploadId)
+		return err
+	}
+	return nil
+}
+
+// mergeParts uploads the parts of a merge. Small parts, and the start of a large part that follows them, are buffered
+// until the buffer reaches the minimum part size, and the rest of each large part is copied server side
+func (s3fs *S3FS) mergeParts(parts []string, s3Path string, uploadID *string) ([]*s3.CompletedPart, error) {
+	var completed []*s3.CompletedPart
+	var buf []byte
+	flush := func() error {
+		uploaded, err := s3fs.svc.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(s3fs.config.S3Bucket),
+			Key:           aws.String(s3Path),
+			Body:          bytes.NewReader(buf),
+			ContentLength: aws.Int64(int64(len(buf))),
+			PartNumber:    aws.Int64(int64(len(completed) + 1)),
+			UploadId:      uploadID,
+		})
+		if err != nil {
+			return s3Error("/"+s3Path, err)
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int64(int64(len(completed) + 1))})
+		buf = nil
+		return nil
+	}
+	read := func(part string, offset int64, length int64) error {
+		body, err := s3fs.GetObjectRange(part, offset, length)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		data, err := ioutil.ReadAll(body)
+		buf = append(buf, data...)
+		return err
+	}
+
+	for _, part := range parts {
+		size, err := s3fs.Size(part)
+		if err != nil {
+			return nil, err
+		}
+		var offset int64
+		if len(buf) > 0 {
+			offset = s3MinPartSize - int64(len(buf))
+			if offset > size {
+				offset = size
+			}
+			if offset > 0 {
+				if err := read(part, 0, offset); err != nil {
+					return nil, err
+				}
+			}
+			if int64(len(buf)) >= s3MinPartSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		remaining := size - offset
+		switch {
+		case remaining <= 0:
+		case remaining < s3MinPartSize:
+			if err := read(part, offset, remaining); err != nil {
+				return nil, err
+			}
+		default:
+			if remaining > s3MaxCopyPartSize {
+				return nil, fmt.Errorf("merging %s: the part is larger than the %d byte copy limit", part, s3MaxCopyPartSize)
+			}
+			copied, err := s3fs.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+				Bucket:          aws.String(s3fs.config.S3Bucket),
+				Key:             aws.String(s3Path),
+				CopySource:      aws.String(url.PathEscape(s3fs.config.S3Bucket + "/" + strings.TrimPrefix(part, "/"))),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, size-1)),
+				PartNumber:      aws.Int64(int64(len(completed) + 1)),
+				UploadId:        uploadID,
+			})
+			if err != nil {
+				return nil, s3Error(part, err)
+			}
+			completed = append(completed, &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: aws.Int64(int64(len(completed) + 1))})
+		}
+	}
+	//the last part can be any size, and a merge of empty parts still needs one part to complete
+	if len(buf) > 0 || len(completed) == 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return completed, nil
+}
+
+// RestoreState is the restore status of an archived object, from the Restore header of HeadObject
+type RestoreState struct {
+	// StorageClass is the storage class of the object, such as GLACIER or DEEP_ARCHIVE
+	StorageClass string
+	// InProgress is true while a restore has been requested but the copy isn't readable yet
+	InProgress bool
+	// Restored is true once the restored copy can be read with GetObject, until Expiry
+	Restored bool
+	// Expiry is when the restored copy is removed again
+	Expiry time.Time
+}
+
+// RestoreObject starts restoring an archived object so it can be read for the number of days given. The tier is Standard,
+// Bulk or Expedited and defaults to Standard when empty. Requesting a restore that is already in progress is not an error,
+// so callers can request the restore and then poll RestoreStatus until Restored is true
+func (s3fs *S3FS) RestoreObject(path string, days int, tier string) (err error) {
+	defer s3fs.options.observe("RestoreObject", 0)(&err)
+	if days < 1 {
+		return fmt.Errorf("restoring %s: days must be at least 1", path)
+	}
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	switch tier {
+	case s3.TierStandard, s3.TierBulk, s3.TierExpedited:
+	default:
+		return fmt.Errorf("invalid restore tier %q, expected %s, %s or %s", tier, s3.TierStandard, s3.TierBulk, s3.TierExpedited)
+	}
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	}
+	_, err = s3fs.svc.RestoreObject(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return s3Error(path, err)
+}
+
+// RestoreStatus reports whether a restore of the object is in progress or complete, and when the restored copy expires.
+// Objects that were never archived or never restored report neither
+func (s3fs *S3FS) RestoreStatus(path string) (_ RestoreState, err error) {
+	defer s3fs.options.observe("RestoreStatus", 0)(&err)
+	output, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+	})
+	if err != nil {
+		return RestoreState{}, s3Error(path, err)
+	}
+	state := parseRestore(aws.StringValue(output.Restore))
+	state.StorageClass = aws.StringValue(output.StorageClass)
+	return state, nil
+}
+
+// parseRestore parses the Restore header, which is ongoing-request="true" while a restore runs and
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT" once it is done
+func parseRestore(header string) RestoreState {
+	state := RestoreState{}
+	if header == "" {
+		return state
+	}
+	if strings.Contains(header, `ongoing-request="true"`) {
+		state.InProgress = true
+		return state
+	}
+	state.Restored = true
+	const expiryKey = `expiry-date="`
+	if i := strings.Index(header, expiryKey); i >= 0 {
+		value := header[i+len(expiryKey):]
+		if end := strings.Index(value, `"`); end >= 0 {
+			if expiry, err := http.ParseTime(value[:end]); err == nil {
+				state.Expiry = expiry
+			}
+		}
+	}
+	return state
+}
+
+// PeekObject reads the first n bytes of the object with a range request, so only those bytes are downloaded.
+// Fewer bytes are returned when the object is smaller than n. An object written with WithCompression is read from
+// the start with GetObject instead, so the bytes are decompressed like they are by GetObject
+func (s3fs *S3FS) PeekObject(path string, n int64) (_ []byte, err error) {
+	defer s3fs.options.observe("PeekObject", 0)(&err)
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	output, err := s3fs.getObjectRange(path, 0, n)
+	if err != nil {
+		//s3 can't satisfy a range of an empty object
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+			return []byte{}, nil
+		}
+		return nil, err
+	}
+	body := output.Body
+	if aws.StringValue(output.ContentEncoding) == gzipEncoding {
+		output.Body.Close()
+		body, err = s3fs.GetObject(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer body.Close()
+	return ioutil.ReadAll(io.LimitReader(body, n))
+}
+
+// DownloadFile downloads the object to the local file with concurrent ranged requests, using the UploadConcurrency and
+// UploadPartSize of the config for the number and size of the ranges. Objects written with WithCompression, and stores
+// with a bandwidth limit, are downloaded with a single GetObject instead so they are decompressed and throttled
+func (s3fs *S3FS) DownloadFile(path string, localPath string) (err error) {
+	defer s3fs.options.observe("DownloadFile", 0)(&err)
+	s3Path := strings.TrimPrefix(path, "/")
+	head, err := s3fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(s3Path),
+	})
+	if err != nil {
+		return s3Error(path, err)
+	}
+	if aws.StringValue(head.ContentEncoding) == gzipEncoding || s3fs.options.limiter != nil {
+		return downloadFile(localPath, func(f *os.File) error {
+			reader, err := s3fs.GetObject(path)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			_, err = io.Copy(f, reader)
+			return err
+		})
+	}
+	downloader := s3manager.NewDownloaderWithClient(s3fs.svc, func(d *s3manager.Downloader) {
+		if s3fs.config.UploadConcurrency > 0 {
+			d.Concurrency = s3fs.config.UploadConcurrency
+		}
+		if s3fs.config.UploadPartSize > 0 {
+			d.PartSize = s3fs.config.UploadPartSize
+		}
+	})
+	return downloadFile(localPath, func(f *os.File) error {
+		_, err := downloader.Download(f, &s3.GetObjectInput{
+			Bucket:  aws.String(s3fs.config.S3Bucket),
+			Key:     aws.String(s3Path),
+			IfMatch: head.ETag,
+		})
+		return s3Error(path, err)
+	})
+}
+
+// GetObjectTags returns the tags of the object
+func (s3fs *S3FS) GetObjectTags(path string) (_ map[string]string, err error) {
+	defer s3fs.options.observe("GetObjectTags", 0)(&err)
+	output, err := s3fs.svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(s3fs.config.S3Bucket),
+		Key:    aws.String(strings.TrimPrefix(path, "/")),
+	})
+	if err != nil {
+		return nil, s3Error(path, err)
+	}
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// PutObjectTags replaces the tags of the object with the tags provided
+func (s3fs *S3FS) PutObjectTags(path string, tags map[string]string) (err error) {
+	defer s3fs.options.observe("PutObjectTags", 0)(&err)
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err = s3fs.svc.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s3fs.config.S3Bucket),
+		Key:     aws.String(strings.TrimPrefix(path, "/")),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return s3Error(path, err)
+}
+
+// TagPrefix adds the tags to every object under the prefix, keeping the other tags of each object, such as the
+// ExpireAfterTag used by lifecycle rules. Objects are tagged 8 at a time and failures are collected into a MultiError
+// so one bad key doesn't stop the rest
+func (s3fs *S3FS) TagPrefix(path string, tags map[string]string) (err error) {
+	defer s3fs.options.observe("TagPrefix", 0)(&err)
+	return s3fs.updatePrefixTags(path, func(current map[string]string) {
+		for k, v := range tags {
+			current[k] = v
+		}
+	})
+}
+
+// UntagPrefix removes the tags with the keys provided from every object under the prefix, the counterpart of TagPrefix
+func (s3fs *S3FS) UntagPrefix(path string, keys ...string) (err error) {
+	defer s3fs.options.observe("UntagPrefix", 0)(&err)
+	return s3fs.updatePrefixTags(path, func(current map[string]string) {
+		for _, k := range keys {
+			delete(current, k)
+		}
+	})
+}
+
+// updatePrefixTags reads the tags of each object under the prefix, applies update to them and writes them back.
+// Tagging has no partial update in s3, so a tag written by someone else between the read and the write can be lost
+func (s3fs *S3FS) updatePrefixTags(path string, update func(tags map[string]string)) error {
+	prefix := "/" + strings.Trim(path, "/") + "/"
+	var errs MultiError
+	var mu sync.Mutex
+	err := WalkConcurrent(s3fs, prefix, defaultBatchWorkers, func(objectPath string, file os.FileInfo) error {
+		tags, err := s3fs.GetObjectTags(objectPath)
+		if err == nil {
+			update(tags)
+			err = s3fs.PutObjectTags(objectPath, tags)
+		}
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("tagging %s: %w", objectPath, err))
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errs.errorOrNil()
+}
+
+// Empty deletes every object in the bucket, leaving the bucket itself, in batches of 1000 keys as the listing is read.
+// To guard against wiping the wrong bucket by accident, bucket must repeat the S3Bucket of the config. Noncurrent
+// versions in a version enabled bucket are kept. Keys that fail to delete are collected into a MultiError
+func (s3fs *S3FS) Empty(bucket string) (err error) {
+	defer s3fs.options.observe("Empty", 0)(&err)
+	if bucket != s3fs.config.S3Bucket {
+		return fmt.Errorf("emptying %s: confirmation %q doesn't match the bucket", s3fs.config.S3Bucket, bucket)
+	}
+	var errs MultiError
+	batch := make([]string, 0, defaultPageSize)
+	flush := func() {
+		if err := s3fs.DeleteObjects(batch...); err != nil {
+			errs = append(errs, err)
+		}
+		batch = batch[:0]
+	}
+	err = s3fs.Walk("", func(path string, file os.FileInfo) error {
+		batch = append(batch, path)
+		if len(batch) == defaultPageSize {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	return errs.errorOrNil()
+}
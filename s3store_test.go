@@ -0,0 +1,978 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BenchmarkPutObject puts through a single store, which reuses its s3 client and uploader for every call
+func BenchmarkPutObject(b *testing.B) {
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket}, mock)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := []byte("benchmark")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.PutObject("/bench", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPutObjectNewStore builds the store, with its client and uploader, for every put, for comparison with the
+// allocations of BenchmarkPutObject
+func BenchmarkPutObjectNewStore(b *testing.B) {
+	mock := newMockS3()
+	data := []byte("benchmark")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket}, mock)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fs.PutObject("/bench", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestS3FSReusesClient(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	uploader := fs.uploader
+	for i := 0; i < 3; i++ {
+		if _, err := fs.PutObject("/reuse", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.GetDir("/", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.svc != mock {
+		t.Error("expected the store to keep the client it was created with")
+	}
+	if fs.uploader != uploader {
+		t.Error("expected the uploader to be reused")
+	}
+	if mock.count("PutObject") != 3 {
+		t.Errorf("expected 3 puts through the shared client, got %d", mock.count("PutObject"))
+	}
+}
+
+func TestNewS3FSWithClient(t *testing.T) {
+	if _, err := NewS3FSWithClient(S3FSConfig{}, newMockS3()); err != ErrMissingBucket {
+		t.Errorf("expected ErrMissingBucket, got %v", err)
+	}
+	fs, mock := newTestS3FS(t)
+	if _, err := fs.PutObject("/injected.txt", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectString(fs, "/injected.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "data" || mock.object("injected.txt") == nil {
+		t.Errorf("expected the object in the injected client, got %q", content)
+	}
+	if mock.count("PutObject") != 1 || mock.count("GetObject") != 1 {
+		t.Errorf("expected the calls to go through the injected client, got %v", mock.calls)
+	}
+}
+
+func TestS3GetDirPathRoundTrip(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("data/a.txt", []byte("a"))
+	mock.put("data/sub/b.txt", []byte("b"))
+	objects, err := fs.GetDir("/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*objects) != 2 {
+		t.Fatalf("expected a directory and a file, got %v", *objects)
+	}
+	for _, object := range *objects {
+		key := path.Join(object.Path, object.Name)
+		if object.IsDir {
+			if key != "data/sub" {
+				t.Errorf("expected the directory key data/sub, got %s", key)
+			}
+			children, err := fs.GetDir(key, false)
+			if err != nil || len(*children) != 1 || (*children)[0].Name != "b.txt" {
+				t.Errorf("expected to list b.txt under %s, got %v %v", key, children, err)
+			}
+			continue
+		}
+		if key != "data/a.txt" {
+			t.Errorf("expected the object key data/a.txt, got %s", key)
+		}
+		if content, err := GetObjectString(fs, key, 0); err != nil || content != "a" {
+			t.Errorf("expected to get %s, got %q %v", key, content, err)
+		}
+	}
+}
+
+// TestS3GetDirKeyParsing parses keys with "/" whatever the os separator, so a backslash in a key is part of the name
+func TestS3GetDirKeyParsing(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("data/dir/a.txt", []byte("a"))
+	mock.put("data/report.final.csv", []byte("b"))
+	mock.put(`data/windows\name.txt`, []byte("c"))
+	objects, err := fs.GetDir("/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ name, path, ext string }{
+		{"dir", "data", ""},
+		{"report.final.csv", "data", ".csv"},
+		{`windows\name.txt`, "data", ".txt"},
+	}
+	if len(*objects) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), *objects)
+	}
+	for i, e := range expected {
+		if o := (*objects)[i]; o.Name != e.name || o.Path != e.path || o.Type != e.ext {
+			t.Errorf("expected name %s path %s type %s, got %+v", e.name, e.path, e.ext, o)
+		}
+	}
+}
+
+func TestS3GlobFetchOwner(t *testing.T) {
+	for _, fetchOwner := range []bool{false, true} {
+		mock := newMockS3()
+		fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, FetchOwner: fetchOwner}, mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.put("data/a.txt", []byte("a"))
+		matches, err := fs.Glob("/data/*.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ""
+		if fetchOwner {
+			expected = mockOwner
+		}
+		if len(matches) != 1 || matches[0].ModifiedBy != expected {
+			t.Errorf("fetch owner %v: expected the match to be modified by %q, got %+v", fetchOwner, expected, matches)
+		}
+	}
+}
+
+func TestSharedAccessURLs(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	paths := []string{"/thumbs/1.png", "/thumbs/2.png", "/thumbs/3.png"}
+	urls, err := fs.SharedAccessURLs(paths, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != len(paths) {
+		t.Errorf("expected a url for each of the %d paths, got %v", len(paths), urls)
+	}
+	for _, p := range paths {
+		if !strings.Contains(urls[p], strings.TrimPrefix(p, "/")) {
+			t.Errorf("expected a url for %s, got %q", p, urls[p])
+		}
+	}
+
+	mock.region = ""
+	urls, err = fs.SharedAccessURLs(paths, time.Hour)
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != len(paths) || !errors.Is(errs[0], ErrUnsupportedConfig) || len(urls) != 0 {
+		t.Errorf("expected each path to fail without a region, got %v %v", urls, err)
+	}
+	if _, err := fs.SharedAccessURLs(paths, 8*24*time.Hour); err == nil {
+		t.Error("expected an expiration over 7 days to be rejected")
+	}
+}
+
+func TestS3ObjectVersions(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.versionPageSize = 2
+	first := mock.putVersion("data/a.txt", []byte("first"))
+	second := mock.putVersion("data/a.txt", []byte("second!"))
+	other := mock.putVersion("data/b.txt", []byte("other"))
+
+	content, err := fs.GetObjectVersion("/data/a.txt", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil || string(data) != "first" {
+		t.Errorf("expected the first version, got %q %v", data, err)
+	}
+	if _, err := fs.GetObjectVersion("/data/a.txt", "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for a missing version, got %v", err)
+	}
+
+	versions, err := fs.ListObjectVersions("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ObjectVersion{
+		{Key: "/data/a.txt", VersionID: second, IsLatest: true, Size: 7},
+		{Key: "/data/a.txt", VersionID: first, IsLatest: false, Size: 5},
+		{Key: "/data/b.txt", VersionID: other, IsLatest: true, Size: 5},
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("expected %d versions across the pages, got %v", len(expected), versions)
+	}
+	for i, e := range expected {
+		v := versions[i]
+		if v.Key != e.Key || v.VersionID != e.VersionID || v.IsLatest != e.IsLatest || v.Size != e.Size || v.ModTime.IsZero() {
+			t.Errorf("expected %+v, got %+v", e, v)
+		}
+	}
+	if mock.count("ListObjectVersions") != 2 {
+		t.Errorf("expected 2 pages, got %d", mock.count("ListObjectVersions"))
+	}
+}
+
+func TestS3GetObjectVersionReadsLikeGetObject(t *testing.T) {
+	fs, mock := newTestS3FS(t, WithBandwidthLimit(testBandwidth))
+	compressed, err := gzipBytes(compressible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped := mock.putVersion("data.json", compressed)
+	mock.versions[len(mock.versions)-1].contentEncoding = gzipEncoding
+	large := mock.putVersion("data.bin", make([]byte, throttledSize))
+
+	content, err := fs.GetObjectVersion("/data.json", gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(content)
+	content.Close()
+	if err != nil || !bytes.Equal(data, compressible) {
+		t.Errorf("expected the compressed version to be decompressed, got %d bytes %v", len(data), err)
+	}
+	elapsed := timed(t, func() error {
+		content, err := fs.GetObjectVersion("/data.bin", large)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		_, err = io.Copy(ioutil.Discard, content)
+		return err
+	})
+	if elapsed < throttledMinimum {
+		t.Errorf("expected the version to be read under the bandwidth limit, took %s", elapsed)
+	}
+}
+
+func TestS3WalkVersions(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.versionPageSize = 2
+	first := mock.putVersion("data/a.txt", []byte("first"))
+	second := mock.putVersion("data/a.txt", []byte("second!"))
+	other := mock.putVersion("data/b.txt", []byte("other"))
+	if err := fs.DeleteObjectVersion("/data/a.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	marker := mock.versions[len(mock.versions)-1]
+	if !marker.deleteMarker {
+		t.Fatalf("expected the delete to add a delete marker, got %+v", marker)
+	}
+	//distinct times so the newest first order doesn't depend on the clock resolution
+	base := time.Now().Add(-time.Hour)
+	for i, v := range mock.versions {
+		v.modified = base.Add(time.Duration(i) * time.Minute)
+	}
+
+	type visit struct {
+		key          string
+		versionID    string
+		deleteMarker bool
+		size         int64
+	}
+	var visits []visit
+	err := fs.WalkVersions("/data", func(path string, versionID string, isDeleteMarker bool, file os.FileInfo) error {
+		visits = append(visits, visit{path, versionID, isDeleteMarker, file.Size()})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []visit{
+		{"/data/a.txt", marker.id, true, 0},
+		{"/data/a.txt", second, false, 7},
+		{"/data/a.txt", first, false, 5},
+		{"/data/b.txt", other, false, 5},
+	}
+	if !reflect.DeepEqual(visits, expected) {
+		t.Errorf("expected %v, got %v", expected, visits)
+	}
+	if mock.count("ListObjectVersions") != 2 {
+		t.Errorf("expected 2 pages, got %d", mock.count("ListObjectVersions"))
+	}
+
+	visited := 0
+	err = fs.WalkVersions("/data", func(string, string, bool, os.FileInfo) error {
+		visited++
+		return ErrStopWalk
+	})
+	if err != nil || visited != 1 {
+		t.Errorf("expected ErrStopWalk to end the walk at the first entry, visited %d with %v", visited, err)
+	}
+	blockfs := newTestBlockFS(t)
+	if err := blockfs.WalkVersions("/", func(string, string, bool, os.FileInfo) error { return nil }); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestBlockFSObjectVersionsNotSupported(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.GetObjectVersion("/data.txt", "v1"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+	if _, err := fs.ListObjectVersions("/"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestS3DeleteObjectVersion(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	first := mock.putVersion("data.txt", []byte("first"))
+	second := mock.putVersion("data.txt", []byte("second"))
+
+	if err := fs.DeleteObjectVersion("/data.txt", first); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := fs.ListObjectVersions("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].VersionID != second {
+		t.Errorf("expected only the second version to remain, got %v", versions)
+	}
+	if mock.object("data.txt") == nil {
+		t.Error("expected deleting an old version to keep the current object")
+	}
+
+	if err := fs.DeleteObjectVersion("/data.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if mock.object("data.txt") != nil {
+		t.Error("expected an empty version id to delete the current object")
+	}
+	versions, err = fs.ListObjectVersions("/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].IsLatest {
+		t.Errorf("expected the second version to be kept behind a delete marker, got %v", versions)
+	}
+	if err := newTestBlockFS(t).DeleteObjectVersion("/data.txt", first); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported from BlockFS, got %v", err)
+	}
+}
+
+func TestUploadReturnsETag(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	source := filepath.Join(t.TempDir(), "source.txt")
+	if err := ioutil.WriteFile(source, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		output, err := fs.Upload(strings.NewReader("content"), "/upload.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Md5 != "9a0364b9e99bb480dd25e1f0284c8555" {
+			t.Errorf("%s: expected the md5 of the content as the etag, got %q", name, output.Md5)
+		}
+		output, err = fs.UploadFile(source, "/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Md5 == "" {
+			t.Errorf("%s: expected UploadFile to return the etag", name)
+		}
+	}
+	output, err := s3fs.Upload(strings.NewReader("content"), "/located.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(output.Location, "/located.txt") {
+		t.Errorf("expected the location of the object, got %q", output.Location)
+	}
+}
+
+func TestSharedAccessURLKMSObject(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	obj := mock.put("secure/report.pdf", []byte("report"))
+	obj.sse, obj.kmsKeyID = s3.ServerSideEncryptionAwsKms, "arn:aws:kms:us-east-1:123456789012:key/test"
+
+	url, err := fs.SharedAccessURL("/secure/report.pdf", time.Hour, WithContentDisposition("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"secure/report.pdf", "X-Amz-Expires=3600", "response-content-disposition=attachment"} {
+		if !strings.Contains(url, expected) {
+			t.Errorf("expected the url to contain %s, got %s", expected, url)
+		}
+	}
+
+	mock.signedHeaders = http.Header{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}
+	if _, err := fs.SharedAccessURL("/secure/report.pdf", time.Hour); err == nil {
+		t.Error("expected a url that needs signed headers to be rejected")
+	}
+	_, headers, err := fs.SharedAccessRequest("/secure/report.pdf", time.Hour)
+	if err != nil || headers.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+		t.Errorf("expected the signed headers to be returned, got %v %v", headers, err)
+	}
+
+	mock.signedHeaders = nil
+	mock.region = ""
+	if _, err := fs.SharedAccessURL("/secure/report.pdf", time.Hour); !errors.Is(err, ErrUnsupportedConfig) {
+		t.Errorf("expected a presign without a region to fail with ErrUnsupportedConfig, got %v", err)
+	}
+}
+
+func TestS3CreateDirAndEmptyObject(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	if err := fs.CreateDir("/made/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateEmptyObject("/made/empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"made/dir/", "made/empty.txt"} {
+		if obj := mock.object(key); obj == nil || len(obj.data) != 0 {
+			t.Errorf("expected an empty object at %s, got %v", key, obj)
+		}
+	}
+	objects, err := fs.GetDir("/made", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*objects) != 2 || !(*objects)[0].IsDir || (*objects)[1].IsDir {
+		t.Errorf("expected the directory and the empty file, got %v", *objects)
+	}
+}
+
+func TestS3Touch(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	past := time.Now().Add(-time.Hour)
+	obj := mock.put("marker", []byte("alive"))
+	obj.modified, obj.contentType = past, "text/plain"
+	obj.metadata = map[string]*string{"owner": aws.String("ops")}
+	if err := fs.Touch("/marker"); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("CopyObject") != 1 {
+		t.Fatalf("expected a self copy, got %d copies", mock.count("CopyObject"))
+	}
+	touched := mock.object("marker")
+	if !touched.modified.After(past) || string(touched.data) != "alive" {
+		t.Errorf("expected the modtime to advance with the content kept, got %s %q", touched.modified, touched.data)
+	}
+	if touched.contentType != "text/plain" || aws.StringValue(touched.metadata["owner"]) != "ops" {
+		t.Errorf("expected the content type and metadata to be kept, got %s %v", touched.contentType, touched.metadata)
+	}
+	if err := fs.Touch("/new-marker"); err != nil {
+		t.Fatal(err)
+	}
+	if created := mock.object("new-marker"); created == nil || len(created.data) != 0 {
+		t.Errorf("expected touching a missing object to create it empty, got %v", created)
+	}
+}
+
+func TestS3TouchEncryptionAndLargeObjects(t *testing.T) {
+	const kmsKey = "arn:aws:kms:us-east-1:123456789012:key/test"
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, ServerSideEncryption: s3.ServerSideEncryptionAwsKms, SSEKMSKeyId: kmsKey}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.put("plain", []byte("plain"))
+	if err := fs.Touch("/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("plain"); obj.sse != s3.ServerSideEncryptionAwsKms || obj.kmsKeyID != kmsKey {
+		t.Errorf("expected the touched object to get the configured encryption, got %q %q", obj.sse, obj.kmsKeyID)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	large := mock.put("large.bin", nil)
+	large.size = s3MaxCopyPartSize + 1
+	large.modified, large.contentType = past, "application/x-hdf5"
+	if err := fs.Touch("/large.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("CopyObject") != 1 || mock.count("CompleteMultipartUpload") != 1 {
+		t.Fatalf("expected a multipart copy of the large object, got %d copies and %d completions", mock.count("CopyObject"), mock.count("CompleteMultipartUpload"))
+	}
+	touched := mock.object("large.bin")
+	if !touched.modified.After(past) || touched.contentType != "application/x-hdf5" || touched.kmsKeyID != kmsKey {
+		t.Errorf("expected the modtime to advance with the content type and encryption kept, got %s %s %q", touched.modified, touched.contentType, touched.kmsKeyID)
+	}
+}
+
+func TestS3CopyObjectWithMetadata(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	obj := mock.put("report.csv", []byte("a,b"))
+	obj.contentType = "application/octet-stream"
+	obj.metadata = map[string]*string{"owner": aws.String("ops")}
+	//copying onto itself fixes the content type in place
+	err := fs.CopyObjectWithMetadata("/report.csv", "/report.csv", map[string]string{"source": "gauge"}, "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.copies) != 1 {
+		t.Fatalf("expected one copy, got %d", len(mock.copies))
+	}
+	input := mock.copies[0]
+	if aws.StringValue(input.MetadataDirective) != s3.MetadataDirectiveReplace {
+		t.Errorf("expected the REPLACE metadata directive, got %q", aws.StringValue(input.MetadataDirective))
+	}
+	if aws.StringValue(input.ContentType) != "text/csv" || aws.StringValue(input.Metadata["source"]) != "gauge" {
+		t.Errorf("expected the new content type and metadata to be sent, got %s %v", aws.StringValue(input.ContentType), input.Metadata)
+	}
+	copied := mock.object("report.csv")
+	if string(copied.data) != "a,b" || copied.contentType != "text/csv" {
+		t.Errorf("expected the content kept under the new content type, got %q %s", copied.data, copied.contentType)
+	}
+	if _, ok := copied.metadata["owner"]; ok || len(copied.metadata) != 1 {
+		t.Errorf("expected the source metadata to be replaced, got %v", copied.metadata)
+	}
+}
+
+func TestS3CopyObjectWithMetadataKeepsContentHeaders(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := fs.PutObject("/data.json", compressible, WithCompression(), WithExpires(expires)); err != nil {
+		t.Fatal(err)
+	}
+	source := mock.object("data.json")
+	source.cacheControl, source.contentDisposition, source.sse = "max-age=60", "attachment", s3.ServerSideEncryptionAes256
+	if err := fs.CopyObjectWithMetadata("/data.json", "/copy.json", map[string]string{"source": "gauge"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetObjectBytes(fs, "/copy.json", 0)
+	if err != nil || !bytes.Equal(content, compressible) {
+		t.Errorf("expected the compressed copy to read back decompressed, got %d bytes %v", len(content), err)
+	}
+	copied := mock.object("copy.json")
+	if copied.contentEncoding != gzipEncoding || copied.cacheControl != "max-age=60" || copied.contentDisposition != "attachment" {
+		t.Errorf("expected the content headers of the source, got %q %q %q", copied.contentEncoding, copied.cacheControl, copied.contentDisposition)
+	}
+	if !copied.expires.Equal(expires) || copied.sse != s3.ServerSideEncryptionAes256 {
+		t.Errorf("expected the expiry and encryption of the source, got %s %q", copied.expires, copied.sse)
+	}
+	if copied.contentType != "application/json" || aws.StringValue(copied.metadata["source"]) != "gauge" {
+		t.Errorf("expected the new content type and metadata, got %s %v", copied.contentType, copied.metadata)
+	}
+
+	large := mock.put("large.json", nil)
+	large.size = s3MaxCopyPartSize + 1
+	large.contentEncoding = gzipEncoding
+	if err := fs.CopyObjectWithMetadata("/large.json", "/large.json", map[string]string{"source": "gauge"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("CompleteMultipartUpload") != 1 {
+		t.Fatalf("expected a multipart copy of the large object, got %d completions", mock.count("CompleteMultipartUpload"))
+	}
+	if copied := mock.object("large.json"); copied.contentEncoding != gzipEncoding || aws.StringValue(copied.metadata["source"]) != "gauge" {
+		t.Errorf("expected the large copy to keep its encoding with the new metadata, got %q %v", copied.contentEncoding, copied.metadata)
+	}
+}
+
+func TestS3UploadExpiry(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	opts := []UploadOption{WithExpires(expires), WithExpireAfter(7), WithTags(map[string]string{"owner": "ops"})}
+	if _, err := fs.PutObject("/export/put.csv", []byte("a,b"), opts...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Upload(strings.NewReader("a,b"), "/export/upload.csv", opts...); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"export/put.csv", "export/upload.csv"} {
+		obj := mock.object(key)
+		if !obj.expires.Equal(expires) {
+			t.Errorf("%s: expected the Expires header %s, got %s", key, expires, obj.expires)
+		}
+		tags := make(map[string]string)
+		for _, tag := range obj.tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		expected := map[string]string{ExpireAfterTag: "7d", "owner": "ops"}
+		if !reflect.DeepEqual(tags, expected) {
+			t.Errorf("%s: expected the tags %v, got %v", key, expected, tags)
+		}
+	}
+}
+
+func TestS3CopyObjectLargerThanCopyLimit(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("small.bin", []byte("small"))
+	if err := fs.CopyObject("/small.bin", "/small-copy.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("CopyObject") != 1 || mock.count("UploadPartCopy") != 0 {
+		t.Errorf("expected a single call copy, got %d copies and %d part copies", mock.count("CopyObject"), mock.count("UploadPartCopy"))
+	}
+
+	large := mock.put("large.bin", nil)
+	large.size = s3MaxCopyPartSize + 1
+	large.contentType = "application/x-hdf5"
+	if err := fs.CopyObject("/large.bin", "/large-copy.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("CopyObject") != 1 || mock.count("CompleteMultipartUpload") != 1 {
+		t.Fatalf("expected a multipart copy, got %d copies and %d completions", mock.count("CopyObject"), mock.count("CompleteMultipartUpload"))
+	}
+	//the 1 byte remainder is too small for a part of its own, so it is copied with the last 1GB part
+	var expected []string
+	for i := int64(0); i < 4; i++ {
+		expected = append(expected, fmt.Sprintf("bytes=%d-%d", i*s3CopyPartSize, (i+1)*s3CopyPartSize-1))
+	}
+	expected = append(expected, fmt.Sprintf("bytes=%d-%d", 4*s3CopyPartSize, large.size-1))
+	if !reflect.DeepEqual(mock.copyRanges, expected) {
+		t.Errorf("expected the part ranges %v, got %v", expected, mock.copyRanges)
+	}
+	if copied := mock.object("large-copy.bin"); copied == nil || copied.contentType != "application/x-hdf5" {
+		t.Errorf("expected the copy to keep the content type, got %v", copied)
+	}
+}
+
+func TestS3KMSMultipartUpload(t *testing.T) {
+	const kmsKey = "arn:aws:kms:us-east-1:123456789012:key/test"
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, ServerSideEncryption: s3.ServerSideEncryptionAwsKms, SSEKMSKeyId: kmsKey}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, etags := startS3Upload(t, fs, "/secure/chunked", []byte("sensitive"))
+	input := mock.uploads[id].input
+	if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms || aws.StringValue(input.SSEKMSKeyId) != kmsKey {
+		t.Errorf("expected the multipart init to carry the KMS encryption, got %v %v", input.ServerSideEncryption, input.SSEKMSKeyId)
+	}
+	if err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{UploadId: id, ObjectPath: "/secure/chunked", ChunkUploadIds: etags}); err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("secure/chunked"); obj.sse != s3.ServerSideEncryptionAwsKms || obj.kmsKeyID != kmsKey {
+		t.Errorf("expected the completed object to be KMS encrypted, got %q %q", obj.sse, obj.kmsKeyID)
+	}
+	if _, err := fs.Upload(strings.NewReader("sensitive"), "/secure/streamed"); err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("secure/streamed"); obj.sse != s3.ServerSideEncryptionAwsKms || obj.kmsKeyID != kmsKey {
+		t.Errorf("expected the streamed object to be KMS encrypted, got %q %q", obj.sse, obj.kmsKeyID)
+	}
+}
+
+func TestS3MergeObjectsFailureAborts(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	putKeys(t, fs, "/parts/1", "/parts/2")
+	for _, op := range []string{"CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload"} {
+		mock.errs[op] = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+		err := fs.MergeObjects([]string{"/parts/1", "/parts/2"}, "/merged")
+		var denied *AccessDeniedError
+		if !errors.As(err, &denied) || denied.Path != "/merged" {
+			t.Errorf("%s: expected an AccessDeniedError for /merged, got %v", op, err)
+		}
+		if len(mock.uploads) != 0 {
+			t.Errorf("%s: expected the failed merge to abort its upload, got %d open", op, len(mock.uploads))
+		}
+		delete(mock.errs, op)
+	}
+}
+
+func TestS3PutObjectKMSETag(t *testing.T) {
+	const kmsKey = "arn:aws:kms:us-east-1:123456789012:key/test"
+	mock := newMockS3()
+	fs, err := NewS3FSWithClient(S3FSConfig{S3Bucket: testBucket, ServerSideEncryption: s3.ServerSideEncryptionAwsKms, SSEKMSKeyId: kmsKey}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("sensitive")
+	output, err := fs.PutObject("/secure/put", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data)
+	if output.Md5 != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the md5 of the content, got %s", output.Md5)
+	}
+	if obj := mock.object("secure/put"); output.ETag != obj.etag {
+		t.Errorf("expected the etag s3 returned %s, got %s", obj.etag, output.ETag)
+	}
+	if strings.Trim(output.ETag, `"`) == output.Md5 {
+		t.Errorf("expected the etag of an SSE-KMS object to differ from its md5, got %s", output.ETag)
+	}
+	if _, err := fs.PutObject("/secure/put", []byte("updated"), WithIfMatch(output.ETag)); err != nil {
+		t.Errorf("expected a write conditional on the etag to succeed, got %v", err)
+	}
+}
+
+func TestS3ConfigUseAccelerateEndpoint(t *testing.T) {
+	for _, accelerate := range []bool{false, true} {
+		cfg, err := newS3Config(S3FSConfig{S3Bucket: testBucket, S3Region: "us-east-1", UseAccelerateEndpoint: accelerate}, newStoreOptions(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aws.BoolValue(cfg.S3UseAccelerate) != accelerate {
+			t.Errorf("expected S3UseAccelerate %v, got %v", accelerate, aws.BoolValue(cfg.S3UseAccelerate))
+		}
+	}
+	config := S3FSConfig{S3Bucket: testBucket, S3Region: "us-east-1", UseAccelerateEndpoint: true, Mock: true, S3ForcePathStyle: true}
+	if _, err := newS3Config(config, newStoreOptions(nil)); !errors.Is(err, ErrUnsupportedConfig) {
+		t.Errorf("expected acceleration with path style addressing to fail with ErrUnsupportedConfig, got %v", err)
+	}
+}
+
+func TestS3TagPrefix(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("data/%02d", i))
+		mock.put(keys[i], nil)
+	}
+	mock.object("data/00").tags = []*s3.Tag{{Key: aws.String(ExpireAfterTag), Value: aws.String("7d")}}
+	mock.put("other/file", nil)
+	if err := fs.TagPrefix("/data", map[string]string{"reviewed": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		tags, err := fs.GetObjectTags(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags["reviewed"] != "true" {
+			t.Errorf("expected %s to be tagged, got %v", key, tags)
+		}
+	}
+	if tags, _ := fs.GetObjectTags("data/00"); tags[ExpireAfterTag] != "7d" {
+		t.Errorf("expected the existing tags to be kept, got %v", tags)
+	}
+	if tags, _ := fs.GetObjectTags("other/file"); len(tags) != 0 {
+		t.Errorf("expected objects outside the prefix to be untouched, got %v", tags)
+	}
+
+	mock.failNext["PutObjectTagging"] = []error{errors.New("tagging failed")}
+	err := fs.UntagPrefix("/data", "reviewed")
+	var multi MultiError
+	if !errors.As(err, &multi) || len(multi) != 1 {
+		t.Fatalf("expected the failed key in a MultiError, got %v", err)
+	}
+	untagged := 0
+	for _, key := range keys {
+		if tags, _ := fs.GetObjectTags(key); tags["reviewed"] == "" {
+			untagged++
+		}
+	}
+	if untagged != len(keys)-1 {
+		t.Errorf("expected every other object to be untagged, got %d of %d", untagged, len(keys))
+	}
+}
+
+func TestSharedAccessHeadURL(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	url, err := fs.SharedAccessHeadURL("/data/large.bin", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "https://" + testBucket + ".s3.amazonaws.com/data/large.bin?X-Amz-Expires=900"
+	if url != expected {
+		t.Errorf("expected %s, got %s", expected, url)
+	}
+	if !reflect.DeepEqual(mock.presigned, []string{http.MethodHead}) {
+		t.Errorf("expected a HEAD request to be presigned, got %v", mock.presigned)
+	}
+	for _, expiration := range []time.Duration{0, 8 * 24 * time.Hour} {
+		if _, err := fs.SharedAccessHeadURL("/data/large.bin", expiration); err == nil {
+			t.Errorf("expected an expiration of %s to be rejected", expiration)
+		}
+	}
+	mock.region = ""
+	if _, err := fs.SharedAccessHeadURL("/data/large.bin", time.Hour); !errors.Is(err, ErrUnsupportedConfig) {
+		t.Errorf("expected a presign without a region to fail with ErrUnsupportedConfig, got %v", err)
+	}
+}
+
+func TestS3ObjectLock(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	until := time.Now().Add(365 * 24 * time.Hour).Truncate(time.Second)
+	mock.put("records/a.csv", []byte("a"))
+	if err := fs.PutObjectRetention("/records/a.csv", s3.ObjectLockRetentionModeCompliance, until); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PutObjectLegalHold("/records/a.csv", true); err != nil {
+		t.Fatal(err)
+	}
+	obj := mock.object("records/a.csv")
+	if obj.lockMode != s3.ObjectLockRetentionModeCompliance || !obj.lockUntil.Equal(until) || obj.legalHold != s3.ObjectLockLegalHoldStatusOn {
+		t.Errorf("expected the compliance retention until %s and a legal hold, got %s %s %s", until, obj.lockMode, obj.lockUntil, obj.legalHold)
+	}
+	if err := fs.PutObjectLegalHold("/records/a.csv", false); err != nil {
+		t.Fatal(err)
+	}
+	if obj.legalHold != s3.ObjectLockLegalHoldStatusOff {
+		t.Errorf("expected the legal hold to be removed, got %s", obj.legalHold)
+	}
+
+	if _, err := fs.PutObject("/records/b.csv", []byte("b"), WithRetention(s3.ObjectLockRetentionModeGovernance, until)); err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("records/b.csv"); obj.lockMode != s3.ObjectLockRetentionModeGovernance || !obj.lockUntil.Equal(until) {
+		t.Errorf("expected the retention to be set by the put, got %s %s", obj.lockMode, obj.lockUntil)
+	}
+	if _, err := fs.Upload(strings.NewReader("c"), "/records/c.csv", WithRetention(s3.ObjectLockRetentionModeGovernance, until)); err != nil {
+		t.Fatal(err)
+	}
+	if obj := mock.object("records/c.csv"); obj.lockMode != s3.ObjectLockRetentionModeGovernance {
+		t.Errorf("expected the retention to be set after the upload, got %q", obj.lockMode)
+	}
+
+	calls := mock.count("PutObjectRetention")
+	if err := fs.PutObjectRetention("/records/a.csv", "FOREVER", until); err == nil {
+		t.Error("expected an invalid mode to be rejected")
+	}
+	if _, err := fs.PutObject("/records/d.csv", []byte("d"), WithRetention("FOREVER", until)); err == nil {
+		t.Error("expected an invalid mode to be rejected on put")
+	}
+	if mock.count("PutObjectRetention") != calls || mock.object("records/d.csv") != nil {
+		t.Error("expected invalid modes to be rejected before calling s3")
+	}
+}
+
+func TestBlockFSObjectLockNotSupported(t *testing.T) {
+	fs := newTestBlockFS(t)
+	if _, err := fs.PutObject("/a.csv", []byte("a"), WithRetention(s3.ObjectLockRetentionModeGovernance, time.Now())); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestNewFileStoreValidatesS3Config(t *testing.T) {
+	valid := S3FSConfig{S3Bucket: testBucket, S3Region: "us-east-1", S3Id: "id", S3Key: "key"}
+	tests := []struct {
+		name     string
+		modify   func(*S3FSConfig)
+		expected error
+	}{
+		{"missing bucket", func(c *S3FSConfig) { c.S3Bucket = "" }, ErrMissingBucket},
+		{"missing region", func(c *S3FSConfig) { c.S3Region = "" }, ErrMissingRegion},
+		{"missing key", func(c *S3FSConfig) { c.S3Key = "" }, ErrMissingCredentials},
+		{"missing id", func(c *S3FSConfig) { c.S3Id = "" }, ErrMissingCredentials},
+	}
+	for _, test := range tests {
+		config := valid
+		test.modify(&config)
+		if _, err := NewFileStore(config); !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+	defaultChain := valid
+	defaultChain.S3Id, defaultChain.S3Key = "", ""
+	for _, config := range []S3FSConfig{valid, defaultChain} {
+		if _, err := NewFileStore(config); err != nil {
+			t.Errorf("expected a complete config to be accepted, got %v", err)
+		}
+	}
+}
+
+func TestParseRestore(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected RestoreState
+	}{
+		{"", RestoreState{}},
+		{`ongoing-request="true"`, RestoreState{InProgress: true}},
+		{`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, RestoreState{Restored: true, Expiry: time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC)}},
+		{`ongoing-request="false"`, RestoreState{Restored: true}},
+		{`ongoing-request="false", expiry-date="not a date"`, RestoreState{Restored: true}},
+	}
+	for _, test := range tests {
+		if state := parseRestore(test.header); !reflect.DeepEqual(state, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.header, test.expected, state)
+		}
+	}
+}
+
+func TestS3RestoreObject(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("archived.txt", []byte("content")).storageClass = s3.StorageClassGlacier
+	mock.put("standard.txt", []byte("content"))
+
+	state, err := fs.RestoreStatus("/archived.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, RestoreState{StorageClass: s3.StorageClassGlacier}) {
+		t.Errorf("expected an archived object that was never restored, got %+v", state)
+	}
+	if err := fs.RestoreObject("/archived.txt", 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	//requesting a restore that is already running isn't an error
+	if err := fs.RestoreObject("/archived.txt", 1, s3.TierBulk); err != nil {
+		t.Errorf("expected a repeated restore to succeed, got %v", err)
+	}
+	state, err = fs.RestoreStatus("/archived.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.InProgress || state.Restored {
+		t.Errorf("expected the restore to be in progress, got %+v", state)
+	}
+
+	calls := mock.count("RestoreObject")
+	if err := fs.RestoreObject("/archived.txt", 0, ""); err == nil {
+		t.Error("expected an error for less than a day")
+	}
+	if err := fs.RestoreObject("/archived.txt", 1, "Fast"); err == nil {
+		t.Error("expected an error for an unknown tier")
+	}
+	if mock.count("RestoreObject") != calls {
+		t.Errorf("expected invalid requests not to be sent, got %d calls", mock.count("RestoreObject")-calls)
+	}
+	if err := fs.RestoreObject("/standard.txt", 1, ""); err == nil {
+		t.Error("expected an error restoring an object that isn't archived")
+	}
+	if _, err := fs.RestoreStatus("/missing.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestS3CopyPrefixCollectsFailures(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	putKeys(t, fs, "/src/a.txt", "/src/b.txt", "/src/c.txt")
+	mock.failNext["CopyObject"] = []error{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")}
+	err := fs.CopyPrefix("/src", "/dst", nil)
+	var multi MultiError
+	if !errors.As(err, &multi) || len(multi) != 1 {
+		t.Fatalf("expected a MultiError with the one failure, got %v", err)
+	}
+	var denied *AccessDeniedError
+	if !errors.As(multi[0], &denied) || denied.Path != "/src/a.txt" {
+		t.Errorf("expected an AccessDeniedError for /src/a.txt, got %v", multi[0])
+	}
+	for _, p := range []string{"/dst/b.txt", "/dst/c.txt"} {
+		if _, err := fs.GetObjectInfo(p); err != nil {
+			t.Errorf("expected the copy to continue past the failure to %s, got %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// errInvalidRange is returned by parseRange when the range can't be satisfied for the object size
+var errInvalidRange = errors.New("invalid range")
+
+// rangeGetter is implemented by stores that can read part of an object without reading it from the start
+type rangeGetter interface {
+	GetObjectRange(path string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// ServeObject writes the object to the response with its Content-Type, Content-Length, ETag and Last-Modified headers.
+// Single range requests are answered with the requested part, from GetObjectRange when the store supports it
+// or by seeking when the object body is seekable, as it is for files. Errors that happen before the response
+// is written are returned so the caller can choose the status, for example a 404 for ErrObjectNotFound.
+// Objects written with WithCompression are served decompressed, like GetObject reads them. Their decompressed size isn't
+// known up front, so they are sent without a Content-Length and range requests are answered with the whole object
+func ServeObject(fs FileStore, w http.ResponseWriter, r *http.Request, objectPath string) error {
+	info, err := fs.GetObjectInfo(objectPath)
+	if err != nil {
+		return err
+	}
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"`+strings.Trim(info.ETag, `"`)+`"`)
+	}
+
+	compressed := info.ContentEncoding == gzipEncoding
+	if rg, ok := fs.(rangeGetter); ok && r.Header.Get("Range") != "" && !compressed {
+		offset, length, err := parseRange(r.Header.Get("Range"), info.Size)
+		if err == nil {
+			body, err := rg.GetObjectRange(objectPath, offset, length)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+			if !info.ModTime.IsZero() {
+				w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			_, err = io.Copy(w, body)
+			return err
+		}
+		if err == errInvalidRange {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		//ranges that can't be parsed, such as multiple ranges, are ignored and the whole object is served
+	}
+
+	body, err := fs.GetObject(objectPath)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(objectPath), info.ModTime, seeker)
+		return nil
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if !compressed {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// parseRange parses a single http byte range, such as bytes=0-499, bytes=500- or bytes=-500, into an offset and length.
+// errInvalidRange is returned when the range lies outside the object
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %s", header)
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unsupported range %s", header)
+	}
+	start, end := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if start == "" {
+		suffix, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unsupported range %s", header)
+		}
+		if suffix <= 0 || size == 0 {
+			return 0, 0, errInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unsupported range %s", header)
+	}
+	if offset < 0 || offset >= size {
+		return 0, 0, errInvalidRange
+	}
+	last := size - 1
+	if end != "" {
+		last, err = strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unsupported range %s", header)
+		}
+		if last < offset {
+			return 0, 0, errInvalidRange
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return offset, last - offset + 1, nil
+}
@@ -0,0 +1,149 @@
+package filestore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve runs ServeObject for a get of the object with the range header, when it isn't empty
+func serve(t *testing.T, fs FileStore, objectPath string, rangeHeader string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/objects"+objectPath, nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	err := ServeObject(fs, w, r, objectPath)
+	return w, err
+}
+
+func TestServeObject(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		if _, err := fs.PutObject("/data.txt", []byte("0123456789"), WithContentType("text/plain")); err != nil {
+			t.Fatal(err)
+		}
+		w, err := serve(t, fs, "/data.txt", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t.Errorf("%s: expected the whole object, got %d %q", name, w.Code, w.Body.String())
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s: expected the Content-Type, got %q", name, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Content-Length") != "10" {
+			t.Errorf("%s: expected a Content-Length of 10, got %q", name, w.Header().Get("Content-Length"))
+		}
+		if w.Header().Get("Last-Modified") == "" {
+			t.Errorf("%s: expected a Last-Modified header", name)
+		}
+
+		tests := []struct {
+			header       string
+			code         int
+			body         string
+			contentRange string
+		}{
+			{"bytes=2-4", http.StatusPartialContent, "234", "bytes 2-4/10"},
+			{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+			{"bytes=-2", http.StatusPartialContent, "89", "bytes 8-9/10"},
+			{"bytes=5-100", http.StatusPartialContent, "56789", "bytes 5-9/10"},
+			{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		}
+		for _, test := range tests {
+			w, err := serve(t, fs, "/data.txt", test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.code {
+				t.Errorf("%s: %s expected %d, got %d", name, test.header, test.code, w.Code)
+				continue
+			}
+			if w.Header().Get("Content-Range") != test.contentRange {
+				t.Errorf("%s: %s expected the Content-Range %s, got %q", name, test.header, test.contentRange, w.Header().Get("Content-Range"))
+			}
+			if test.code == http.StatusPartialContent && w.Body.String() != test.body {
+				t.Errorf("%s: %s expected %q, got %q", name, test.header, test.body, w.Body.String())
+			}
+		}
+
+		if _, err := serve(t, fs, "/missing.txt", ""); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("%s: expected ErrObjectNotFound to be returned, got %v", name, err)
+		}
+	}
+}
+
+func TestServeObjectRangeFromS3(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	mock.put("data.txt", []byte("0123456789"))
+	w, err := serve(t, fs, "/data.txt", "bytes=2-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "234" {
+		t.Errorf("expected the range, got %q", w.Body.String())
+	}
+	if len(mock.ranges) != 1 || mock.ranges[0] != "bytes=2-4" {
+		t.Errorf("expected the range to be read from the bucket, got %v", mock.ranges)
+	}
+	if w.Header().Get("ETag") != mock.object("data.txt").etag {
+		t.Errorf("expected the quoted etag, got %q", w.Header().Get("ETag"))
+	}
+}
+
+func TestServeObjectCompressed(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		if _, err := fs.PutObject("/data.txt", compressible, WithCompression()); err != nil {
+			t.Fatal(err)
+		}
+		w, err := serve(t, fs, "/data.txt", "bytes=0-9")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != string(compressible) {
+			t.Errorf("%s: expected the whole decompressed object, got %d with %d bytes", name, w.Code, w.Body.Len())
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: expected no Content-Length, got %q", name, w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		offset int64
+		length int64
+		err    error
+	}{
+		{"bytes=0-499", 0, 500, nil},
+		{"bytes=500-", 500, 500, nil},
+		{"bytes=-100", 900, 100, nil},
+		{"bytes=-2000", 0, 1000, nil},
+		{"bytes=900-2000", 900, 100, nil},
+		{"bytes=1000-", 0, 0, errInvalidRange},
+		{"bytes=500-400", 0, 0, errInvalidRange},
+		{"bytes=-0", 0, 0, errInvalidRange},
+	}
+	for _, test := range tests {
+		offset, length, err := parseRange(test.header, 1000)
+		if err != test.err {
+			t.Errorf("%s: expected the error %v, got %v", test.header, test.err, err)
+			continue
+		}
+		if offset != test.offset || length != test.length {
+			t.Errorf("%s: expected %d+%d, got %d+%d", test.header, test.offset, test.length, offset, length)
+		}
+	}
+	for _, header := range []string{"bytes=0-1,4-5", "items=0-1", "bytes=a-b", "bytes=5"} {
+		if _, _, err := parseRange(header, 1000); err == nil || err == errInvalidRange {
+			t.Errorf("%s: expected the range to be unsupported, got %v", header, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package filestore
+
+import (
+	"errors"
+	"sync"
+)
+
+// errSessionComplete is returned when an UploadSession is used after Complete
+var errSessionComplete = errors.New("upload session is already complete")
+
+// UploadSession writes an object in chunks through InitializeObjectUpload, WriteChunk and CompleteObjectUpload,
+// keeping track of the upload id, the chunk numbers and the chunk ids so the caller doesn't have to
+type UploadSession struct {
+	fs         FileStore
+	objectPath string
+	uploadID   string
+	chunkIDs   []string
+	complete   bool
+	mu         sync.Mutex
+}
+
+// NewUploadSession initializes a chunked upload of the object at path. Every chunk but the last must be the chunk size
+// of the store
+func NewUploadSession(fs FileStore, path string) (*UploadSession, error) {
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: path})
+	if err != nil {
+		return nil, err
+	}
+	return &UploadSession{
+		fs:         fs,
+		objectPath: path,
+		uploadID:   result.ID,
+	}, nil
+}
+
+// UploadID returns the id of the upload, for logging or for abandoning the upload outside the session
+func (s *UploadSession) UploadID() string {
+	return s.uploadID
+}
+
+// WriteChunk writes the next chunk of the object. Chunks are numbered in the order they are written, so WriteChunk is
+// serialized and a failed chunk can be retried by calling WriteChunk again with the same data
+func (s *UploadSession) WriteChunk(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.complete {
+		return errSessionComplete
+	}
+	result, err := s.fs.WriteChunk(UploadConfig{
+		ObjectPath: s.objectPath,
+		ChunkId:    int64(len(s.chunkIDs)),
+		UploadId:   s.uploadID,
+		Data:       data,
+	})
+	if err != nil {
+		return err
+	}
+	s.chunkIDs = append(s.chunkIDs, result.ID)
+	return nil
+}
+
+// Complete finishes the upload with the chunks written so far. The session can't be written to afterwards
+func (s *UploadSession) Complete() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.complete {
+		return errSessionComplete
+	}
+	err := s.fs.CompleteObjectUpload(CompletedObjectUploadConfig{
+		UploadId:       s.uploadID,
+		ObjectPath:     s.objectPath,
+		ChunkUploadIds: s.chunkIDs,
+	})
+	if err != nil {
+		return err
+	}
+	s.complete = true
+	return nil
+}
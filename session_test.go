@@ -0,0 +1,53 @@
+package filestore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUploadSession(t *testing.T) {
+	blockfs, err := NewBlockFS(BlockFSConfig{RootDir: t.TempDir(), ChunkSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3fs, _ := newTestS3FS(t)
+	s3Chunk := bytes.Repeat([]byte("s"), int(s3MinPartSize))
+	tests := []struct {
+		name   string
+		fs     FileStore
+		chunks [][]byte
+	}{
+		{"BlockFS", blockfs, [][]byte{[]byte("abcd"), []byte("efgh"), []byte("ij")}},
+		{"S3FS", s3fs, [][]byte{s3Chunk, s3Chunk, []byte("last")}},
+	}
+	for _, test := range tests {
+		session, err := NewUploadSession(test.fs, "/session.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.UploadID() == "" {
+			t.Errorf("%s: expected an upload id", test.name)
+		}
+		for _, chunk := range test.chunks {
+			if err := session.WriteChunk(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := session.Complete(); err != nil {
+			t.Fatal(err)
+		}
+		content, err := GetObjectBytes(test.fs, "/session.bin", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, bytes.Join(test.chunks, nil)) {
+			t.Errorf("%s: expected the three chunks in order, got %d bytes", test.name, len(content))
+		}
+		if err := session.WriteChunk([]byte("more")); err == nil {
+			t.Errorf("%s: expected writing to a completed session to fail", test.name)
+		}
+		if err := session.Complete(); err == nil {
+			t.Errorf("%s: expected completing twice to fail", test.name)
+		}
+	}
+}
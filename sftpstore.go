@@ -0,0 +1,576 @@
+package filestore
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPFSConfig stores the connection settings and credentials necessary to create an sftp instance of the filestore
+type SFTPFSConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// PrivateKey is a PEM encoded private key used instead of, or in addition to, the password
+	PrivateKey string
+	// HostKey is the server public key in authorized_keys format. It is required unless InsecureIgnoreHostKey is set
+	HostKey               string
+	InsecureIgnoreHostKey bool
+	// BasePath is prepended to every path, scoping the store to a directory on the server
+	BasePath  string
+	ChunkSize int64
+}
+
+// SFTPFS satisfies the FileStore interface, allowing for generic file operations to be done on an sftp server
+type SFTPFS struct {
+	conn      *ssh.Client
+	client    *sftp.Client
+	config    *SFTPFSConfig
+	chunkSize int64
+	options   storeOptions
+}
+
+// NewSFTPFS connects to the sftp server in the config
+func NewSFTPFS(config SFTPFSConfig, opts ...Option) (*SFTPFS, error) {
+	sshConfig := &ssh.ClientConfig{
+		User: config.User,
+	}
+	if config.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing sftp private key: %w", err)
+		}
+		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(config.Password))
+	}
+	switch {
+	case config.HostKey != "":
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing sftp host key: %w", err)
+		}
+		sshConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	case config.InsecureIgnoreHostKey:
+		sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("sftp config requires a HostKey or InsecureIgnoreHostKey")
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 22
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(config.Host, strconv.Itoa(port)), sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	fs := SFTPFS{
+		conn:      conn,
+		client:    client,
+		config:    &config,
+		chunkSize: defaultChunkSize,
+		options:   newStoreOptions(opts),
+	}
+	if config.ChunkSize > 0 {
+		fs.chunkSize = config.ChunkSize
+	}
+	return &fs, nil
+}
+
+// GetDir lists the contents of the remote directory, with the option of being recursive
+func (s *SFTPFS) GetDir(dirPath string, recursive bool) (_ *[]FileStoreResultObject, err error) {
+	defer s.options.observe("GetDir", 0)(&err)
+	remotePath := s.remotePath(dirPath)
+	var objects []FileStoreResultObject
+	switch recursive {
+	case true:
+		objects = make([]FileStoreResultObject, 0)
+		walker := s.client.Walk(remotePath)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return nil, err
+			}
+			file := walker.Stat()
+			objects = append(objects, FileStoreResultObject{
+				ID:         len(objects),
+				Name:       file.Name(),
+				Size:       strconv.FormatInt(file.Size(), 10),
+				SizeBytes:  file.Size(),
+				Path:       s.storePath(path.Dir(walker.Path())),
+				Type:       path.Ext(file.Name()),
+				IsDir:      file.IsDir(),
+				Modified:   file.ModTime(),
+				ModifiedBy: "",
+			})
+		}
+
+	case false:
+		contents, err := s.client.ReadDir(remotePath)
+		if err != nil {
+			return nil, fsError(dirPath, err)
+		}
+		objects = make([]FileStoreResultObject, len(contents))
+		for i, f := range contents {
+			objects[i] = FileStoreResultObject{
+				ID:         i,
+				Name:       f.Name(),
+				Size:       strconv.FormatInt(f.Size(), 10),
+				SizeBytes:  f.Size(),
+				Path:       dirPath,
+				Type:       path.Ext(f.Name()),
+				IsDir:      f.IsDir(),
+				Modified:   f.ModTime(),
+				ModifiedBy: "",
+			}
+		}
+	}
+	sortResults(objects)
+	return &objects, nil
+}
+
+// GetDirPage lists a single page of the entries directly in the remote directory, in name order. See BlockFS.GetDirPage
+func (s *SFTPFS) GetDirPage(dirPath string, token string, pageSize int) (_ []FileStoreResultObject, _ string, err error) {
+	defer s.options.observe("GetDirPage", 0)(&err)
+	remotePath := s.remotePath(dirPath)
+	contents, err := s.client.ReadDir(remotePath)
+	if err != nil {
+		return nil, "", fsError(dirPath, err)
+	}
+	page, next := pageEntries(contents, token, pageSize)
+	objects := make([]FileStoreResultObject, len(page))
+	for i, f := range page {
+		objects[i] = fileResult(i, s.storePath(path.Join(remotePath, f.Name())), f)
+	}
+	return objects, next, nil
+}
+
+// ListDirs returns the names of the directories directly in the remote directory, sorted by name
+func (s *SFTPFS) ListDirs(dirPath string) (_ []string, err error) {
+	defer s.options.observe("ListDirs", 0)(&err)
+	contents, err := s.client.ReadDir(s.remotePath(dirPath))
+	if err != nil {
+		return nil, fsError(dirPath, err)
+	}
+	return dirNames(contents), nil
+}
+
+// GetObject opens the remote file for reading. The caller must close it
+func (s *SFTPFS) GetObject(filePath string) (reader io.ReadCloser, err error) {
+	defer s.options.observeRead("GetObject")(&reader, &err)
+	f, err := s.client.Open(s.remotePath(filePath))
+	if err != nil {
+		return nil, fsError(filePath, err)
+	}
+	return s.options.limitReadCloser(f), nil
+}
+
+// GetObjectInfo stats the remote file and sniffs its content type from the first 512 bytes
+func (s *SFTPFS) GetObjectInfo(filePath string) (_ *ObjectInfo, err error) {
+	defer s.options.observe("GetObjectInfo", 0)(&err)
+	remotePath := s.remotePath(filePath)
+	fi, err := s.client.Stat(remotePath)
+	if err != nil {
+		return nil, fsError(filePath, err)
+	}
+	info := &ObjectInfo{
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Metadata: map[string]string{},
+	}
+	if fi.IsDir() {
+		return info, nil
+	}
+	f, err := s.client.Open(remotePath)
+	if err != nil {
+		return nil, fsError(filePath, err)
+	}
+	defer f.Close()
+	info.ContentType, err = sniffContentType(f)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Size returns the size of the remote file in bytes
+func (s *SFTPFS) Size(filePath string) (_ int64, err error) {
+	defer s.options.observe("Size", 0)(&err)
+	fi, err := s.client.Stat(s.remotePath(filePath))
+	if err != nil {
+		return 0, fsError(filePath, err)
+	}
+	return fi.Size(), nil
+}
+
+// PutObject writes the data to the remote file, creating parent directories as needed.
+// Empty data writes an empty file, matching BlockFS
+func (s *SFTPFS) PutObject(filePath string, data []byte, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer s.options.observe("PutObject", int64(len(data)))(&err)
+	defer func() { s.options.uploaded(filePath, output, err) }()
+	options := newUploadOptions(opts)
+	if options.compress {
+		return nil, fmt.Errorf("%w: compression on sftp", ErrNotSupported)
+	}
+	if options.retention != nil {
+		return nil, fmt.Errorf("%w: retention on sftp", ErrNotSupported)
+	}
+	remotePath := s.remotePath(filePath)
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return nil, err
+	}
+	if err := s.checkConditions(filePath, remotePath, options); err != nil {
+		return nil, err
+	}
+	f, err := s.client.Create(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	n, err := f.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	output = &FileOperationOutput{
+		Md5:         fmt.Sprintf("%x", md5.Sum(data)),
+		ContentType: options.contentType,
+		Size:        int64(n),
+	}
+	if output.ContentType == "" {
+		output.ContentType = detectContentType(filePath, data)
+	}
+	return output, nil
+}
+
+// checkConditions checks the remote file against WithIfMatch and WithIfAbsent before it is written
+func (s *SFTPFS) checkConditions(filePath string, remotePath string, options uploadOptions) error {
+	if options.ifMatch != "" {
+		if err := s.checkETag(filePath, remotePath, options.ifMatch); err != nil {
+			return err
+		}
+	}
+	if options.ifAbsent {
+		f, err := s.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			//servers report an exclusive create of an existing file as a generic failure
+			if _, statErr := s.client.Stat(remotePath); statErr == nil {
+				return fmt.Errorf("%w: %s", ErrAlreadyExists, filePath)
+			}
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// checkETag compares the md5 of the remote file to the expected etag. There is no lock on the server,
+// so a write by another client between the check and the write can still be lost
+func (s *SFTPFS) checkETag(filePath string, remotePath string, expected string) error {
+	f, err := s.client.Open(remotePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s does not exist", ErrPreconditionFailed, filePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return checkETag(filePath, expected, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// DeleteObjects removes the remote files, removing directories along with their contents
+func (s *SFTPFS) DeleteObjects(paths ...string) (err error) {
+	defer s.options.observe("DeleteObjects", 0)(&err)
+	for _, p := range paths {
+		remotePath := s.remotePath(p)
+		info, statErr := s.client.Stat(remotePath)
+		if statErr != nil {
+			err = fsError(p, statErr)
+			continue
+		}
+		if info.IsDir() {
+			err = s.removeAll(remotePath)
+		} else {
+			err = s.client.Remove(remotePath)
+		}
+	}
+	return err
+}
+
+// Append adds the data to the end of the remote file, creating the file and its parent directories when they don't exist
+func (s *SFTPFS) Append(filePath string, data []byte) (err error) {
+	defer s.options.observe("Append", int64(len(data)))(&err)
+	remotePath := s.remotePath(filePath)
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	f, err := s.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	//not every server honors the append flag, so write from the current end of the file
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// CreateDir creates the remote directory at filePath, along with any missing parents
+func (s *SFTPFS) CreateDir(filePath string) (err error) {
+	defer s.options.observe("CreateDir", 0)(&err)
+	return s.client.MkdirAll(s.remotePath(filePath))
+}
+
+// CreateEmptyObject creates an empty remote file at filePath, truncating the file if it already exists
+func (s *SFTPFS) CreateEmptyObject(filePath string) error {
+	_, err := s.PutObject(filePath, nil)
+	return err
+}
+
+// Touch sets the modification time of the remote file to now without changing its content, creating an empty file when
+// it doesn't exist
+func (s *SFTPFS) Touch(filePath string) (err error) {
+	defer s.options.observe("Touch", 0)(&err)
+	now := time.Now()
+	err = s.client.Chtimes(s.remotePath(filePath), now, now)
+	if os.IsNotExist(err) {
+		return s.CreateEmptyObject(filePath)
+	}
+	return err
+}
+
+func (s *SFTPFS) removeAll(remotePath string) error {
+	var dirs []string
+	walker := s.client.Walk(remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if walker.Stat().IsDir() {
+			dirs = append(dirs, walker.Path())
+			continue
+		}
+		if err := s.client.Remove(walker.Path()); err != nil {
+			return err
+		}
+	}
+	//directories are visited parents first, so remove them in reverse
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := s.client.RemoveDirectory(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload streams the reader to the remote file at key, creating parent directories as needed.
+// The output has the md5 and size of the content and its content type
+func (s *SFTPFS) Upload(reader io.Reader, key string, opts ...UploadOption) (output *FileOperationOutput, err error) {
+	defer s.options.observeUpload("Upload")(&output, &err)
+	defer func() { s.options.uploaded(key, output, err) }()
+	options := newUploadOptions(opts)
+	if options.compress {
+		return nil, fmt.Errorf("%w: compression on sftp", ErrNotSupported)
+	}
+	if options.retention != nil {
+		return nil, fmt.Errorf("%w: retention on sftp", ErrNotSupported)
+	}
+	reader, hashing, err := prepareUpload(reader, key, &options, s.options)
+	if err != nil {
+		return nil, err
+	}
+	remotePath := s.remotePath(key)
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return nil, err
+	}
+	if err := s.checkConditions(key, remotePath, options); err != nil {
+		return nil, err
+	}
+	f, err := s.client.Create(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOperationOutput{
+		Md5:         hashing.md5(),
+		ContentType: options.contentType,
+		Size:        hashing.size,
+	}, nil
+}
+
+// UploadFile uploads the local file to the remote file at key
+func (s *SFTPFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	return uploadFile(s, filePath, key, opts)
+}
+
+func (s *SFTPFS) InitializeObjectUpload(u UploadConfig) (_ UploadResult, err error) {
+	defer s.options.observe("InitializeObjectUpload", 0)(&err)
+	result := UploadResult{}
+	remotePath := s.remotePath(u.ObjectPath)
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return result, err
+	}
+	f, err := s.client.Create(remotePath)
+	if err != nil {
+		return result, err
+	}
+	_ = f.Close()
+	result.ID = uuid.New().String()
+	return result, nil
+}
+
+// WriteChunk writes the chunk into the remote file at the offset for its chunk id
+func (s *SFTPFS) WriteChunk(u UploadConfig) (_ UploadResult, err error) {
+	defer s.options.observe("WriteChunk", int64(len(u.Data)))(&err)
+	result := UploadResult{}
+	f, err := s.client.OpenFile(s.remotePath(u.ObjectPath), os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(u.Data, u.ChunkId*s.chunkSize)
+	result.WriteSize = len(u.Data)
+	return result, err
+}
+
+func (s *SFTPFS) CompleteObjectUpload(u CompletedObjectUploadConfig) (err error) {
+	defer s.options.observe("CompleteObjectUpload", 0)(&err)
+	if s.options.onUpload != nil {
+		fi, err := s.client.Stat(s.remotePath(u.ObjectPath))
+		if err != nil {
+			return err
+		}
+		s.options.uploaded(u.ObjectPath, &FileOperationOutput{Size: fi.Size()}, nil)
+	}
+	return nil
+}
+
+// Glob returns the remote files and directories matching the pattern, using the syntax of path.Match
+func (s *SFTPFS) Glob(pattern string) (_ []FileStoreResultObject, err error) {
+	defer s.options.observe("Glob", 0)(&err)
+	matches, err := s.client.Glob(s.remotePath(pattern))
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]FileStoreResultObject, 0, len(matches))
+	for _, match := range matches {
+		fi, err := s.client.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, fileResult(len(objects), s.storePath(match), fi))
+	}
+	sortResults(objects)
+	return objects, nil
+}
+
+// Walk visits every file and directory under the remote path
+func (s *SFTPFS) Walk(walkPath string, vistorFunction FileVisitFunction) error {
+	return s.WalkContext(context.Background(), walkPath, vistorFunction)
+}
+
+// WalkContext is Walk with cancellation. The visitor can return ErrStopWalk to end the walk early without an error
+func (s *SFTPFS) WalkContext(ctx context.Context, walkPath string, vistorFunction FileVisitFunction) (err error) {
+	defer s.options.observe("WalkContext", 0)(&err)
+	walker := s.client.Walk(s.remotePath(walkPath))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := vistorFunction(s.storePath(walker.Path()), walker.Stat())
+		if errors.Is(err, ErrStopWalk) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkDir visits every file and directory under the remote path. Returning filepath.SkipDir from the visitor prunes that directory
+func (s *SFTPFS) WalkDir(walkPath string, visitorFunction WalkDirFunction) (err error) {
+	defer s.options.observe("WalkDir", 0)(&err)
+	walker := s.client.Walk(s.remotePath(walkPath))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		info := walker.Stat()
+		err := visitorFunction(s.storePath(walker.Path()), info, info.IsDir())
+		if err == filepath.SkipDir {
+			walker.SkipDir()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks that the connection is alive and the base path exists
+func (s *SFTPFS) Ping() (err error) {
+	defer s.options.observe("Ping", 0)(&err)
+	base := s.remotePath("/")
+	if _, err := s.client.Stat(base); err != nil {
+		return fmt.Errorf("sftp path %s on %s is not reachable: %w", base, s.config.Host, err)
+	}
+	return nil
+}
+
+// Close closes the sftp session and the ssh connection it runs over
+func (s *SFTPFS) Close() error {
+	err := s.client.Close()
+	if connErr := s.conn.Close(); err == nil {
+		err = connErr
+	}
+	return err
+}
+
+// remotePath scopes the store path to the configured base path, cleaning it so it can't escape the base
+func (s *SFTPFS) remotePath(storePath string) string {
+	return path.Join(s.config.BasePath, path.Clean("/"+storePath))
+}
+
+// storePath converts a remote path back into the path used by callers of the store
+func (s *SFTPFS) storePath(remotePath string) string {
+	base := path.Clean(s.config.BasePath)
+	if base != "." && base != "/" {
+		remotePath = strings.TrimPrefix(remotePath, base)
+	}
+	return "/" + strings.TrimPrefix(remotePath, "/")
+}
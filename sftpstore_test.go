@@ -0,0 +1,188 @@
+package filestore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSFTPFS returns a store connected over pipes to an in process sftp server, with its base path at a new temp directory
+func newTestSFTPFS(t *testing.T, opts ...Option) (*SFTPFS, string) {
+	t.Helper()
+	root := t.TempDir()
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//closing the server ends the read loop of the client, which its Close waits for
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	fs := &SFTPFS{
+		client:    client,
+		config:    &SFTPFSConfig{BasePath: root},
+		chunkSize: defaultChunkSize,
+		options:   newStoreOptions(opts),
+	}
+	return fs, root
+}
+
+func TestSFTPRoundTrip(t *testing.T) {
+	fs, root := newTestSFTPFS(t)
+	if _, err := fs.PutObject("/dir/data.txt", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "dir", "data.txt")); err != nil || string(data) != "content" {
+		t.Errorf("expected the file under the base path, got %q %v", data, err)
+	}
+	if content := readObject(t, fs, "/dir/data.txt"); content != "content" {
+		t.Errorf("expected the content, got %q", content)
+	}
+	size, err := fs.Size("/dir/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 7 {
+		t.Errorf("expected a size of 7, got %d", size)
+	}
+	if _, err := fs.GetObject("/dir/missing.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+
+	objects, err := fs.GetDir("/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*objects) != 1 || (*objects)[0].Name != "data.txt" || (*objects)[0].SizeBytes != 7 {
+		t.Errorf("expected the file in the listing, got %v", *objects)
+	}
+	page, next, err := fs.GetDirPage("/", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" || len(page) != 1 || page[0].Name != "dir" || !page[0].IsDir || page[0].Path != "/" {
+		t.Errorf("expected the directory in the page, got %v next %q", page, next)
+	}
+
+	if err := fs.DeleteObjects("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed, got %v", err)
+	}
+}
+
+func TestSFTPPathsStayUnderBasePath(t *testing.T) {
+	fs, root := newTestSFTPFS(t)
+	for _, p := range []string{"../escape.txt", "/../../escape.txt", "a/../../escape.txt"} {
+		if _, err := fs.PutObject(p, []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "escape.txt")); err != nil {
+			t.Errorf("%s: expected the file to be written under the base path, got %v", p, err)
+		}
+		if remote := fs.remotePath(p); remote != filepath.ToSlash(filepath.Join(root, "escape.txt")) {
+			t.Errorf("%s: expected the remote path under the base path, got %s", p, remote)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escape.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the base path, got %v", err)
+	}
+	if p := fs.storePath(fs.remotePath("dir/data.txt")); p != "/dir/data.txt" {
+		t.Errorf("expected the store path back from the remote path, got %s", p)
+	}
+}
+
+func TestSFTPUnsupportedUploadOptions(t *testing.T) {
+	fs, root := newTestSFTPFS(t)
+	options := map[string]UploadOption{
+		"compression": WithCompression(),
+		"retention":   WithRetention("GOVERNANCE", time.Now().Add(time.Hour)),
+	}
+	for name, option := range options {
+		if _, err := fs.PutObject("/data.txt", []byte("content"), option); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("PutObject with %s: expected ErrNotSupported, got %v", name, err)
+		}
+		if _, err := fs.Upload(strings.NewReader("content"), "/data.txt", option); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("Upload with %s: expected ErrNotSupported, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "data.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written, got %v", err)
+	}
+}
+
+func TestSFTPUploadConditions(t *testing.T) {
+	fs, _ := newTestSFTPFS(t)
+	output, err := fs.PutObject("/data.txt", []byte("original"), WithIfAbsent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Upload(strings.NewReader("replaced"), "/data.txt", WithIfAbsent()); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+	if _, err := fs.PutObject("/data.txt", []byte("replaced"), WithIfMatch("d41d8cd98f00b204e9800998ecf8427e")); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for a stale md5, got %v", err)
+	}
+	if _, err := fs.PutObject("/missing.txt", []byte("replaced"), WithIfMatch(output.Md5)); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed for a missing file, got %v", err)
+	}
+	if content := readObject(t, fs, "/data.txt"); content != "original" {
+		t.Errorf("expected the failed writes to leave the file, got %q", content)
+	}
+	if _, err := fs.Upload(strings.NewReader("replaced"), "/data.txt", WithIfMatch(output.Md5)); err != nil {
+		t.Fatal(err)
+	}
+	if content := readObject(t, fs, "/data.txt"); content != "replaced" {
+		t.Errorf("expected the matching write to replace the file, got %q", content)
+	}
+}
+
+func TestSFTPChunkedUpload(t *testing.T) {
+	fs, _ := newTestSFTPFS(t)
+	fs.chunkSize = 4
+	result, err := fs.InitializeObjectUpload(UploadConfig{ObjectPath: "/dir/chunked.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"0123", "4567", "89"}
+	//chunks are written at the offset of their id, so they can arrive in any order
+	for _, id := range []int64{2, 0, 1} {
+		u := UploadConfig{ObjectPath: "/dir/chunked.txt", UploadId: result.ID, ChunkId: id, Data: []byte(chunks[id])}
+		if _, err := fs.WriteChunk(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.CompleteObjectUpload(CompletedObjectUploadConfig{ObjectPath: "/dir/chunked.txt", UploadId: result.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if content := readObject(t, fs, "/dir/chunked.txt"); content != strings.Join(chunks, "") {
+		t.Errorf("expected the chunks in order, got %q", content)
+	}
+	dirs, err := fs.ListDirs("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dirs, []string{"dir"}) {
+		t.Errorf("expected [dir], got %v", dirs)
+	}
+}
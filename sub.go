@@ -0,0 +1,272 @@
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Sub returns a view of the store confined to prefix. Paths passed to the view are joined to the prefix,
+// paths that would climb out of the prefix are rejected with ErrPathTraversal, and the prefix is stripped from listing results
+func Sub(fs FileStore, prefix string) FileStore {
+	return &subFS{
+		fs:     fs,
+		prefix: strings.Trim(prefix, "/"),
+	}
+}
+
+type subFS struct {
+	fs     FileStore
+	prefix string
+}
+
+// fullPath joins the path to the prefix. The root of the view keeps a trailing "/", so listing it on s3 doesn't match
+// the keys of a sibling that starts with the prefix, such as 420 for a prefix of 42
+func (s *subFS) fullPath(p string) (string, error) {
+	rel := path.Clean(strings.TrimPrefix(p, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%w: %s", ErrPathTraversal, p)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	full := path.Join("/", s.prefix, rel)
+	if (rel == "" || strings.HasSuffix(p, "/")) && full != "/" {
+		full += "/"
+	}
+	return full, nil
+}
+
+// subPath strips the prefix from a path returned by the underlying store. It reports false for a path outside the
+// prefix, which is left out of the results of the view
+func (s *subFS) subPath(p string) (string, bool) {
+	if s.prefix == "" {
+		return p, true
+	}
+	trimmed := strings.TrimPrefix(p, "/")
+	if trimmed == s.prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(trimmed, s.prefix+"/") {
+		return "/" + strings.TrimPrefix(trimmed, s.prefix+"/"), true
+	}
+	return p, false
+}
+
+// subResults strips the prefix from the paths of listing results, dropping the results outside the prefix
+func (s *subFS) subResults(objects []FileStoreResultObject) []FileStoreResultObject {
+	results := objects[:0]
+	for _, o := range objects {
+		p, ok := s.subPath(o.Path)
+		if !ok {
+			continue
+		}
+		o.Path = p
+		results = append(results, o)
+	}
+	return results
+}
+
+func (s *subFS) GetDir(dirPath string, recursive bool) (*[]FileStoreResultObject, error) {
+	full, err := s.fullPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.fs.GetDir(full, recursive)
+	if err != nil {
+		return nil, err
+	}
+	results := s.subResults(*objects)
+	return &results, nil
+}
+
+func (s *subFS) GetDirPage(dirPath string, token string, pageSize int) ([]FileStoreResultObject, string, error) {
+	full, err := s.fullPath(dirPath)
+	if err != nil {
+		return nil, "", err
+	}
+	objects, next, err := s.fs.GetDirPage(full, token, pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.subResults(objects), next, nil
+}
+
+func (s *subFS) ListDirs(dirPath string) ([]string, error) {
+	full, err := s.fullPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.ListDirs(full)
+}
+
+func (s *subFS) GetObject(filePath string) (io.ReadCloser, error) {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.GetObject(full)
+}
+
+func (s *subFS) GetObjectInfo(filePath string) (*ObjectInfo, error) {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.GetObjectInfo(full)
+}
+
+func (s *subFS) Size(filePath string) (int64, error) {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return s.fs.Size(full)
+}
+
+func (s *subFS) PutObject(filePath string, data []byte, opts ...UploadOption) (*FileOperationOutput, error) {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.PutObject(full, data, opts...)
+}
+
+func (s *subFS) DeleteObjects(paths ...string) error {
+	fullPaths := make([]string, len(paths))
+	for i, p := range paths {
+		full, err := s.fullPath(p)
+		if err != nil {
+			return err
+		}
+		fullPaths[i] = full
+	}
+	return s.fs.DeleteObjects(fullPaths...)
+}
+
+func (s *subFS) Append(filePath string, data []byte) error {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
+	return s.fs.Append(full, data)
+}
+
+func (s *subFS) CreateDir(filePath string) error {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
+	return s.fs.CreateDir(full)
+}
+
+func (s *subFS) CreateEmptyObject(filePath string) error {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
+	return s.fs.CreateEmptyObject(full)
+}
+
+func (s *subFS) Touch(filePath string) error {
+	full, err := s.fullPath(filePath)
+	if err != nil {
+		return err
+	}
+	return s.fs.Touch(full)
+}
+
+func (s *subFS) Upload(reader io.Reader, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	full, err := s.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.Upload(reader, full, opts...)
+}
+
+func (s *subFS) UploadFile(filePath string, key string, opts ...UploadOption) (*FileOperationOutput, error) {
+	full, err := s.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.fs.UploadFile(filePath, full, opts...)
+}
+
+func (s *subFS) Glob(pattern string) ([]FileStoreResultObject, error) {
+	full, err := s.fullPath(pattern)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.fs.Glob(full)
+	if err != nil {
+		return nil, err
+	}
+	return s.subResults(objects), nil
+}
+
+func (s *subFS) Walk(walkPath string, vistorFunction FileVisitFunction) error {
+	return s.WalkContext(context.Background(), walkPath, vistorFunction)
+}
+
+func (s *subFS) WalkDir(walkPath string, visitorFunction WalkDirFunction) error {
+	full, err := s.fullPath(walkPath)
+	if err != nil {
+		return err
+	}
+	return s.fs.WalkDir(full, func(p string, file os.FileInfo, isDir bool) error {
+		subPath, ok := s.subPath(p)
+		if !ok {
+			return nil
+		}
+		return visitorFunction(subPath, file, isDir)
+	})
+}
+
+func (s *subFS) WalkContext(ctx context.Context, walkPath string, vistorFunction FileVisitFunction) error {
+	full, err := s.fullPath(walkPath)
+	if err != nil {
+		return err
+	}
+	return s.fs.WalkContext(ctx, full, func(p string, file os.FileInfo) error {
+		subPath, ok := s.subPath(p)
+		if !ok {
+			return nil
+		}
+		return vistorFunction(subPath, file)
+	})
+}
+
+func (s *subFS) InitializeObjectUpload(u UploadConfig) (UploadResult, error) {
+	full, err := s.fullPath(u.ObjectPath)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	u.ObjectPath = full
+	return s.fs.InitializeObjectUpload(u)
+}
+
+func (s *subFS) WriteChunk(u UploadConfig) (UploadResult, error) {
+	full, err := s.fullPath(u.ObjectPath)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	u.ObjectPath = full
+	return s.fs.WriteChunk(u)
+}
+
+func (s *subFS) CompleteObjectUpload(u CompletedObjectUploadConfig) error {
+	full, err := s.fullPath(u.ObjectPath)
+	if err != nil {
+		return err
+	}
+	u.ObjectPath = full
+	return s.fs.CompleteObjectUpload(u)
+}
+
+// Close closes the store the sub store was created from, so it should only be called when neither is used again
+func (s *subFS) Close() error {
+	return s.fs.Close()
+}
@@ -0,0 +1,109 @@
+package filestore
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// subTestStores returns a BlockFS and an S3FS holding the objects of a prefix and of a sibling that starts with it
+func subTestStores(t *testing.T) map[string]FileStore {
+	t.Helper()
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for _, fs := range stores {
+		putKeys(t, fs, "/42/a.txt", "/420/b.txt", "/4201.txt")
+	}
+	return stores
+}
+
+// resultFiles returns the names of the files in listing results, failing on a path outside of the view
+func resultFiles(t *testing.T, name string, objects []FileStoreResultObject) []string {
+	t.Helper()
+	var files []string
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Path, "/") || strings.Contains(o.Path, "42") {
+			t.Errorf("%s: expected a path relative to the view, got %s", name, o.Path)
+		}
+		if !o.IsDir {
+			files = append(files, o.Name)
+		}
+	}
+	return files
+}
+
+func TestSubExcludesSiblingPrefix(t *testing.T) {
+	for name, store := range subTestStores(t) {
+		fs := Sub(store, "42")
+		expected := []string{"a.txt"}
+
+		for _, root := range []string{"", ".", "/"} {
+			visited := walkedFiles(t, func(visit FileVisitFunction) error {
+				return fs.Walk(root, visit)
+			})
+			if !reflect.DeepEqual(visited, []string{"/a.txt"}) {
+				t.Errorf("%s: Walk(%q) expected [/a.txt], got %v", name, root, visited)
+			}
+		}
+
+		var walkedDir []string
+		err := fs.WalkDir("", func(p string, file os.FileInfo, isDir bool) error {
+			if !isDir {
+				walkedDir = append(walkedDir, p)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(walkedDir, []string{"/a.txt"}) {
+			t.Errorf("%s: WalkDir expected [/a.txt], got %v", name, walkedDir)
+		}
+
+		objects, err := fs.GetDir("", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files := resultFiles(t, name, *objects); !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: GetDir expected %v, got %v", name, expected, files)
+		}
+
+		page, _, err := fs.GetDirPage("", "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files := resultFiles(t, name, page); !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: GetDirPage expected %v, got %v", name, expected, files)
+		}
+
+		matches, err := fs.Glob("/*.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files := resultFiles(t, name, matches); !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: Glob expected %v, got %v", name, expected, files)
+		}
+	}
+}
+
+func TestSubRejectsEscape(t *testing.T) {
+	for name, store := range subTestStores(t) {
+		fs := Sub(store, "42")
+		for _, p := range []string{"../420/b.txt", "/../420/b.txt", "a/../../420/b.txt", ".."} {
+			if _, err := fs.GetObject(p); !errors.Is(err, ErrPathTraversal) {
+				t.Errorf("%s: GetObject(%q) expected ErrPathTraversal, got %v", name, p, err)
+			}
+			if _, err := fs.GetDir(p, false); !errors.Is(err, ErrPathTraversal) {
+				t.Errorf("%s: GetDir(%q) expected ErrPathTraversal, got %v", name, p, err)
+			}
+			if err := fs.Walk(p, func(string, os.FileInfo) error { return nil }); !errors.Is(err, ErrPathTraversal) {
+				t.Errorf("%s: Walk(%q) expected ErrPathTraversal, got %v", name, p, err)
+			}
+		}
+		if _, err := store.GetObjectInfo("/420/b.txt"); err != nil {
+			t.Errorf("%s: expected the sibling to be untouched, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WalkConcurrent walks the path like Walk but calls the visitor from a pool of workers, so slow visitors such as
+// checksumming can process many objects in parallel. The visitor is called from several goroutines at once and must be
+// safe for concurrent use. The first error returned by a visitor cancels the listing and the remaining visits and is returned,
+// except for ErrStopWalk, which ends the walk without an error. A workers count of zero or less uses 8 workers
+func WalkConcurrent(fs FileStore, path string, workers int, vistorFunction FileVisitFunction) error {
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type visit struct {
+		path string
+		file os.FileInfo
+	}
+	visits := make(chan visit)
+	var once sync.Once
+	var visitErr error
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range visits {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := vistorFunction(v.path, v.file); err != nil {
+					once.Do(func() {
+						visitErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	walkErr := fs.WalkContext(ctx, path, func(filePath string, file os.FileInfo) error {
+		select {
+		case visits <- visit{path: filePath, file: file}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(visits)
+	wg.Wait()
+
+	if visitErr != nil {
+		if errors.Is(visitErr, ErrStopWalk) {
+			return nil
+		}
+		return visitErr
+	}
+	return walkErr
+}
+
+// afterWalker is implemented by stores that can start a listing after a key without listing the keys before it
+type afterWalker interface {
+	WalkAfter(path string, startAfter string, vistorFunction FileVisitFunction) error
+}
+
+// WalkAfter walks the path like Walk but only visits the objects whose paths sort after startAfter, so a scan that
+// stopped at a known path can resume where it left off. s3 starts the listing at startAfter, other stores walk the
+// whole path and skip the paths up to it. A leading slash on startAfter is ignored
+func WalkAfter(fs FileStore, path string, startAfter string, vistorFunction FileVisitFunction) error {
+	if w, ok := fs.(afterWalker); ok {
+		return w.WalkAfter(path, startAfter, vistorFunction)
+	}
+	marker := strings.TrimPrefix(startAfter, "/")
+	return fs.Walk(path, func(filePath string, file os.FileInfo) error {
+		if strings.TrimPrefix(filePath, "/") <= marker {
+			return nil
+		}
+		return vistorFunction(filePath, file)
+	})
+}
+
+// afterLister is implemented by stores that can start a directory listing after a key without listing the keys before it
+type afterLister interface {
+	GetDirAfter(dirPath string, startAfter string, recursive bool) (*[]FileStoreResultObject, error)
+}
+
+// GetDirAfter lists the directory like GetDir but only returns the entries whose paths sort after startAfter, so a
+// listing that stopped at a known path can resume where it left off. s3 starts the listing at startAfter, other stores
+// list the whole directory and drop the entries up to it. A leading slash on startAfter is ignored
+func GetDirAfter(fs FileStore, dirPath string, startAfter string, recursive bool) (*[]FileStoreResultObject, error) {
+	if l, ok := fs.(afterLister); ok {
+		return l.GetDirAfter(dirPath, startAfter, recursive)
+	}
+	objects, err := fs.GetDir(dirPath, recursive)
+	if err != nil {
+		return nil, err
+	}
+	marker := strings.TrimPrefix(startAfter, "/")
+	after := []FileStoreResultObject{}
+	for _, object := range *objects {
+		if strings.TrimPrefix(path.Join(object.Path, object.Name), "/") <= marker {
+			continue
+		}
+		object.ID = len(after)
+		after = append(after, object)
+	}
+	return &after, nil
+}
@@ -0,0 +1,439 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// putKeys writes an object for each of the keys
+func putKeys(t *testing.T, fs FileStore, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if _, err := fs.PutObject(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func walkedFiles(t *testing.T, walk func(FileVisitFunction) error) []string {
+	t.Helper()
+	var visited []string
+	err := walk(func(filePath string, file os.FileInfo) error {
+		if !file.IsDir() {
+			visited = append(visited, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return visited
+}
+
+func TestWalkAfterSkipsEarlierKeys(t *testing.T) {
+	var keys []string
+	for i := 40; i < 45; i++ {
+		keys = append(keys, fmt.Sprintf("/data/%05d", i))
+	}
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		putKeys(t, fs, keys...)
+		visited := walkedFiles(t, func(visit FileVisitFunction) error {
+			return WalkAfter(fs, "/data", "data/00042", visit)
+		})
+		expected := []string{"/data/00043", "/data/00044"}
+		if !reflect.DeepEqual(visited, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, visited)
+		}
+	}
+}
+
+func TestWalkAfterStartsS3ListingAtMarker(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	putKeys(t, fs, "/data/00001", "/data/00002")
+	if err := fs.WalkAfter("/data", "/data/00001", func(string, os.FileInfo) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if mock.count("ListObjectsV2") != 1 {
+		t.Errorf("expected a single listing, got %d", mock.count("ListObjectsV2"))
+	}
+}
+
+func TestGetDirAfterSkipsEarlierKeys(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		putKeys(t, fs, "/data/00041", "/data/00042", "/data/00043", "/data/00044")
+		for _, recursive := range []bool{false, true} {
+			objects, err := GetDirAfter(fs, "/data", "/data/00042", recursive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for i, object := range *objects {
+				if object.ID != i {
+					t.Errorf("%s: expected the entries to be numbered from 0, got %d at %d", name, object.ID, i)
+				}
+				names = append(names, path.Join(object.Path, object.Name))
+			}
+			expected := []string{"/data/00043", "/data/00044"}
+			if name == "S3FS" {
+				expected = []string{"data/00043", "data/00044"}
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("%s recursive %v: expected %v, got %v", name, recursive, expected, names)
+			}
+		}
+	}
+}
+
+func TestS3WalkStopsOnVisitorError(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	for _, key := range []string{"data/1", "data/2", "data/3"} {
+		mock.put(key, []byte(key))
+	}
+	visitErr := errors.New("visit failed")
+	var visited []string
+	err := fs.Walk("/data", func(filePath string, file os.FileInfo) error {
+		visited = append(visited, filePath)
+		if len(visited) == 2 {
+			return visitErr
+		}
+		return nil
+	})
+	if err != visitErr {
+		t.Errorf("expected the visitor error, got %v", err)
+	}
+	if len(visited) != 2 {
+		t.Errorf("expected the walk to stop at the second object, visited %v", visited)
+	}
+}
+
+func TestS3WalkContextCancelledAfterFirstPage(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	for i := 0; i < 1500; i++ {
+		mock.put(fmt.Sprintf("data/%05d", i), nil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	err := fs.WalkContext(ctx, "/data", func(string, os.FileInfo) error {
+		visited++
+		if visited == 1000 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if mock.count("ListObjectsV2") != 1 {
+		t.Errorf("expected no listing after the cancel, got %d listings", mock.count("ListObjectsV2"))
+	}
+}
+
+func TestWalkContextStopWalk(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	//a wrapped ErrStopWalk ends the walk the same way
+	stops := []error{ErrStopWalk, fmt.Errorf("found it: %w", ErrStopWalk)}
+	for name, fs := range stores {
+		putKeys(t, fs, "/data/1", "/data/2", "/data/3")
+		for _, stop := range stops {
+			visited := 0
+			err := fs.WalkContext(context.Background(), "/data", func(filePath string, file os.FileInfo) error {
+				if file.IsDir() {
+					return nil
+				}
+				visited++
+				return stop
+			})
+			if err != nil {
+				t.Errorf("%s: expected %v to end the walk without an error, got %v", name, stop, err)
+			}
+			if visited != 1 {
+				t.Errorf("%s: expected the walk to stop at the first object, visited %d", name, visited)
+			}
+		}
+	}
+}
+
+func TestGlobNestedPattern(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		putKeys(t, fs,
+			"/logs/2023-01/a.gz", "/logs/2023-01/b.txt", "/logs/2023-02/c.gz",
+			"/logs/2024-01/d.gz", "/logs/2023-03/nested/e.gz", "/logs/2023-1/f.gz", "/top.txt",
+		)
+		tests := []struct {
+			pattern  string
+			expected []string
+		}{
+			{"/logs/2023-*/*.gz", []string{"/logs/2023-01/a.gz", "/logs/2023-02/c.gz", "/logs/2023-1/f.gz"}},
+			//directories match like they do for filepath.Glob
+			{"/logs/2023-0?/*", []string{"/logs/2023-01/a.gz", "/logs/2023-01/b.txt", "/logs/2023-02/c.gz", "/logs/2023-03/nested"}},
+			{"/logs/*/nested/*.gz", []string{"/logs/2023-03/nested/e.gz"}},
+			{"/logs/2025-*/*.gz", nil},
+			{"/*.txt", []string{"/top.txt"}},
+			{"/*", []string{"/logs", "/top.txt"}},
+		}
+		for _, test := range tests {
+			matches, err := fs.Glob(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found []string
+			for _, match := range matches {
+				found = append(found, "/"+strings.TrimPrefix(path.Join(match.Path, match.Name), "/"))
+				if strings.Count(test.pattern, "/") == 1 && match.Path != "/" {
+					t.Errorf("%s %s: expected the root as the path of %s, got %q", name, test.pattern, match.Name, match.Path)
+				}
+			}
+			sort.Strings(found)
+			if !reflect.DeepEqual(found, test.expected) {
+				t.Errorf("%s %s: expected %v, got %v", name, test.pattern, test.expected, found)
+			}
+		}
+	}
+}
+
+func TestWalkConcurrentVisitsEachObjectOnce(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	for i := 0; i < 2500; i++ {
+		mock.put(fmt.Sprintf("data/%05d", i), nil)
+	}
+	var mu sync.Mutex
+	visits := make(map[string]int)
+	err := WalkConcurrent(fs, "/data", 4, func(filePath string, file os.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		visits[filePath]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visits) != 2500 {
+		t.Errorf("expected all 2500 objects to be visited, got %d", len(visits))
+	}
+	for filePath, count := range visits {
+		if count != 1 {
+			t.Errorf("expected %s to be visited once, got %d", filePath, count)
+		}
+	}
+}
+
+func TestWalkConcurrentErrorAbortsWalk(t *testing.T) {
+	fs, mock := newTestS3FS(t)
+	for i := 0; i < 2500; i++ {
+		mock.put(fmt.Sprintf("data/%05d", i), nil)
+	}
+	visitErr := errors.New("checksum failed")
+	var mu sync.Mutex
+	visited := 0
+	err := WalkConcurrent(fs, "/data", 4, func(filePath string, file os.FileInfo) error {
+		mu.Lock()
+		visited++
+		mu.Unlock()
+		if filePath == "/data/00010" {
+			return visitErr
+		}
+		return nil
+	})
+	if err != visitErr {
+		t.Errorf("expected the visitor error, got %v", err)
+	}
+	if visited >= 2500 || mock.count("ListObjectsV2") != 1 {
+		t.Errorf("expected the error to stop the walk, visited %d with %d listings", visited, mock.count("ListObjectsV2"))
+	}
+
+	err = WalkConcurrent(fs, "/data", 4, func(string, os.FileInfo) error { return ErrStopWalk })
+	if err != nil {
+		t.Errorf("expected ErrStopWalk to end the walk without an error, got %v", err)
+	}
+}
+
+func TestListDirs(t *testing.T) {
+	s3fs, mock := newTestS3FS(t)
+	mock.put("data/marker/", nil)
+	stores := map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs}
+	for name, fs := range stores {
+		putKeys(t, fs, "/data/b/1", "/data/a/nested/2", "/data/file.txt", "/data/c.txt")
+		if err := fs.CreateDir("/data/marker"); err != nil {
+			t.Fatal(err)
+		}
+		dirs, err := fs.ListDirs("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"a", "b", "marker"}
+		if !reflect.DeepEqual(dirs, expected) {
+			t.Errorf("%s: expected only the directories %v, got %v", name, expected, dirs)
+		}
+	}
+}
+
+func TestS3WalkDirVisitsPrefixesAsDirectories(t *testing.T) {
+	fs, _ := newTestS3FS(t)
+	putKeys(t, fs, "/data/sub/1", "/data/file.txt")
+	dirs := make(map[string]os.FileInfo)
+	err := fs.WalkDir("/data", func(filePath string, file os.FileInfo, isDir bool) error {
+		if isDir {
+			dirs[filePath] = file
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := dirs["/data/sub/"]
+	if !ok {
+		t.Fatalf("expected the sub prefix to be visited as a directory, got %v", dirs)
+	}
+	if !info.IsDir() || info.Mode()&os.ModeDir == 0 || info.Name() != "data/sub/" {
+		t.Errorf("expected the data/sub/ prefix with os.ModeDir, got %s %v %s", info.Name(), info.IsDir(), info.Mode())
+	}
+	if len(dirs) != 1 {
+		t.Errorf("expected only the prefix to be a directory, got %v", dirs)
+	}
+}
+
+func TestBlockFSWalkSymlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "data", "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "data", "real", "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "data", "real"), filepath.Join(root, "data", "linked")); err != nil {
+		t.Skipf("symlinks aren't supported: %s", err)
+	}
+	//a link back to its parent would loop forever if it was descended into
+	if err := os.Symlink(filepath.Join(root, "data"), filepath.Join(root, "data", "real", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		follow   bool
+		expected []string
+	}{
+		{false, []string{"/data/linked", "/data/real/file.txt", "/data/real/loop"}},
+		{true, []string{"/data/linked/file.txt", "/data/real/file.txt"}},
+	}
+	for _, test := range tests {
+		fs, err := NewBlockFS(BlockFSConfig{RootDir: root, FollowSymlinks: test.follow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dirs []string
+		visited := walkedFiles(t, func(visit FileVisitFunction) error {
+			return fs.Walk("/data", func(filePath string, file os.FileInfo) error {
+				if file.IsDir() {
+					dirs = append(dirs, filePath)
+				}
+				return visit(filePath, file)
+			})
+		})
+		sort.Strings(visited)
+		if !reflect.DeepEqual(visited, test.expected) {
+			t.Errorf("follow %v: expected %v, got %v", test.follow, test.expected, visited)
+		}
+		if test.follow {
+			sort.Strings(dirs)
+			expected := []string{"/data", "/data/linked", "/data/linked/loop", "/data/real", "/data/real/loop"}
+			if !reflect.DeepEqual(dirs, expected) {
+				t.Errorf("expected the loops to be visited without descending, got %v", dirs)
+			}
+		}
+	}
+}
+
+// pagedNames lists the directory a page at a time and returns the names of the entries of every page, failing when a
+// page is larger than pageSize
+func pagedNames(t *testing.T, fs FileStore, dirPath string, pageSize int) ([]string, int) {
+	t.Helper()
+	var names []string
+	var token string
+	pages := 0
+	for {
+		page, next, err := fs.GetDirPage(dirPath, token, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > pageSize {
+			t.Fatalf("expected at most %d entries in a page, got %d", pageSize, len(page))
+		}
+		pages++
+		for _, o := range page {
+			names = append(names, o.Name)
+		}
+		if next == "" {
+			return names, pages
+		}
+		token = next
+	}
+}
+
+func TestGetDirRoot(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		putKeys(t, fs, "/dir/a.txt", "/top.txt")
+		for _, root := range []string{"/", ""} {
+			listing, err := fs.GetDir(root, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, o := range *listing {
+				names = append(names, o.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, []string{"dir", "top.txt"}) {
+				t.Errorf("%s: expected the root of %q to list its directory and file, got %v", name, root, names)
+			}
+		}
+	}
+}
+
+func TestGetDirPage(t *testing.T) {
+	s3fs, _ := newTestS3FS(t)
+	for name, fs := range map[string]FileStore{"BlockFS": newTestBlockFS(t), "S3FS": s3fs} {
+		putKeys(t, fs, "/dir/a.txt", "/dir/b.txt", "/dir/c.txt", "/dir/d.txt", "/dir/sub/e.txt", "/top.txt")
+
+		names, pages := pagedNames(t, fs, "/dir", 2)
+		if !reflect.DeepEqual(names, []string{"a.txt", "b.txt", "c.txt", "d.txt", "sub"}) {
+			t.Errorf("%s: expected each entry once in name order, got %v", name, names)
+		}
+		if pages != 3 {
+			t.Errorf("%s: expected 3 pages of 2, got %d", name, pages)
+		}
+
+		page, next, err := fs.GetDirPage("/", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != "" || len(page) != 2 {
+			t.Errorf("%s: expected the root listed in one default page, got %v next %q", name, page, next)
+		}
+		for _, o := range page {
+			if o.Name == "top.txt" && (o.IsDir || o.SizeBytes != int64(len("/top.txt"))) {
+				t.Errorf("%s: expected the file entry, got %+v", name, o)
+			}
+			if o.Name == "dir" && !o.IsDir {
+				t.Errorf("%s: expected the directory entry, got %+v", name, o)
+			}
+		}
+	}
+}